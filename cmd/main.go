@@ -2,14 +2,24 @@ package main
 
 import (
 	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/handlers"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/mailer"
 	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"PROJECTTEST/internal/oidc"
+	"PROJECTTEST/internal/payments"
 	"PROJECTTEST/internal/routes"
 	"context"
 	"fmt"
 	"github.com/joho/godotenv"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -25,14 +35,76 @@ func main() {
 		fmt.Println("No URI provided in .env")
 	}
 
-	secret, exists := os.LookupEnv("SECRET")
-	if !exists {
-		fmt.Println("No SECRET provided in .env")
+	// JWT signing keys: a directory of PEM files named <kid>.pem
+	if dir, ok := os.LookupEnv("JWT_KEYS_DIR"); ok && dir != "" {
+		keys, err := middleware.LoadKeySet(dir, os.Getenv("JWT_ACTIVE_KID"))
+		if err != nil {
+			log.Fatalf("Could not load JWT keys: %v", err)
+		}
+		middleware.Keys = keys
+	} else {
+		fmt.Println("No JWT_KEYS_DIR provided, signing with an ephemeral key (tokens will not survive a restart)")
+		keys, err := middleware.GenerateKeySet()
+		if err != nil {
+			log.Fatalf("Could not generate JWT key: %v", err)
+		}
+		middleware.Keys = keys
+	}
+
+	helpers.TrustProxyHeaders = os.Getenv("TRUST_PROXY") == "true"
+
+	m, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure mailer: %v", err)
+	}
+	handlers.Mailer = m
+	if base, ok := os.LookupEnv("APP_BASE_URL"); ok && base != "" {
+		handlers.AppBaseURL = strings.TrimRight(base, "/")
+	}
+
+	providers, err := oidc.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure OIDC providers: %v", err)
+	}
+	handlers.OIDCProviders = providers
+
+	pay, err := payments.FromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure payments: %v", err)
+	}
+	if fake, ok := pay.(*payments.Fake); ok {
+		if fake.WebhookURL == "" {
+			fake.WebhookURL = "http://localhost:8080/api/payments/webhook/fake"
+		}
+		fmt.Println("Using the fake payment provider")
+	}
+	handlers.PaymentProvider = pay
+
+	rates, err := money.FromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure currencies: %v", err)
 	}
+	handlers.ExchangeRates = rates
 
-	middleware.JWTSecret = []byte(secret)
+	if v, ok := os.LookupEnv("LEGACY_PRODUCT_STOCK"); ok && v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid LEGACY_PRODUCT_STOCK %q", v)
+		}
+		database.LegacyStock = n
+	}
 	database.ConnectDB(uri)
 
+	if admin, ok := os.LookupEnv("ADMIN_USERNAME"); ok && admin != "" {
+		if err := handlers.GrantRole(admin, models.RoleAdmin); err != nil {
+			fmt.Printf("Could not grant admin role to %s: %v\n", admin, err)
+		}
+	}
+
+	// background jobs
+	go every(time.Minute, "expiring pending orders", handlers.ExpirePendingOrders)
+	go every(5*time.Minute, "reconciling the ledger", handlers.ReconcileLedger)
+
 	// Setup HTTP server
 	r := routes.InitRoutes()
 	server := &http.Server{
@@ -40,6 +112,19 @@ func main() {
 		Handler: r,
 	}
 
+	// SIGHUP reloads the JWT keys, so a new key can be rotated in without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := middleware.Keys.Reload(); err != nil {
+				fmt.Printf("Could not reload JWT keys: %v\n", err)
+				continue
+			}
+			fmt.Println("JWT keys reloaded")
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
@@ -63,3 +148,18 @@ func main() {
 	database.CloseDB() // Disconnect MongoDB
 	fmt.Println("Server gracefully stopped")
 }
+
+// every runs job now and then each interval, logging failures; the next
+// run retries.
+func every(interval time.Duration, what string, job func(context.Context) error) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := job(ctx); err != nil {
+			log.Printf("Error %s: %v", what, err)
+		}
+		cancel()
+		<-t.C
+	}
+}
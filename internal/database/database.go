@@ -1,10 +1,16 @@
 package database
 
 import (
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
@@ -21,8 +27,34 @@ var (
 	UsersColl        *mongo.Collection
 	ProductsColl     *mongo.Collection
 	InteractionsColl *mongo.Collection
+
+	RefreshTokensColl *mongo.Collection
+	EmailTokensColl   *mongo.Collection
+	LoginThrottleColl *mongo.Collection
+	LoginEventsColl   *mongo.Collection
+	OIDCStatesColl    *mongo.Collection
+	UsedMFATokensColl *mongo.Collection
+	APIKeysColl       *mongo.Collection
+	SellersColl       *mongo.Collection
+	CartsColl         *mongo.Collection
+	OrdersColl        *mongo.Collection
+	PaymentsColl      *mongo.Collection
+	PaymentEventsColl *mongo.Collection
+	CouponsColl       *mongo.Collection
+	RedemptionsColl   *mongo.Collection
+	PriceHistoryColl  *mongo.Collection
+	TaxRulesColl      *mongo.Collection
+	ShippingColl      *mongo.Collection
+	ReturnsColl       *mongo.Collection
+	CommissionColl    *mongo.Collection
+	LedgerColl        *mongo.Collection
+	PayoutsColl       *mongo.Collection
 )
 
+// LegacyStock is the stock given to products created before stock was
+// tracked, so they stay on sale. Set by main from LEGACY_PRODUCT_STOCK.
+var LegacyStock = 100
+
 func ConnectDB(uri string) {
 	once.Do(func() {
 		serverAPI := options.ServerAPI(options.ServerAPIVersion1)
@@ -46,6 +78,45 @@ func ConnectDB(uri string) {
 		UsersColl = client.Database("databaseproject").Collection("users")
 		ProductsColl = client.Database("databaseproject").Collection("products")
 		InteractionsColl = client.Database("databaseproject").Collection("interactions")
+
+		RefreshTokensColl = client.Database("databaseproject").Collection("refresh_tokens")
+		EmailTokensColl = client.Database("databaseproject").Collection("email_tokens")
+		LoginThrottleColl = client.Database("databaseproject").Collection("login_throttle")
+		LoginEventsColl = client.Database("databaseproject").Collection("login_events")
+		OIDCStatesColl = client.Database("databaseproject").Collection("oidc_states")
+		UsedMFATokensColl = client.Database("databaseproject").Collection("used_mfa_tokens")
+		APIKeysColl = client.Database("databaseproject").Collection("api_keys")
+		SellersColl = client.Database("databaseproject").Collection("sellers")
+		CartsColl = client.Database("databaseproject").Collection("carts")
+		OrdersColl = client.Database("databaseproject").Collection("orders")
+		PaymentsColl = client.Database("databaseproject").Collection("payments")
+		PaymentEventsColl = client.Database("databaseproject").Collection("payment_events")
+		CouponsColl = client.Database("databaseproject").Collection("coupons")
+		RedemptionsColl = client.Database("databaseproject").Collection("coupon_redemptions")
+		PriceHistoryColl = client.Database("databaseproject").Collection("price_history")
+		TaxRulesColl = client.Database("databaseproject").Collection("tax_rules")
+		ShippingColl = client.Database("databaseproject").Collection("shipping_methods")
+		ReturnsColl = client.Database("databaseproject").Collection("returns")
+		CommissionColl = client.Database("databaseproject").Collection("commission_rules")
+		LedgerColl = client.Database("databaseproject").Collection("ledger_entries")
+		PayoutsColl = client.Database("databaseproject").Collection("payout_batches")
+
+		if err = ensureIndexes(); err != nil {
+			clientInstanceError = fmt.Errorf("failed to create indexes: %v", err)
+			return
+		}
+		if err = migrateLegacyPrices(); err != nil {
+			clientInstanceError = fmt.Errorf("failed to migrate prices: %v", err)
+			return
+		}
+		if err = migrateLegacyStock(); err != nil {
+			clientInstanceError = fmt.Errorf("failed to migrate stock: %v", err)
+			return
+		}
+		if err = hideClosedStores(); err != nil {
+			clientInstanceError = fmt.Errorf("failed to hide closed stores: %v", err)
+			return
+		}
 	})
 
 	if clientInstanceError != nil {
@@ -53,6 +124,296 @@ func ConnectDB(uri string) {
 	}
 }
 
+// ensureIndexes creates the indexes the application relies on for
+// uniqueness and expiry. CreateMany is a no-op for indexes that already exist.
+func ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := RefreshTokensColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		// expired refresh tokens are useless, let Mongo drop them
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = UsersColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// older accounts have an empty email, only real addresses must be unique
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+		},
+		// an external account can be linked to one user only
+		{
+			Keys:    bson.D{{Key: "identities.key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"identities.key": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = APIKeysColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = ProductsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "owner_id", Value: 1}}},
+		{Keys: bson.D{{Key: "seller_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "variants.sku", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"variants.sku": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = SellersColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = OIDCStatesColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "state_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	// a used mfa token only has to be remembered until it would expire
+	_, err = UsedMFATokensColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = EmailTokensColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	// counters of keys nobody failed on for a day are not interesting anymore
+	_, err = LoginThrottleColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_failure_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = LoginEventsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "ip", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// guest carts carry expires_at, user carts don't and never expire
+	_, err = CartsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"user_id": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{Key: "guest_token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"guest_token_hash": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = OrdersColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "seller_ids", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// one attempt number per order keeps concurrent pay requests apart
+	_, err = PaymentsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}, {Key: "attempt", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "intent_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = CouponsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner_seller_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = RedemptionsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "coupon_id", Value: 1}, {Key: "user_id", Value: 1}}},
+		// each of a user's uses under a per-user limit takes its own slot
+		{
+			Keys:    bson.D{{Key: "coupon_id", Value: 1}, {Key: "user_id", Value: 1}, {Key: "slot", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"slot": bson.M{"$exists": true}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = PriceHistoryColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "product_id", Value: 1}, {Key: "at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = TaxRulesColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "country", Value: 1}, {Key: "active", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = ReturnsColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "seller_id", Value: 1}, {Key: "status", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = LedgerColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "tx_key", Value: 1}}},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "seller_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "order_id", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// one payout run at a time
+	_, err = PayoutsColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "status", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"status": "running"}),
+	})
+	return err
+}
+
+// migrateLegacyPrices turns prices stored as plain numbers (major units of
+// the store currency) into money documents, so filters can query
+// price.amount and coupons find their amounts where they now look. Other
+// documents are read through money.Money's decoder and converted when next
+// written.
+func migrateLegacyPrices() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := migrateMoneyFields(ctx, ProductsColl, "price", "compare_at_price", "sale_price"); err != nil {
+		return err
+	}
+	// fixed coupons kept their amount in value, next to the percentages
+	_, err := CouponsColl.UpdateMany(ctx, bson.M{"type": "fixed", "value": bson.M{"$type": "number"}, "amount": bson.M{"$exists": false}}, bson.A{
+		bson.M{"$set": bson.M{"amount": "$value"}},
+		bson.M{"$unset": "value"},
+	})
+	if err != nil {
+		return err
+	}
+	return migrateMoneyFields(ctx, CouponsColl, "amount", "min_order_value", "max_discount")
+}
+
+// migrateLegacyStock gives products without a stock field LegacyStock
+// units and nothing reserved; stock guards and filters need the field.
+func migrateLegacyStock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	_, err := ProductsColl.UpdateMany(ctx, bson.M{"stock": bson.M{"$exists": false}}, bson.M{"$set": bson.M{
+		"stock":    LegacyStock,
+		"reserved": 0,
+	}})
+	return err
+}
+
+// hideClosedStores hides the products of stores that were closed before
+// products could be hidden: stores that are not approved and stores of
+// suspended users. Later changes keep the flag up to date themselves.
+func hideClosedStores() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	var owners []bson.ObjectID
+	err := UsersColl.Distinct(ctx, "_id", bson.M{"status": models.UserStatusSuspended}).Decode(&owners)
+	if err != nil {
+		return err
+	}
+	if owners == nil {
+		owners = []bson.ObjectID{} // $in needs an array
+	}
+	var stores []bson.ObjectID
+	err = SellersColl.Distinct(ctx, "_id", bson.M{"$or": bson.A{
+		bson.M{"status": bson.M{"$ne": models.SellerStatusApproved}},
+		bson.M{"user_id": bson.M{"$in": owners}},
+	}}).Decode(&stores)
+	if err != nil {
+		return err
+	}
+	if len(stores) == 0 {
+		return nil
+	}
+	_, err = ProductsColl.UpdateMany(ctx,
+		bson.M{"seller_id": bson.M{"$in": stores}, "hidden": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"hidden": true}},
+	)
+	return err
+}
+
+// migrateMoneyFields converts the fields where they are still numbers to
+// money documents in the store currency.
+func migrateMoneyFields(ctx context.Context, coll *mongo.Collection, fields ...string) error {
+	scale := math.Pow10(money.Exponent(money.Default))
+	for _, field := range fields {
+		_, err := coll.UpdateMany(ctx, bson.M{field: bson.M{"$type": "number"}}, bson.A{
+			bson.M{"$set": bson.M{field: bson.M{
+				"amount":   bson.M{"$toLong": bson.M{"$round": bson.A{bson.M{"$multiply": bson.A{"$" + field, scale}}, 0}}},
+				"currency": money.Default,
+			}}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetClient returns the MongoDB client (optional, if needed elsewhere).
 func GetClient() *mongo.Client {
 	return clientInstance
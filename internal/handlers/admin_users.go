@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// adminTarget loads the user named in the URL. It writes the error response
+// itself and returns false when there is nothing to act on.
+func adminTarget(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var user models.User
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return user, false
+	}
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return user, false
+	}
+	return user, true
+}
+
+// notSelf stops admins from suspending, demoting or deleting themselves,
+// which could leave nobody able to undo it.
+func notSelf(w http.ResponseWriter, r *http.Request, user models.User) bool {
+	if p, ok := middleware.UserFrom(r.Context()); ok && p.UserID == user.ID {
+		helpers.RespondError(w, http.StatusBadRequest, "admins cannot do this to their own account")
+		return false
+	}
+	return true
+}
+
+// AdminListUsersHandler lists users. Filters: q (username, email or display
+// name), role, status.
+func AdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, limit, skip := helpers.Pagination(r, 50, 200)
+
+	filter := bson.M{}
+	if s := strings.TrimSpace(q.Get("q")); s != "" {
+		re := bson.M{"$regex": regexp.QuoteMeta(s), "$options": "i"}
+		filter["$or"] = []bson.M{{"username": re}, {"email": re}, {"display_name": re}}
+	}
+	if role := q.Get("role"); role != "" {
+		if role == models.RoleBuyer {
+			// accounts without stored roles are buyers too
+			filter["$and"] = []bson.M{{"$or": []bson.M{{"roles": role}, {"roles": bson.M{"$in": []interface{}{nil, bson.A{}}}}}}}
+		} else {
+			filter["roles"] = role
+		}
+	}
+	switch status := q.Get("status"); status {
+	case "":
+	case models.UserStatusActive:
+		filter["status"] = bson.M{"$ne": models.UserStatusSuspended}
+	case models.UserStatusSuspended:
+		filter["status"] = status
+	default:
+		helpers.RespondError(w, http.StatusBadRequest, "unknown status")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := database.UsersColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := database.UsersColl.Find(ctx, filter, opts)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.User{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func AdminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok {
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"user": user})
+}
+
+func AdminSuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok || !notSelf(w, r, user) {
+		return
+	}
+	_, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{
+		"status":         models.UserStatusSuspended,
+		"suspended_at":   time.Now(),
+		"suspend_reason": strings.TrimSpace(payload.Reason),
+	}})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// AuthMiddleware already refuses suspended users; revoking the sessions
+	// also stops them from refreshing
+	if err := middleware.RevokeUserSessions(ctx, user.ID); err != nil {
+		log.Printf("Error revoking sessions of suspended user: %v", err)
+	}
+	if err := syncStoreListing(ctx, user.ID); err != nil {
+		log.Printf("Error hiding the store of suspended user: %v", err)
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": models.UserStatusSuspended})
+}
+
+func AdminReactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok {
+		return
+	}
+	_, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set":   bson.M{"status": models.UserStatusActive},
+		"$unset": bson.M{"suspended_at": "", "suspend_reason": ""},
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := syncStoreListing(ctx, user.ID); err != nil {
+		log.Printf("Error listing the store of reactivated user: %v", err)
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": models.UserStatusActive})
+}
+
+// AdminSetRolesHandler replaces the user's roles. The seller role is not
+// set here, it is granted and taken with the store, see setSellerStatus.
+func AdminSetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Roles []string `json:"roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || len(payload.Roles) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "roles required")
+		return
+	}
+	for _, role := range payload.Roles {
+		if !models.ValidRole(role) {
+			helpers.RespondError(w, http.StatusBadRequest, "unknown role "+role)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok || !notSelf(w, r, user) {
+		return
+	}
+	roles := uniqueStrings(payload.Roles)
+	isSeller := user.HasRole(models.RoleSeller)
+	if slices.Contains(roles, models.RoleSeller) != isSeller {
+		helpers.RespondError(w, http.StatusBadRequest, "the seller role follows the store status, approve or suspend the store under /api/admin/sellers instead")
+		return
+	}
+	// the store may have been approved or suspended meanwhile
+	sellerFilter := bson.M{"$nin": bson.A{models.RoleSeller}}
+	if isSeller {
+		sellerFilter = bson.M{"$in": bson.A{models.RoleSeller}}
+	}
+	res, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID, "roles": sellerFilter}, bson.M{"$set": bson.M{"roles": roles}})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		helpers.RespondError(w, http.StatusConflict, "the user's store changed, retry")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"roles": roles})
+}
+
+// AdminForcePasswordResetHandler logs the user out everywhere, blocks
+// password logins and mails them a reset link.
+func AdminForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok {
+		return
+	}
+	if _, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"must_reset_password": true}}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := middleware.RevokeUserSessions(ctx, user.ID); err != nil {
+		log.Printf("Error revoking sessions for forced reset: %v", err)
+	}
+
+	emailSent := false
+	if user.Email != "" {
+		if err := sendPasswordResetEmail(ctx, user); err != nil {
+			log.Printf("Error sending password reset email: %v", err)
+		} else {
+			emailSent = true
+		}
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "password reset required",
+		"email_sent": emailSent,
+	})
+}
+
+func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok || !notSelf(w, r, user) {
+		return
+	}
+	if err := deleteAccount(ctx, user); err != nil {
+		log.Printf("Error deleting user %s: %v", user.ID.Hex(), err)
+		helpers.RespondError(w, http.StatusInternalServerError, "could not delete account")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "account deleted"})
+}
+
+func AdminUserInteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit, skip := helpers.Pagination(r, 50, 500)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok {
+		return
+	}
+	filter := bson.M{"user_id": user.ID}
+	if action := r.URL.Query().Get("action_type"); action != "" {
+		filter["action_type"] = action
+	}
+	total, err := database.InteractionsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := database.InteractionsColl.Find(ctx, filter, opts)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Interaction{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func AdminUserLoginEventsHandler(w http.ResponseWriter, r *http.Request) {
+	_, limit, skip := helpers.Pagination(r, 50, 500)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	user, ok := adminTarget(ctx, w, r)
+	if !ok {
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := database.LoginEventsColl.Find(ctx, bson.M{"user_id": user.ID}, opts)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.LoginEvent{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, items)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	apiKeyPrefix     = "mk_"
+	apiKeyShownChars = 12
+	maxAPIKeys       = 20
+	maxAPIKeyNameLen = 64
+)
+
+// CreateAPIKeyHandler creates a key and returns it in plain text. This is
+// the only time the key is shown.
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" || len(payload.Name) > maxAPIKeyNameLen {
+		helpers.RespondError(w, http.StatusBadRequest, "name required (max 64 characters)")
+		return
+	}
+	if len(payload.Scopes) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "at least one scope required")
+		return
+	}
+	for _, s := range payload.Scopes {
+		if !models.ValidScope(s) {
+			helpers.RespondError(w, http.StatusBadRequest, "unknown scope "+s)
+			return
+		}
+	}
+	if payload.ExpiresInDays < 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "expires_in_days must not be negative")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count, err := database.APIKeysColl.CountDocuments(ctx, bson.M{"user_id": principal.UserID, "revoked_at": bson.M{"$exists": false}})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if count >= maxAPIKeys {
+		helpers.RespondError(w, http.StatusBadRequest, "too many api keys, revoke one first")
+		return
+	}
+
+	secret, err := helpers.NewToken(32)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not create key")
+		return
+	}
+	key := apiKeyPrefix + secret
+	now := time.Now()
+	k := models.APIKey{
+		UserID:    principal.UserID,
+		Name:      payload.Name,
+		Prefix:    key[:apiKeyShownChars],
+		KeyHash:   helpers.HashToken(key),
+		Scopes:    uniqueStrings(payload.Scopes),
+		CreatedAt: now,
+	}
+	if payload.ExpiresInDays > 0 {
+		exp := now.AddDate(0, 0, payload.ExpiresInDays)
+		k.ExpiresAt = &exp
+	}
+	res, err := database.APIKeysColl.InsertOne(ctx, k)
+	if err != nil {
+		log.Printf("Error creating api key: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	k.ID = res.InsertedID.(bson.ObjectID)
+
+	helpers.RespondJSON(w, http.StatusCreated, map[string]interface{}{
+		"key":     key,
+		"api_key": k,
+	})
+}
+
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := database.APIKeysColl.Find(ctx, bson.M{"user_id": principal.UserID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.APIKey{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, items)
+}
+
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := database.APIKeysColl.UpdateOne(ctx,
+		bson.M{"_id": id, "user_id": principal.UserID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		helpers.RespondError(w, http.StatusNotFound, "api key not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// authResponse is the body returned whenever a user obtains a new session.
+func authResponse(tokens *middleware.TokenPair, user models.User) map[string]interface{} {
+	return map[string]interface{}{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          user,
+	}
+}
+
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.RefreshToken == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "refresh_token required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tokens, err := middleware.RefreshTokens(ctx, payload.RefreshToken)
+	if errors.Is(err, middleware.ErrInvalidRefreshToken) {
+		helpers.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if errors.Is(err, middleware.ErrAccountSuspended) {
+		helpers.RespondError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing token: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "could not refresh token")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, tokens)
+}
+
+// LogoutHandler revokes the caller's current session, or all of their
+// sessions when {"all": true} is sent.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		All bool `json:"all"`
+	}
+	// body is optional
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var err error
+	if payload.All {
+		err = middleware.RevokeUserSessions(ctx, principal.UserID)
+	} else {
+		err = middleware.RevokeSession(ctx, principal.TokenID)
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "logged out"})
+}
+
+// GrantRole adds a role to the named user. It is used at startup to
+// bootstrap the first admin account from ADMIN_USERNAME.
+func GrantRole(username, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		return err
+	}
+	roles := append(user.EffectiveRoles(), role)
+	_, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"roles": uniqueStrings(roles)}})
+	return err
+}
+
+func uniqueStrings(in []string) []string {
+	seen := map[string]struct{}{}
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
+
+// JWKSHandler publishes the public signing keys so other services can
+// verify marketplace tokens.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	helpers.RespondJSON(w, http.StatusOK, middleware.Keys.JWKS())
+}
@@ -0,0 +1,656 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// CartTokenHeader carries the guest cart token. It is handed out with the
+// first item a guest adds and merged into the user's cart at login.
+const CartTokenHeader = "X-Cart-Token"
+
+const (
+	guestCartTTL    = 30 * 24 * time.Hour
+	maxCartLines    = 100
+	maxLineQuantity = 99
+)
+
+var errCartChanged = errors.New("cart changed, retry")
+
+// cartOwner names a cart by user or by guest token hash.
+type cartOwner struct {
+	userID    bson.ObjectID
+	guestHash string
+}
+
+func (o cartOwner) filter() bson.M {
+	if !o.userID.IsZero() {
+		return bson.M{"user_id": o.userID}
+	}
+	return bson.M{"guest_token_hash": o.guestHash}
+}
+
+func (o cartOwner) none() bool { return o.userID.IsZero() && o.guestHash == "" }
+
+// resolveCartOwner finds whose cart the request is about. With create set,
+// a guest without a token is given one, returned as newToken. It writes the
+// error response itself.
+func resolveCartOwner(w http.ResponseWriter, r *http.Request, create bool) (owner cartOwner, newToken string, ok bool) {
+	if principal, ok := middleware.UserFrom(r.Context()); ok {
+		if principal.IsAPIKey() {
+			helpers.RespondError(w, http.StatusForbidden, "not allowed with an api key")
+			return owner, "", false
+		}
+		return cartOwner{userID: principal.UserID}, "", true
+	}
+	if token := r.Header.Get(CartTokenHeader); token != "" {
+		return cartOwner{guestHash: helpers.HashToken(token)}, "", true
+	}
+	if create {
+		newToken, err := helpers.NewToken(32)
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "could not create cart token")
+			return owner, "", false
+		}
+		return cartOwner{guestHash: helpers.HashToken(newToken)}, newToken, true
+	}
+	return owner, "", true
+}
+
+// loadCart returns the owner's cart, or an empty one if there is none yet.
+func loadCart(ctx context.Context, owner cartOwner) (models.Cart, error) {
+	cart := models.Cart{Items: []models.CartItem{}}
+	if owner.none() {
+		return cart, nil
+	}
+	err := database.CartsColl.FindOne(ctx, owner.filter()).Decode(&cart)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Cart{Items: []models.CartItem{}}, nil
+	}
+	return cart, err
+}
+
+// ensureCart creates the owner's cart if needed and returns it. Guest carts
+// live for guestCartTTL after their last change.
+func ensureCart(ctx context.Context, owner cartOwner) (models.Cart, error) {
+	now := time.Now()
+	set := bson.M{"updated_at": now}
+	if owner.userID.IsZero() {
+		set["expires_at"] = now.Add(guestCartTTL)
+	}
+	var cart models.Cart
+	err := database.CartsColl.FindOneAndUpdate(ctx, owner.filter(), bson.M{
+		"$set":         set,
+		"$setOnInsert": bson.M{"items": bson.A{}, "created_at": now},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&cart)
+	if mongo.IsDuplicateKeyError(err) {
+		// lost the race to create it
+		err = database.CartsColl.FindOne(ctx, owner.filter()).Decode(&cart)
+	}
+	return cart, err
+}
+
+func findLine(cart models.Cart, productID, variantID bson.ObjectID) *models.CartItem {
+	for i := range cart.Items {
+		if cart.Items[i].ProductID == productID && cart.Items[i].VariantID == variantID {
+			return &cart.Items[i]
+		}
+	}
+	return nil
+}
+
+// setLineQuantity changes one line, guarded on the quantity it was computed
+// from, and re-snapshots its price.
+func setLineQuantity(ctx context.Context, cart models.Cart, line models.CartItem, qty int, price money.Money) error {
+	filter := bson.M{"_id": cart.ID, "items": bson.M{"$elemMatch": bson.M{"_id": line.ID, "quantity": line.Quantity}}}
+	res, err := database.CartsColl.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"items.$.quantity":   qty,
+		"items.$.unit_price": price,
+		"updated_at":         time.Now(),
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errCartChanged
+	}
+	return nil
+}
+
+// available is how many units of the product or variant can be sold now.
+func available(p models.Product, v *models.ProductVariant) int {
+	if v != nil {
+		return v.Stock
+	}
+	return p.Stock
+}
+
+// cartLine is a cart item checked against the current catalog. Product is
+// nil when the product or variant is gone.
+type cartLine struct {
+	item         models.CartItem
+	product      *models.Product
+	variant      *models.ProductVariant
+	price        money.Money
+	priceChanged bool
+	available    int
+	status       string
+}
+
+// validateCart re-validates the cart against current prices and stock.
+// Lines whose price moved are re-snapshotted, so a change is reported once
+// and checkout can trust the stored price afterwards.
+func validateCart(ctx context.Context, cart models.Cart) ([]cartLine, error) {
+	ids := make([]bson.ObjectID, 0, len(cart.Items))
+	for _, it := range cart.Items {
+		ids = append(ids, it.ProductID)
+	}
+	products := map[bson.ObjectID]models.Product{}
+	if len(ids) > 0 {
+		cursor, err := database.ProductsColl.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return nil, err
+		}
+		var list []models.Product
+		if err := cursor.All(ctx, &list); err != nil {
+			return nil, err
+		}
+		for _, p := range list {
+			products[p.ID] = p
+		}
+	}
+
+	lines := make([]cartLine, 0, len(cart.Items))
+	for _, it := range cart.Items {
+		line := cartLine{item: it, price: it.UnitPrice, status: "unavailable"}
+		p, ok := products[it.ProductID]
+		if ok {
+			v, err := buyableVariant(p, it.VariantID)
+			if err == nil {
+				line.product, line.variant = &p, v
+			}
+		}
+		if line.product == nil {
+			lines = append(lines, line)
+			continue
+		}
+
+		line.price = p.UnitPrice(line.variant)
+		if !line.price.In(money.Default) {
+			// priced before the store currency changed; not sellable until repriced
+			line.product, line.variant, line.price = nil, nil, it.UnitPrice
+			lines = append(lines, line)
+			continue
+		}
+		if line.price != it.UnitPrice {
+			line.priceChanged = true
+			_, err := database.CartsColl.UpdateOne(ctx, bson.M{"_id": cart.ID, "items._id": it.ID},
+				bson.M{"$set": bson.M{"items.$.unit_price": line.price}})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		line.available = available(p, line.variant)
+		switch {
+		case line.available <= 0:
+			line.status = "out_of_stock"
+		case line.available < it.Quantity:
+			line.status = "insufficient_stock"
+		default:
+			line.status = "ok"
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// cartView renders a validated cart, with the totals also in the display
+// currency cur.
+func cartView(ctx context.Context, cart models.Cart, cur string) (map[string]interface{}, error) {
+	lines, err := validateCart(ctx, cart)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]map[string]interface{}, 0, len(lines))
+	subtotal := money.Zero(money.Default)
+	count := 0
+	valid := true
+	for _, l := range lines {
+		item := map[string]interface{}{
+			"id":         l.item.ID,
+			"product_id": l.item.ProductID,
+			"quantity":   l.item.Quantity,
+			"unit_price": l.price,
+			"status":     l.status,
+		}
+		if !l.item.VariantID.IsZero() {
+			item["variant_id"] = l.item.VariantID
+		}
+		items = append(items, item)
+		if l.status != "ok" {
+			valid = false
+		}
+		if l.product == nil {
+			continue
+		}
+
+		item["name"] = l.product.Name
+		item["image_url"] = l.product.ImageURL
+		if l.variant != nil {
+			item["sku"] = l.variant.SKU
+			item["size"] = l.variant.Size
+			item["color"] = l.variant.Color
+		}
+		item["price_changed"] = l.priceChanged
+		if l.priceChanged {
+			item["previous_unit_price"] = l.item.UnitPrice
+		}
+		item["available"] = l.available
+		if l.status == "out_of_stock" {
+			continue
+		}
+		item["line_total"] = l.price.Mul(l.item.Quantity)
+		subtotal = subtotal.Add(l.price.Mul(l.item.Quantity))
+		count += l.item.Quantity
+	}
+
+	view := map[string]interface{}{
+		"id":         cart.ID,
+		"items":      items,
+		"item_count": count,
+		"subtotal":   subtotal,
+		"discount":   money.Zero(subtotal.Currency),
+		"total":      subtotal,
+		"valid":      valid,
+	}
+	defer func() {
+		view["display"] = displayAmounts(cur, map[string]money.Money{
+			"subtotal": subtotal,
+			"discount": view["discount"].(money.Money),
+			"total":    view["total"].(money.Money),
+		})
+	}()
+	if cart.CouponCode == "" {
+		return view, nil
+	}
+
+	// the coupon is checked again on every read; one that stopped applying
+	// stays on the cart with its reason
+	coupon := map[string]interface{}{"code": cart.CouponCode, "valid": false}
+	c, err := findCoupon(ctx, cart.CouponCode)
+	var res *couponResult
+	if err == nil {
+		res, err = evaluateCoupon(ctx, c, cart.UserID, lines)
+	}
+	var reason couponError
+	switch {
+	case errors.As(err, &reason):
+		coupon["reason"] = reason.Error()
+	case err != nil:
+		return nil, err
+	default:
+		coupon["valid"] = true
+		coupon["type"] = c.Type
+		coupon["discount"] = res.discount
+		coupon["free_shipping"] = res.freeShipping
+		view["discount"] = res.discount
+		view["total"] = subtotal.Sub(res.discount)
+	}
+	view["coupon"] = coupon
+	return view, nil
+}
+
+func respondCart(w http.ResponseWriter, r *http.Request, ctx context.Context, status int, owner cartOwner, newToken string) {
+	cur, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cart, err := loadCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	view, err := cartView(ctx, cart, cur)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if newToken != "" {
+		view["cart_token"] = newToken
+	}
+	helpers.RespondJSON(w, status, view)
+}
+
+func GetCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
+
+// AddCartItemHandler adds units of a product (or variant) to the cart,
+// merging with an existing line for the same item.
+func AddCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ProductID string `json:"product_id"`
+		VariantID string `json:"variant_id"`
+		Quantity  *int   `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	pid, err := bson.ObjectIDFromHex(payload.ProductID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid product id")
+		return
+	}
+	var vid bson.ObjectID
+	if payload.VariantID != "" {
+		if vid, err = bson.ObjectIDFromHex(payload.VariantID); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+			return
+		}
+	}
+	qty := 1
+	if payload.Quantity != nil {
+		qty = *payload.Quantity
+	}
+	if qty < 1 || qty > maxLineQuantity {
+		helpers.RespondError(w, http.StatusBadRequest, fmt.Sprintf("quantity must be 1-%d", maxLineQuantity))
+		return
+	}
+
+	owner, newToken, ok := resolveCartOwner(w, r, true)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var p models.Product
+	if err := database.ProductsColl.FindOne(ctx, listedFilter(bson.M{"_id": pid})).Decode(&p); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "product not found")
+		return
+	}
+	v, err := buyableVariant(p, vid)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	price := p.UnitPrice(v)
+
+	cart, err := ensureCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	total := qty
+	line := findLine(cart, pid, vid)
+	if line != nil {
+		total += line.Quantity
+	}
+	if total > maxLineQuantity {
+		helpers.RespondError(w, http.StatusBadRequest, fmt.Sprintf("at most %d of one item per cart", maxLineQuantity))
+		return
+	}
+	if stock := available(p, v); total > stock {
+		helpers.RespondError(w, http.StatusConflict, fmt.Sprintf("only %d in stock", max(stock, 0)))
+		return
+	}
+
+	if line != nil {
+		err = setLineQuantity(ctx, cart, *line, total, price)
+	} else {
+		if len(cart.Items) >= maxCartLines {
+			helpers.RespondError(w, http.StatusBadRequest, "cart is full")
+			return
+		}
+		item := models.CartItem{ID: bson.NewObjectID(), ProductID: pid, VariantID: vid, Quantity: qty, UnitPrice: price, AddedAt: time.Now()}
+		lineMatch := bson.M{"product_id": pid, "variant_id": bson.M{"$exists": false}}
+		if !vid.IsZero() {
+			lineMatch["variant_id"] = vid
+		}
+		var res *mongo.UpdateResult
+		res, err = database.CartsColl.UpdateOne(ctx,
+			bson.M{"_id": cart.ID, "items": bson.M{"$not": bson.M{"$elemMatch": lineMatch}}},
+			bson.M{"$push": bson.M{"items": item}, "$set": bson.M{"updated_at": time.Now()}})
+		if err == nil && res.MatchedCount == 0 {
+			err = errCartChanged
+		}
+	}
+	if errors.Is(err, errCartChanged) {
+		helpers.RespondError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	respondCart(w, r, ctx, http.StatusCreated, owner, newToken)
+}
+
+// UpdateCartItemHandler sets the quantity of a line; zero removes it.
+func UpdateCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Quantity *int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Quantity == nil {
+		helpers.RespondError(w, http.StatusBadRequest, "quantity required")
+		return
+	}
+	qty := *payload.Quantity
+	if qty < 0 || qty > maxLineQuantity {
+		helpers.RespondError(w, http.StatusBadRequest, fmt.Sprintf("quantity must be 0-%d", maxLineQuantity))
+		return
+	}
+	itemID, err := bson.ObjectIDFromHex(mux.Vars(r)["itemId"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid item id")
+		return
+	}
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+	if qty == 0 {
+		removeCartItem(w, r, owner, itemID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cart, err := loadCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	var line *models.CartItem
+	for i := range cart.Items {
+		if cart.Items[i].ID == itemID {
+			line = &cart.Items[i]
+		}
+	}
+	if line == nil {
+		helpers.RespondError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	var p models.Product
+	if err := database.ProductsColl.FindOne(ctx, bson.M{"_id": line.ProductID}).Decode(&p); err != nil {
+		helpers.RespondError(w, http.StatusConflict, "product no longer available")
+		return
+	}
+	v, err := buyableVariant(p, line.VariantID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusConflict, "product no longer available")
+		return
+	}
+	if stock := available(p, v); qty > stock {
+		helpers.RespondError(w, http.StatusConflict, fmt.Sprintf("only %d in stock", max(stock, 0)))
+		return
+	}
+
+	err = setLineQuantity(ctx, cart, *line, qty, p.UnitPrice(v))
+	if errors.Is(err, errCartChanged) {
+		helpers.RespondError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
+
+func RemoveCartItemHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := bson.ObjectIDFromHex(mux.Vars(r)["itemId"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid item id")
+		return
+	}
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+	removeCartItem(w, r, owner, itemID)
+}
+
+func removeCartItem(w http.ResponseWriter, r *http.Request, owner cartOwner, itemID bson.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := owner.filter()
+	filter["items._id"] = itemID
+	res, err := database.CartsColl.UpdateOne(ctx, filter, bson.M{
+		"$pull": bson.M{"items": bson.M{"_id": itemID}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if owner.none() || res.MatchedCount == 0 {
+		helpers.RespondError(w, http.StatusNotFound, "item not found")
+		return
+	}
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
+
+func ClearCartHandler(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !owner.none() {
+		_, err := database.CartsColl.UpdateOne(ctx, owner.filter(), bson.M{"$set": bson.M{"items": bson.A{}, "updated_at": time.Now()}, "$unset": bson.M{"coupon_code": ""}})
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
+
+// mergeGuestCart moves the guest cart's lines into the user's cart. Lines
+// for the same item add up, capped at maxLineQuantity; stock is left to the
+// next read to report.
+func mergeGuestCart(ctx context.Context, guestToken string, userID bson.ObjectID) error {
+	if guestToken == "" {
+		return nil
+	}
+	// claim the guest cart first so two logins can't both merge it
+	var guest models.Cart
+	err := database.CartsColl.FindOneAndDelete(ctx, bson.M{"guest_token_hash": helpers.HashToken(guestToken)}).Decode(&guest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(guest.Items) == 0 {
+		return nil
+	}
+
+	owner := cartOwner{userID: userID}
+	for attempt := 0; attempt < 3; attempt++ {
+		cart, err := ensureCart(ctx, owner)
+		if err != nil {
+			break
+		}
+		items := append([]models.CartItem{}, cart.Items...)
+		for _, g := range guest.Items {
+			if line := findLine(models.Cart{Items: items}, g.ProductID, g.VariantID); line != nil {
+				line.Quantity = min(line.Quantity+g.Quantity, maxLineQuantity)
+				continue
+			}
+			if len(items) < maxCartLines {
+				items = append(items, g)
+			}
+		}
+		set := bson.M{"items": items, "updated_at": time.Now()}
+		if cart.CouponCode == "" && guest.CouponCode != "" {
+			set["coupon_code"] = guest.CouponCode
+		}
+		var res *mongo.UpdateResult
+		res, err = database.CartsColl.UpdateOne(ctx, bson.M{"_id": cart.ID, "updated_at": cart.UpdatedAt},
+			bson.M{"$set": set})
+		if err != nil {
+			break
+		}
+		if res.MatchedCount > 0 {
+			return nil
+		}
+	}
+
+	// put the guest cart back rather than lose it
+	if _, err := database.CartsColl.InsertOne(ctx, guest); err != nil {
+		log.Printf("Error restoring guest cart %s: %v", guest.ID.Hex(), err)
+	}
+	return errors.New("could not merge guest cart")
+}
+
+// MergeCartHandler merges the guest cart named by X-Cart-Token into the
+// caller's cart, for logins that could not carry the header.
+func MergeCartHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mergeGuestCart(ctx, r.Header.Get(CartTokenHeader), principal.UserID); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	respondCart(w, r, ctx, http.StatusOK, cartOwner{userID: principal.UserID}, "")
+}
@@ -0,0 +1,563 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var couponCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// couponError is a reason to refuse a coupon that can be shown to the buyer.
+type couponError string
+
+func (e couponError) Error() string { return string(e) }
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func findCoupon(ctx context.Context, code string) (models.Coupon, error) {
+	var c models.Coupon
+	err := database.CouponsColl.FindOne(ctx, bson.M{"code": normalizeCouponCode(code)}).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return c, couponError("coupon not found")
+	}
+	return c, err
+}
+
+// couponResult is what a coupon takes off a cart. lineDiscounts spreads
+// the discount over the eligible lines, keyed by cart item id.
+type couponResult struct {
+	coupon        models.Coupon
+	discount      money.Money
+	freeShipping  bool
+	lineDiscounts map[bson.ObjectID]money.Money
+}
+
+// evaluateCoupon checks the coupon against the cart lines and works out the
+// discount. Rejections are couponErrors. userID is zero for guests.
+func evaluateCoupon(ctx context.Context, c models.Coupon, userID bson.ObjectID, lines []cartLine) (*couponResult, error) {
+	now := time.Now()
+	switch {
+	case !c.Active:
+		return nil, couponError("coupon is not active")
+	case c.StartsAt != nil && now.Before(*c.StartsAt):
+		return nil, couponError("coupon is not valid yet")
+	case c.EndsAt != nil && !now.Before(*c.EndsAt):
+		return nil, couponError("coupon has expired")
+	case c.UsageLimit > 0 && c.UsedCount >= c.UsageLimit:
+		return nil, couponError("coupon usage limit reached")
+	}
+	if money.Check(money.Default, c.Amount, c.MinOrderValue, c.MaxDiscount) != nil {
+		return nil, couponError("coupon is not valid in " + money.Default)
+	}
+	if c.PerUserLimit > 0 {
+		if userID.IsZero() {
+			return nil, couponError("log in to use this coupon")
+		}
+		used, err := database.RedemptionsColl.CountDocuments(ctx, bson.M{"coupon_id": c.ID, "user_id": userID})
+		if err != nil {
+			return nil, err
+		}
+		if int(used) >= c.PerUserLimit {
+			return nil, couponError("you have already used this coupon")
+		}
+	}
+
+	subtotal, eligibleTotal := money.Zero(money.Default), money.Zero(money.Default)
+	var eligible []cartLine
+	var weights []int64
+	for _, l := range lines {
+		if l.product == nil || l.status == "out_of_stock" {
+			continue
+		}
+		total := l.price.Mul(l.item.Quantity)
+		subtotal = subtotal.Add(total)
+		if couponApplies(c, *l.product) {
+			eligible = append(eligible, l)
+			weights = append(weights, total.Amount)
+			eligibleTotal = eligibleTotal.Add(total)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil, couponError("coupon does not apply to the items in your cart")
+	}
+	if subtotal.Less(c.MinOrderValue) {
+		return nil, couponError(fmt.Sprintf("order total must be at least %s for this coupon", c.MinOrderValue))
+	}
+
+	res := &couponResult{coupon: c, discount: money.Zero(subtotal.Currency), lineDiscounts: map[bson.ObjectID]money.Money{}}
+	var err error
+	switch c.Type {
+	case models.CouponTypePercentage:
+		res.discount = eligibleTotal.Percent(c.Value)
+		if !c.MaxDiscount.IsZero() {
+			res.discount, err = money.Min(res.discount, c.MaxDiscount)
+		}
+	case models.CouponTypeFixed:
+		res.discount, err = money.Min(c.Amount, eligibleTotal)
+	case models.CouponTypeFreeShipping:
+		res.freeShipping = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// spread pro rata over the eligible lines, to the minor unit
+	for i, share := range res.discount.Allocate(weights) {
+		res.lineDiscounts[eligible[i].item.ID] = share
+	}
+	return res, nil
+}
+
+func couponApplies(c models.Coupon, p models.Product) bool {
+	if len(c.SellerIDs) > 0 && !slices.Contains(c.SellerIDs, p.SellerID) {
+		return false
+	}
+	if len(c.Categories) > 0 && !slices.ContainsFunc(c.Categories, func(cat string) bool { return strings.EqualFold(cat, p.Category) }) {
+		return false
+	}
+	return true
+}
+
+// redeemCoupon counts one use of the coupon by the order. Both limits are
+// enforced atomically: the overall one by a guarded increment, the per-user
+// one by giving each of the user's uses one of PerUserLimit unique slots.
+func redeemCoupon(ctx context.Context, c models.Coupon, userID, orderID bson.ObjectID, discount money.Money) error {
+	filter := bson.M{"_id": c.ID, "active": true}
+	if c.UsageLimit > 0 {
+		filter["used_count"] = bson.M{"$lt": c.UsageLimit}
+	}
+	res, err := database.CouponsColl.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"used_count": 1}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return couponError("coupon usage limit reached")
+	}
+	red := models.CouponRedemption{
+		CouponID:  c.ID,
+		UserID:    userID,
+		OrderID:   orderID,
+		Discount:  discount,
+		CreatedAt: time.Now(),
+	}
+	if c.PerUserLimit > 0 {
+		red.Slot = 1
+	}
+	for {
+		_, err = database.RedemptionsColl.InsertOne(ctx, red)
+		if red.Slot == 0 || !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+		if red.Slot++; red.Slot > c.PerUserLimit {
+			err = couponError("you have already used this coupon")
+			break
+		}
+	}
+	if err != nil {
+		_, _ = database.CouponsColl.UpdateOne(ctx, bson.M{"_id": c.ID}, bson.M{"$inc": bson.M{"used_count": -1}})
+	}
+	return err
+}
+
+// releaseCoupon gives back the use an order made of its coupon.
+func releaseCoupon(ctx context.Context, orderID bson.ObjectID) error {
+	var red models.CouponRedemption
+	err := database.RedemptionsColl.FindOneAndDelete(ctx, bson.M{"order_id": orderID}).Decode(&red)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = database.CouponsColl.UpdateOne(ctx, bson.M{"_id": red.CouponID}, bson.M{"$inc": bson.M{"used_count": -1}})
+	return err
+}
+
+// couponInput holds the editable fields of a coupon; nil means unchanged.
+type couponInput struct {
+	Code          *string      `json:"code"`
+	Type          *string      `json:"type"`
+	Value         *float64     `json:"value"`
+	Amount        *money.Money `json:"amount"`
+	MaxDiscount   *money.Money `json:"max_discount"`
+	MinOrderValue *money.Money `json:"min_order_value"`
+	StartsAt      *time.Time   `json:"starts_at"`
+	EndsAt        *time.Time   `json:"ends_at"`
+	UsageLimit    *int         `json:"usage_limit"`
+	PerUserLimit  *int         `json:"per_user_limit"`
+	Categories    *[]string    `json:"categories"`
+	SellerIDs     *[]string    `json:"seller_ids"`
+	Active        *bool        `json:"active"`
+}
+
+func (in couponInput) apply(c *models.Coupon) error {
+	if in.Code != nil {
+		code := normalizeCouponCode(*in.Code)
+		if !couponCodePattern.MatchString(code) {
+			return errors.New("code must be 3-32 letters, digits, '_' or '-'")
+		}
+		c.Code = code
+	}
+	if in.Type != nil {
+		c.Type = *in.Type
+	}
+	if in.Value != nil {
+		c.Value = *in.Value
+	}
+	if in.Amount != nil {
+		c.Amount = *in.Amount
+	}
+	if in.MaxDiscount != nil {
+		c.MaxDiscount = *in.MaxDiscount
+	}
+	if in.MinOrderValue != nil {
+		c.MinOrderValue = *in.MinOrderValue
+	}
+	if in.StartsAt != nil {
+		c.StartsAt = in.StartsAt
+	}
+	if in.EndsAt != nil {
+		c.EndsAt = in.EndsAt
+	}
+	if in.UsageLimit != nil {
+		c.UsageLimit = *in.UsageLimit
+	}
+	if in.PerUserLimit != nil {
+		c.PerUserLimit = *in.PerUserLimit
+	}
+	if in.Categories != nil {
+		cats := []string{}
+		for _, cat := range *in.Categories {
+			if cat = strings.TrimSpace(cat); cat != "" {
+				cats = append(cats, cat)
+			}
+		}
+		c.Categories = cats
+	}
+	if in.SellerIDs != nil {
+		ids := []bson.ObjectID{}
+		for _, s := range *in.SellerIDs {
+			id, err := bson.ObjectIDFromHex(s)
+			if err != nil {
+				return errors.New("invalid seller id")
+			}
+			ids = append(ids, id)
+		}
+		c.SellerIDs = ids
+	}
+	if in.Active != nil {
+		c.Active = *in.Active
+	}
+
+	switch c.Type {
+	case models.CouponTypePercentage:
+		if c.Value <= 0 || c.Value > 100 {
+			return errors.New("percentage value must be in (0, 100]")
+		}
+		c.Amount = money.Money{}
+	case models.CouponTypeFixed:
+		if c.Amount.Amount <= 0 {
+			return errors.New("fixed amount must be positive")
+		}
+		c.Value = 0
+	case models.CouponTypeFreeShipping:
+		c.Value, c.Amount = 0, money.Money{}
+	default:
+		return errors.New("type must be percentage, fixed or free_shipping")
+	}
+	for _, m := range []money.Money{c.Amount, c.MaxDiscount, c.MinOrderValue} {
+		if err := checkStoreAmount(m); err != nil {
+			return err
+		}
+	}
+	if c.UsageLimit < 0 || c.PerUserLimit < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if c.StartsAt != nil && c.EndsAt != nil && !c.EndsAt.After(*c.StartsAt) {
+		return errors.New("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// couponScope tells whose coupons the caller manages: all of them for
+// admins (zero id), otherwise their approved store's. It writes the error
+// response itself.
+func couponScope(ctx context.Context, w http.ResponseWriter, r *http.Request) (*middleware.Principal, bson.ObjectID, bool) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, bson.ObjectID{}, false
+	}
+	if principal.HasRole(models.RoleAdmin) {
+		return principal, bson.ObjectID{}, true
+	}
+	seller, err := approvedSellerFor(ctx, principal.UserID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return nil, bson.ObjectID{}, false
+	}
+	if seller == nil {
+		helpers.RespondError(w, http.StatusForbidden, "your store is not approved")
+		return nil, bson.ObjectID{}, false
+	}
+	return principal, seller.ID, true
+}
+
+// CreateCouponHandler creates a coupon. Sellers' coupons are limited to
+// their own store's products.
+func CreateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var in couponInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if in.Code == nil || in.Type == nil {
+		helpers.RespondError(w, http.StatusBadRequest, "code and type required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	principal, sellerID, ok := couponScope(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	c := models.Coupon{Active: true, CreatedBy: principal.UserID, CreatedAt: now, UpdatedAt: now}
+	if err := in.apply(&c); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !sellerID.IsZero() {
+		c.OwnerSellerID = sellerID
+		c.SellerIDs = []bson.ObjectID{sellerID}
+	}
+
+	res, err := database.CouponsColl.InsertOne(ctx, c)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "coupon code already exists")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	c.ID = res.InsertedID.(bson.ObjectID)
+	helpers.RespondJSON(w, http.StatusCreated, c)
+}
+
+func ListCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, sellerID, ok := couponScope(ctx, w, r)
+	if !ok {
+		return
+	}
+	page, limit, skip := helpers.Pagination(r, 50, 200)
+	filter := bson.M{}
+	if !sellerID.IsZero() {
+		filter["owner_seller_id"] = sellerID
+	}
+
+	total, err := database.CouponsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.CouponsColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Coupon{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+// ownedCoupon loads the coupon named in the URL if the caller manages it.
+// It writes the error response itself.
+func ownedCoupon(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Coupon, bson.ObjectID, bool) {
+	var c models.Coupon
+	_, sellerID, ok := couponScope(ctx, w, r)
+	if !ok {
+		return c, sellerID, false
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return c, sellerID, false
+	}
+	err = database.CouponsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&c)
+	if err != nil || (!sellerID.IsZero() && c.OwnerSellerID != sellerID) {
+		helpers.RespondError(w, http.StatusNotFound, "coupon not found")
+		return c, sellerID, false
+	}
+	return c, sellerID, true
+}
+
+func UpdateCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var in couponInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, sellerID, ok := ownedCoupon(ctx, w, r)
+	if !ok {
+		return
+	}
+	if err := in.apply(&c); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !sellerID.IsZero() {
+		c.SellerIDs = []bson.ObjectID{sellerID}
+	}
+
+	// used_count is left to redemptions
+	err := database.CouponsColl.FindOneAndUpdate(ctx, bson.M{"_id": c.ID}, bson.M{"$set": bson.M{
+		"code":            c.Code,
+		"type":            c.Type,
+		"value":           c.Value,
+		"amount":          c.Amount,
+		"max_discount":    c.MaxDiscount,
+		"min_order_value": c.MinOrderValue,
+		"starts_at":       c.StartsAt,
+		"ends_at":         c.EndsAt,
+		"usage_limit":     c.UsageLimit,
+		"per_user_limit":  c.PerUserLimit,
+		"categories":      c.Categories,
+		"seller_ids":      c.SellerIDs,
+		"active":          c.Active,
+		"updated_at":      time.Now(),
+	}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&c)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "coupon code already exists")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, c)
+}
+
+// DeleteCouponHandler deactivates a coupon. It is kept for the orders that
+// used it.
+func DeleteCouponHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, ok := ownedCoupon(ctx, w, r)
+	if !ok {
+		return
+	}
+	err := database.CouponsColl.FindOneAndUpdate(ctx, bson.M{"_id": c.ID},
+		bson.M{"$set": bson.M{"active": false, "updated_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&c)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, c)
+}
+
+// ApplyCartCouponHandler puts a coupon on the cart after checking it
+// applies. Rejections answer 422 with the reason.
+func ApplyCartCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || strings.TrimSpace(payload.Code) == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "code required")
+		return
+	}
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cart, err := loadCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if len(cart.Items) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "cart is empty")
+		return
+	}
+	lines, err := validateCart(ctx, cart)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	c, err := findCoupon(ctx, payload.Code)
+	if err == nil {
+		_, err = evaluateCoupon(ctx, c, owner.userID, lines)
+	}
+	var reason couponError
+	if errors.As(err, &reason) {
+		helpers.RespondError(w, http.StatusUnprocessableEntity, reason.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if _, err := database.CartsColl.UpdateOne(ctx, bson.M{"_id": cart.ID}, bson.M{"$set": bson.M{"coupon_code": c.Code, "updated_at": time.Now()}}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
+
+func RemoveCartCouponHandler(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !owner.none() {
+		_, err := database.CartsColl.UpdateOne(ctx, owner.filter(), bson.M{"$unset": bson.M{"coupon_code": ""}})
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	respondCart(w, r, ctx, http.StatusOK, owner, "")
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExchangeRates converts store prices for display. Set by main.
+var ExchangeRates = money.Rates{}
+
+// AcceptCurrencyHeader lists the currencies a client wants prices in, like
+// Accept-Language: "USD, EUR;q=0.8".
+const AcceptCurrencyHeader = "Accept-Currency"
+
+// displayCurrency picks the currency to show amounts in: ?currency= if
+// given, else the best supported entry of Accept-Currency, else the store
+// currency. An unsupported ?currency= is an error; the header is only a
+// preference.
+func displayCurrency(r *http.Request) (string, error) {
+	if c := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency"))); c != "" {
+		if !ExchangeRates.Has(c) {
+			return "", errors.New("unsupported currency " + c)
+		}
+		return c, nil
+	}
+
+	type pref struct {
+		code string
+		q    float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(r.Header.Get(AcceptCurrencyHeader), ",") {
+		code, params, _ := strings.Cut(part, ";")
+		p := pref{code: strings.ToUpper(strings.TrimSpace(code)), q: 1}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil {
+				p.q = q
+			}
+		}
+		if p.code != "" && p.q > 0 {
+			prefs = append(prefs, p)
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if ExchangeRates.Has(p.code) {
+			return p.code, nil
+		}
+	}
+	return money.Default, nil
+}
+
+// displayAmounts converts amounts to cur, or returns nil when cur is the
+// store currency and there is nothing to add.
+func displayAmounts(cur string, amounts map[string]money.Money) map[string]money.Money {
+	if cur == "" || cur == money.Default {
+		return nil
+	}
+	out := make(map[string]money.Money, len(amounts))
+	for k, m := range amounts {
+		c, err := ExchangeRates.Convert(m, cur)
+		if err != nil {
+			log.Printf("Error converting %s to %s: %v", m, cur, err)
+			return nil
+		}
+		out[k] = c
+	}
+	return out
+}
+
+// checkStoreAmount rejects negative amounts and amounts not in the store
+// currency; prices are kept in one currency so carts and orders add up.
+func checkStoreAmount(m money.Money) error {
+	if m.Amount < 0 {
+		return errors.New("amounts must not be negative")
+	}
+	if m.Currency != "" && m.Currency != money.Default {
+		return errors.New("amounts must be in " + money.Default)
+	}
+	return nil
+}
+
+// storeAmount reads a major-units amount given in currency cur and
+// converts it to the store currency.
+func storeAmount(s, cur string) (money.Money, bool) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return money.Money{}, false
+	}
+	m, err := ExchangeRates.Convert(money.FromMajor(v, cur), money.Default)
+	return m, err == nil
+}
+
+func localizeProduct(p *models.Product, cur string) {
+	now := time.Now()
+	p.Display = displayAmounts(cur, map[string]money.Money{
+		"current_price": p.PriceAt(nil, now),
+		"was_price":     p.WasPriceAt(nil, now),
+	})
+}
+
+func localizeProducts(products []models.Product, cur string) {
+	for i := range products {
+		localizeProduct(&products[i], cur)
+	}
+}
+
+func localizeOrder(o *models.Order, cur string) {
+	o.Display = displayAmounts(cur, map[string]money.Money{
+		"subtotal": o.Subtotal,
+		"discount": o.Discount,
+		"shipping": o.Shipping,
+		"tax":      o.Tax,
+		"total":    o.Total,
+	})
+}
+
+// CurrenciesHandler lists the currencies amounts can be shown in, with
+// their rate against the store currency.
+func CurrenciesHandler(w http.ResponseWriter, r *http.Request) {
+	rates := map[string]float64{}
+	for _, c := range ExchangeRates.Currencies() {
+		rates[c] = 1
+		if c != money.Default {
+			rates[c] = ExchangeRates[c]
+		}
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"store_currency": money.Default,
+		"currencies":     ExchangeRates.Currencies(),
+		"rates":          rates,
+	})
+}
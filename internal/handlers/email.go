@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/mailer"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Mailer sends verification and password reset emails. main sets it from
+// the environment, see mailer.FromEnv.
+var Mailer mailer.Mailer = &mailer.MemoryMailer{}
+
+// AppBaseURL is the frontend origin used to build links in emails.
+var AppBaseURL = "http://localhost:3000"
+
+const (
+	verifyEmailTTL   = 48 * time.Hour
+	passwordResetTTL = time.Hour
+	minPasswordLen   = 8
+)
+
+var errInvalidEmailToken = errors.New("invalid or expired token")
+
+// normalizeEmail validates a bare address like "a@b.com" and lowercases it.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "", errors.New("invalid email address")
+	}
+	return strings.ToLower(email), nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	}
+	return nil
+}
+
+// issueEmailToken stores a new token for purpose, replacing any unused one,
+// and returns the plaintext to put in the email.
+func issueEmailToken(ctx context.Context, user models.User, purpose string, ttl time.Duration) (string, error) {
+	token, err := helpers.NewToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = database.EmailTokensColl.DeleteMany(ctx, bson.M{
+		"user_id": user.ID, "purpose": purpose, "used_at": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = database.EmailTokensColl.InsertOne(ctx, models.EmailToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		TokenHash: helpers.HashToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	})
+	return token, err
+}
+
+// consumeEmailToken atomically marks the token used and returns it, so a
+// token can never be redeemed twice.
+func consumeEmailToken(ctx context.Context, token, purpose string) (*models.EmailToken, error) {
+	var et models.EmailToken
+	err := database.EmailTokensColl.FindOneAndUpdate(ctx,
+		bson.M{
+			"token_hash": helpers.HashToken(token),
+			"purpose":    purpose,
+			"used_at":    bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": time.Now()},
+		},
+		bson.M{"$set": bson.M{"used_at": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&et)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errInvalidEmailToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &et, nil
+}
+
+func sendVerificationEmail(ctx context.Context, user models.User) error {
+	token, err := issueEmailToken(ctx, user, models.EmailTokenVerify, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	return Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s/verify-email?token=%s\n\nThe link expires in %d hours.\n",
+			user.Username, AppBaseURL, token, int(verifyEmailTTL.Hours())),
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, user models.User) error {
+	token, err := issueEmailToken(ctx, user, models.EmailTokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	return Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. If it was you, open this link:\n\n%s/reset-password?token=%s\n\nThe link expires in %d minutes. If you did not ask for this, ignore this email.\n",
+			user.Username, AppBaseURL, token, int(passwordResetTTL.Minutes())),
+	})
+}
+
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Token == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "token required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	et, err := consumeEmailToken(ctx, payload.Token, models.EmailTokenVerify)
+	if errors.Is(err, errInvalidEmailToken) {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	// the address may have changed since the mail was sent
+	res, err := database.UsersColl.UpdateOne(ctx,
+		bson.M{"_id": et.UserID, "email": et.Email},
+		bson.M{"$set": bson.M{"email_verified": true}},
+	)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.MatchedCount == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, errInvalidEmailToken.Error())
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "email verified"})
+}
+
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if user.Email == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "no email address on file")
+		return
+	}
+	if user.EmailVerified {
+		helpers.RespondError(w, http.StatusBadRequest, "email already verified")
+		return
+	}
+	if err := sendVerificationEmail(ctx, user); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "could not send email")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusAccepted, map[string]string{"status": "verification email sent"})
+}
+
+// Reset mails are limited per address and per client like failed logins,
+// so the endpoint cannot be used to flood someone's inbox.
+const (
+	resetEmailLimit = 3
+	resetIPLimit    = 10
+)
+
+// ForgotPasswordHandler always answers 202 so it cannot be used to find out
+// which addresses have an account. The lookup and the mail happen after the
+// response, so its timing does not tell either.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	email, err := normalizeEmail(payload.Email)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// every request counts, whether the address has an account or not
+	emailKey := "reset:" + helpers.HashToken(email)
+	ipKey := "reset-ip:" + helpers.ClientIP(r)
+	if wait := lockedFor(ctx, emailKey, ipKey); wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+	for key, limit := range map[string]int{emailKey: resetEmailLimit, ipKey: resetIPLimit} {
+		if _, err := addFailure(ctx, key, limit); err != nil {
+			log.Printf("Error counting password reset request: %v", err)
+		}
+	}
+
+	go sendPasswordResetTo(email)
+
+	helpers.RespondJSON(w, http.StatusAccepted, map[string]string{
+		"status": "if an account with that email exists, a reset link has been sent",
+	})
+}
+
+// sendPasswordResetTo mails a reset link to the account with the address,
+// if there is one.
+func sendPasswordResetTo(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := database.UsersColl.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up password reset address: %v", err)
+		return
+	}
+	if err := sendPasswordResetEmail(ctx, user); err != nil {
+		log.Printf("Error sending password reset email: %v", err)
+	}
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Token == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "token and password required")
+		return
+	}
+	if err := validatePassword(payload.Password); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	et, err := consumeEmailToken(ctx, payload.Token, models.EmailTokenPasswordReset)
+	if errors.Is(err, errInvalidEmailToken) {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	hash, err := helpers.HashPassword(payload.Password)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not hash password")
+		return
+	}
+	_, err = database.UsersColl.UpdateOne(ctx, bson.M{"_id": et.UserID}, bson.M{
+		"$set":   bson.M{"password_hash": hash},
+		"$unset": bson.M{"must_reset_password": ""},
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// following the link proves ownership of the address
+	_, _ = database.UsersColl.UpdateOne(ctx,
+		bson.M{"_id": et.UserID, "email": et.Email},
+		bson.M{"$set": bson.M{"email_verified": true}},
+	)
+
+	// whoever knew the old password must not stay logged in
+	if err := middleware.RevokeUserSessions(ctx, et.UserID); err != nil {
+		log.Printf("Error revoking sessions after password reset: %v", err)
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "password updated"})
+}
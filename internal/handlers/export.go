@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// exportSection is one JSON file of the data export. Collections are looked
+// up lazily because they only exist after database.ConnectDB.
+type exportSection struct {
+	file    string
+	coll    func() *mongo.Collection
+	field   string // field holding the user id
+	newItem func() interface{}
+}
+
+var exportSections = []exportSection{
+	{"interactions.json", func() *mongo.Collection { return database.InteractionsColl }, "user_id", func() interface{} { return &models.Interaction{} }},
+	{"sessions.json", func() *mongo.Collection { return database.RefreshTokensColl }, "user_id", func() interface{} { return &models.RefreshToken{} }},
+	{"login_events.json", func() *mongo.Collection { return database.LoginEventsColl }, "user_id", func() interface{} { return &models.LoginEvent{} }},
+	{"api_keys.json", func() *mongo.Collection { return database.APIKeysColl }, "user_id", func() interface{} { return &models.APIKey{} }},
+	{"store.json", func() *mongo.Collection { return database.SellersColl }, "user_id", func() interface{} { return &models.Seller{} }},
+	{"orders.json", func() *mongo.Collection { return database.OrdersColl }, "user_id", func() interface{} { return &models.Order{} }},
+	{"payments.json", func() *mongo.Collection { return database.PaymentsColl }, "user_id", func() interface{} { return &models.Payment{} }},
+	{"cart.json", func() *mongo.Collection { return database.CartsColl }, "user_id", func() interface{} { return &models.Cart{} }},
+	{"coupon_redemptions.json", func() *mongo.Collection { return database.RedemptionsColl }, "user_id", func() interface{} { return &models.CouponRedemption{} }},
+	{"returns.json", func() *mongo.Collection { return database.ReturnsColl }, "user_id", func() interface{} { return &models.ReturnRequest{} }},
+}
+
+// ExportMeHandler answers a data subject access request: it streams a ZIP
+// with one JSON file per kind of record we keep about the caller.
+func ExportMeHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	// from here on the status is sent, failures can only abort the stream
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%s-%s.zip"`, user.ID.Hex(), time.Now().Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(w)
+	if err := writeExport(ctx, zw, user); err != nil {
+		log.Printf("Error exporting data of user %s: %v", user.ID.Hex(), err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error finishing export of user %s: %v", user.ID.Hex(), err)
+	}
+}
+
+func writeExport(ctx context.Context, zw *zip.Writer, user models.User) error {
+	f, err := zw.Create("user.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(user); err != nil {
+		return err
+	}
+
+	for _, section := range exportSections {
+		f, err := zw.Create(section.file)
+		if err != nil {
+			return err
+		}
+		if err := streamJSONArray(ctx, f, section, user.ID); err != nil {
+			return fmt.Errorf("%s: %w", section.file, err)
+		}
+	}
+	return nil
+}
+
+// streamJSONArray writes the matching documents one at a time, so large
+// histories never have to fit in memory.
+func streamJSONArray(ctx context.Context, out io.Writer, section exportSection, userID bson.ObjectID) error {
+	cursor, err := section.coll().Find(ctx, bson.M{section.field: userID}, options.Find().SetBatchSize(500))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	first := true
+	for cursor.Next(ctx) {
+		item := section.newItem()
+		if err := cursor.Decode(item); err != nil {
+			return err
+		}
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if first {
+			sep = "\n"
+			first = false
+		}
+		if _, err := io.WriteString(out, sep); err != nil {
+			return err
+		}
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, "\n]\n")
+	return err
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"PROJECTTEST/internal/database"
 	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
 	"context"
 	"encoding/json"
 	"math/rand"
@@ -24,6 +25,10 @@ var clothingCategories = []string{
 	"Sneakers", "Cap", "Socks", "Backpack", "Shirt",
 }
 
+var clothingSizes = []string{"XS", "S", "M", "L", "XL"}
+
+var clothingColors = []string{"Black", "White", "Navy", "Grey", "Olive"}
+
 const productImage = "https://pangaia.com/cdn/shop/files/DNA_Oversized_T-Shirt_-Summit_Blue-1.png?crop=center&height=1999&v=1755260238&width=1500"
 
 // ---------- CORE GENERATOR ----------
@@ -48,10 +53,10 @@ func generateRandomProduct() models.Product {
 	// случайная категория
 	category := clothingCategories[rand.Intn(len(clothingCategories))]
 
-	// Цена — рандом от 0 до 200000, кратная 10000
-	price := float64((rand.Intn(21)) * 10000)
+	// Цена — рандом от 0 до 200000, кратная 10000, в валюте магазина
+	price := money.FromMajor(float64(rand.Intn(21)*10000), money.Default)
 
-	return models.Product{
+	p := models.Product{
 		ID:          bson.NewObjectID(),
 		Name:        name,
 		Description: description,
@@ -60,6 +65,22 @@ func generateRandomProduct() models.Product {
 		ImageURL:    productImage,
 		CreatedAt:   time.Now(),
 	}
+
+	// варианты — 1-2 цвета во всех размерах, остаток суммируется в товар
+	for _, color := range clothingColors[:1+rand.Intn(2)] {
+		for _, size := range clothingSizes {
+			v := models.ProductVariant{
+				ID:    bson.NewObjectID(),
+				SKU:   normalizeSKU(p.ID.Hex() + "-" + size + "-" + color),
+				Size:  size,
+				Color: color,
+				Stock: rand.Intn(21),
+			}
+			p.Stock += v.Stock
+			p.Variants = append(p.Variants, v)
+		}
+	}
+	return p
 }
 
 func insertManyProducts(n int) error {
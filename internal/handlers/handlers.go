@@ -15,6 +15,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
@@ -27,6 +28,7 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Username string `json:"username"`
+		Email    string `json:"email"`
 		Password string `json:"password"`
 	}
 
@@ -35,8 +37,17 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if payload.Username == "" || payload.Password == "" {
-		helpers.RespondError(w, http.StatusBadRequest, "username and password required")
+	if payload.Username == "" || payload.Password == "" || payload.Email == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "username, email and password required")
+		return
+	}
+	email, err := normalizeEmail(payload.Email)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validatePassword(payload.Password); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -49,6 +60,11 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		helpers.RespondError(w, http.StatusBadRequest, "username already taken")
 		return
 	}
+	count, _ = database.UsersColl.CountDocuments(ctx, bson.M{"email": email})
+	if count > 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "email already registered")
+		return
+	}
 
 	// hash password
 	hash, err := helpers.HashPassword(payload.Password)
@@ -61,7 +77,8 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	user := models.User{
 		Username:     payload.Username,
 		PasswordHash: hash,
-		Email:        "", // можно удалить поле из структуры, если не нужно
+		Email:        email,
+		Roles:        []string{models.RoleBuyer},
 		CreatedAt:    time.Now(),
 	}
 
@@ -74,17 +91,23 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	user.ID = res.InsertedID.(bson.ObjectID)
 
+	if err := sendVerificationEmail(ctx, user); err != nil {
+		// the user can ask for a new one later
+		log.Printf("Error sending verification email: %v", err)
+	}
+
 	// JWT
-	token, err := middleware.CreateToken(user.ID)
+	tokens, err := middleware.CreateToken(ctx, user)
 	if err != nil {
 		helpers.RespondError(w, http.StatusInternalServerError, "could not create token")
 		return
 	}
 
-	helpers.RespondJSON(w, http.StatusCreated, map[string]interface{}{
-		"token": token,
-		"user":  user,
-	})
+	if err := mergeGuestCart(ctx, r.Header.Get(CartTokenHeader), user.ID); err != nil {
+		log.Printf("Error merging guest cart of user %s: %v", user.ID.Hex(), err)
+	}
+
+	helpers.RespondJSON(w, http.StatusCreated, authResponse(tokens, user))
 }
 
 
@@ -102,50 +125,45 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	attempt := newLoginAttempt(r, payload.Username)
+	if wait := attempt.lockedFor(ctx); wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+
 	var user models.User
 
 	// ❗ ищем по username вместо email
 	err := database.UsersColl.FindOne(ctx, bson.M{"username": payload.Username}).Decode(&user)
 	if err != nil {
+		attempt.recordFailure(ctx, bson.NilObjectID, "unknown username")
 		helpers.RespondError(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
 	// проверяем пароль
 	if err := helpers.CheckPassword(user.PasswordHash, payload.Password); err != nil {
+		attempt.recordFailure(ctx, user.ID, "wrong password")
 		helpers.RespondError(w, http.StatusUnauthorized, "invalid credentials")
 		return
 	}
 
-	// создаём токен
-	token, err := middleware.CreateToken(user.ID)
-	if err != nil {
-		helpers.RespondError(w, http.StatusInternalServerError, "could not create token")
-		return
-	}
-
-
-
-	log.Printf("USER FROM DB: %+v\n", user)   // 👈 добавляем
-	log.Println("HASH:", user.PasswordHash)   // 👈 добавляем
-	log.Println("PASS:", payload.Password)    // 👈 добавляем
-	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
-		"token": token,
-		"user":  user,
-	})
+	// создаём токен (или просим второй фактор)
+	completeLogin(ctx, w, user, attempt)
 }
 func MeHandler(w http.ResponseWriter, r *http.Request) {
-    userID, err := middleware.GetUserIDFromToken(r)
-    if err != nil {
+    principal, ok := middleware.UserFrom(r.Context())
+    if !ok {
         helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
         return
     }
+    userID := principal.UserID
 
     ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
     defer cancel()
 
     var user models.User
-    err = database.UsersColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+    err := database.UsersColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
     if err != nil {
         helpers.RespondError(w, http.StatusNotFound, "user not found")
         return
@@ -161,6 +179,11 @@ func ListProductsHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	pageStr := q.Get("page")
 	limitStr := q.Get("limit")
+	display, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// Default values
 	page := int64(1)
@@ -186,8 +209,28 @@ func ListProductsHandler(w http.ResponseWriter, r *http.Request) {
 	// Calculate skip for pagination
 	skip := (page - 1) * limit
 
-	// Use Find with pagination options
-	cursor, err := database.ProductsColl.Find(ctx, bson.M{}, options.Find().SetLimit(limit).SetSkip(skip))
+	// Signed-in users see products from the categories they engage with first
+	var cats []string
+	if principal, ok := middleware.UserFrom(r.Context()); ok {
+		cats = preferredCategories(ctx, principal.UserID)
+	}
+
+	filter := listedFilter(addInStockFilter(r, bson.M{}))
+
+	var cursor *mongo.Cursor
+	if len(cats) > 0 {
+		cursor, err = database.ProductsColl.Aggregate(ctx, mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$addFields", Value: bson.M{"_pref": bson.M{"$cond": bson.A{bson.M{"$in": bson.A{"$category", cats}}, 1, 0}}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "_pref", Value: -1}, {Key: "_id", Value: 1}}}},
+			{{Key: "$skip", Value: skip}},
+			{{Key: "$limit", Value: limit}},
+			{{Key: "$project", Value: bson.M{"_pref": 0}}},
+		})
+	} else {
+		// Use Find with pagination options
+		cursor, err = database.ProductsColl.Find(ctx, filter, options.Find().SetLimit(limit).SetSkip(skip))
+	}
 	if err != nil {
 		helpers.RespondError(w, http.StatusInternalServerError, "db error")
 		return
@@ -198,10 +241,38 @@ func ListProductsHandler(w http.ResponseWriter, r *http.Request) {
 		helpers.RespondError(w, http.StatusInternalServerError, "db error")
 		return
 	}
+	localizeProducts(items, display)
 
 	helpers.RespondJSON(w, http.StatusOK, items)
 }
 
+// preferredCategories returns up to three categories the user liked or
+// bought most, most frequent first. Errors just mean no personalization.
+func preferredCategories(ctx context.Context, userID bson.ObjectID) []string {
+	cursor, err := database.InteractionsColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "action_type": bson.M{"$in": []string{"like", "purchase"}}}}},
+		{{Key: "$lookup", Value: bson.M{"from": "products", "localField": "product_id", "foreignField": "_id", "as": "product"}}},
+		{{Key: "$unwind", Value: "$product"}},
+		{{Key: "$group", Value: bson.M{"_id": "$product.category", "n": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "n", Value: -1}}}},
+		{{Key: "$limit", Value: 3}},
+	})
+	if err != nil {
+		return nil
+	}
+	var rows []struct {
+		Category string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil
+	}
+	cats := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cats = append(cats, row.Category)
+	}
+	return cats
+}
+
 func ProductDetailHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	objID, err := bson.ObjectIDFromHex(id)
@@ -209,27 +280,39 @@ func ProductDetailHandler(w http.ResponseWriter, r *http.Request) {
 		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
 		return
 	}
+	display, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var p models.Product
-	if err := database.ProductsColl.FindOne(ctx, bson.M{"_id": objID}).Decode(&p); err != nil {
+	if err := database.ProductsColl.FindOne(ctx, listedFilter(bson.M{"_id": objID})).Decode(&p); err != nil {
 		helpers.RespondError(w, http.StatusNotFound, "product not found")
 		return
 	}
+	localizeProduct(&p, display)
 	helpers.RespondJSON(w, http.StatusOK, p)
 }
 
 func ProductsByCategoryHandler(w http.ResponseWriter, r *http.Request) {
 	cat := mux.Vars(r)["category"]
+	display, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	cursor, err := database.ProductsColl.Find(ctx, bson.M{"category": cat})
+	cursor, err := database.ProductsColl.Find(ctx, listedFilter(addInStockFilter(r, bson.M{"category": cat})))
 	if err != nil {
 		helpers.RespondError(w, http.StatusInternalServerError, "db error")
 		return
 	}
 	var items []models.Product
 	cursor.All(ctx, &items)
+	localizeProducts(items, display)
 	helpers.RespondJSON(w, http.StatusOK, items)
 }
 
@@ -239,6 +322,11 @@ func ProductsSearchHandler(w http.ResponseWriter, r *http.Request) {
 	minPriceStr := r.URL.Query().Get("min_price")
 	maxPriceStr := r.URL.Query().Get("max_price")
 	pageStr := r.URL.Query().Get("page")
+	display, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -273,24 +361,31 @@ func ProductsSearchHandler(w http.ResponseWriter, r *http.Request) {
 					andParts = append(andParts, bson.M{"$or": orList})
 			}
 	}
-	// price >= min_price
+	// price >= min_price, given in the display currency
 	if minPriceStr != "" {
-		if minPrice, err := strconv.ParseFloat(minPriceStr, 64); err == nil {
-			andParts = append(andParts, bson.M{"price": bson.M{"$gte": minPrice}})
+		if minPrice, ok := storeAmount(minPriceStr, display); ok {
+			andParts = append(andParts, bson.M{"price.amount": bson.M{"$gte": minPrice.Amount}})
 		}
 	}
 
 	// price <= max_price
 	if maxPriceStr != "" {
-		if maxPrice, err := strconv.ParseFloat(maxPriceStr, 64); err == nil {
-			andParts = append(andParts, bson.M{"price": bson.M{"$lte": maxPrice}})
+		if maxPrice, ok := storeAmount(maxPriceStr, display); ok {
+			andParts = append(andParts, bson.M{"price.amount": bson.M{"$lte": maxPrice.Amount}})
 		}
 	}
 
+	// size / color of a single variant
+	if vf := variantFilter(r); vf != nil {
+		andParts = append(andParts, vf)
+	}
+
 	// combine all AND filters
 	if len(andParts) > 0 {
 		filter["$and"] = andParts
 	}
+	addInStockFilter(r, filter)
+	listedFilter(filter)
 
 	// ------- PAGINATION -------
 	limit := int64(12)
@@ -325,22 +420,32 @@ func ProductsSearchHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	facets, err := variantFacets(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	localizeProducts(items, display)
+
 	// ------- RESPONSE -------
 	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
-		"items": items,
-		"total": total,
-		"page":  page,
+		"items":  items,
+		"total":  total,
+		"page":   page,
+		"facets": facets,
 	})
 }
 
 func PostInteraction(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromToken(r)
-	if err != nil {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
 		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
+	userID := principal.UserID
 	var payload struct {
 		ProductID string `json:"product_id"`
+		VariantID string `json:"variant_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
@@ -351,6 +456,13 @@ func PostInteraction(w http.ResponseWriter, r *http.Request) {
 		helpers.RespondError(w, http.StatusBadRequest, "invalid product id")
 		return
 	}
+	var vid bson.ObjectID
+	if payload.VariantID != "" {
+		if vid, err = bson.ObjectIDFromHex(payload.VariantID); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+			return
+		}
+	}
 	// action from path
 	action := strings.TrimPrefix(r.URL.Path, "/api/interactions/")
 	action = strings.TrimSuffix(action, "/")
@@ -375,10 +487,25 @@ func PostInteraction(w http.ResponseWriter, r *http.Request) {
 		}
 		helpers.RespondJSON(w, http.StatusCreated, map[string]string{"status": "liked"})
 		return
-	} else if action == "view" || action == "purchase" {
+	} else if action == "purchase" {
+		// purchases are recorded when an order is paid
+		helpers.RespondError(w, http.StatusBadRequest, "purchases are made through checkout")
+		return
+	} else if action == "view" {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		it := models.Interaction{UserID: userID, ProductID: pid, ActionType: action, Timestamp: time.Now()}
+		if !vid.IsZero() {
+			var p models.Product
+			if err := database.ProductsColl.FindOne(ctx, bson.M{"_id": pid}).Decode(&p); err != nil {
+				helpers.RespondError(w, http.StatusNotFound, "product not found")
+				return
+			}
+			if p.Variant(vid) == nil {
+				helpers.RespondError(w, http.StatusBadRequest, "unknown variant")
+				return
+			}
+		}
+		it := models.Interaction{UserID: userID, ProductID: pid, VariantID: vid, ActionType: action, Timestamp: time.Now()}
 		_, err := database.InteractionsColl.InsertOne(ctx, it)
 		if err != nil {
 			helpers.RespondError(w, http.StatusInternalServerError, "db error")
@@ -391,11 +518,12 @@ func PostInteraction(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetUserInteractionsHandler(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromToken(r)
-	if err != nil {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
 		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
+	userID := principal.UserID
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	cursor, err := database.InteractionsColl.Find(ctx, bson.M{"user_id": userID})
@@ -414,17 +542,22 @@ func GetUserInteractionsHandler(w http.ResponseWriter, r *http.Request) {
 // 3) get other products those users liked/purchased, count frequency
 // 4) exclude products user already interacted with
 // 5) return top N
+// Returns count against a product: a returned product seeds nothing for
+// the user, and other users' returns take returnPenalty off its score.
+
+const returnPenalty = 2
 
 func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromToken(r)
-	if err != nil {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
 		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
+	userID := principal.UserID
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	// step 1: user's positive products (like/purchase)
-	cursor, err := database.InteractionsColl.Find(ctx, bson.M{"user_id": userID, "action_type": bson.M{"$in": []string{"like", "purchase"}}})
+	// step 1: user's positive products (like/purchase), and returned ones
+	cursor, err := database.InteractionsColl.Find(ctx, bson.M{"user_id": userID, "action_type": bson.M{"$in": []string{"like", "purchase", returnInteractionType}}})
 	if err != nil {
 		helpers.RespondError(w, http.StatusInternalServerError, "db error")
 		return
@@ -436,15 +569,23 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if len(myInter) == 0 {
 		// cold-start: return newest products
-		cur2, _ := database.ProductsColl.Find(ctx, bson.M{}, options.Find().SetLimit(func() int64 { n := 10; return int64(n) }()))
+		cur2, _ := database.ProductsColl.Find(ctx, listedFilter(bson.M{}), options.Find().SetLimit(func() int64 { n := 10; return int64(n) }()))
 		var newest []models.Product
 		cur2.All(ctx, &newest)
 		helpers.RespondJSON(w, http.StatusOK, newest)
 		return
 	}
+	returned := map[bson.ObjectID]bool{}
+	for _, it := range myInter {
+		if it.ActionType == returnInteractionType {
+			returned[it.ProductID] = true
+		}
+	}
 	myProductIDs := make([]bson.ObjectID, 0, len(myInter))
 	for _, it := range myInter {
-		myProductIDs = append(myProductIDs, it.ProductID)
+		if !returned[it.ProductID] {
+			myProductIDs = append(myProductIDs, it.ProductID)
+		}
 	}
 	// step 2: find other users who interacted with those products (like/purchase)
 	otherCursor, err := database.InteractionsColl.Find(ctx, bson.M{"product_id": bson.M{"$in": myProductIDs}, "action_type": bson.M{"$in": []string{"like", "purchase"}}})
@@ -464,9 +605,9 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 			_ = database.ProductsColl.FindOne(ctx, bson.M{"_id": first.ProductID}).Decode(&prod)
 
 			// берем 10 товаров той же категории
-			cur, _ := database.ProductsColl.Find(ctx, bson.M{
+			cur, _ := database.ProductsColl.Find(ctx, listedFilter(bson.M{
 					"category": prod.Category,
-			}, options.Find().SetLimit(10))
+			}), options.Find().SetLimit(10))
 
 			var rec []models.Product
 			cur.All(ctx, &rec)
@@ -485,8 +626,8 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 	for u := range userSet {
 		otherUsers = append(otherUsers, u)
 	}
-	// step 3: get products these users liked/purchased
-	cursor3, err := database.InteractionsColl.Find(ctx, bson.M{"user_id": bson.M{"$in": otherUsers}, "action_type": bson.M{"$in": []string{"like", "purchase"}}})
+	// step 3: get products these users liked/purchased or returned
+	cursor3, err := database.InteractionsColl.Find(ctx, bson.M{"user_id": bson.M{"$in": otherUsers}, "action_type": bson.M{"$in": []string{"like", "purchase", returnInteractionType}}})
 	if err != nil {
 		helpers.RespondError(w, http.StatusInternalServerError, "db error")
 		return
@@ -495,13 +636,20 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 	cursor3.All(ctx, &rels)
 	countByProduct := map[bson.ObjectID]int{}
 	for _, r := range rels {
-		countByProduct[r.ProductID]++
+		if r.ActionType == returnInteractionType {
+			countByProduct[r.ProductID] -= returnPenalty
+		} else {
+			countByProduct[r.ProductID]++
+		}
 	}
 	// exclude products user already interacted with
 	exclude := map[bson.ObjectID]struct{}{}
 	for _, id := range myProductIDs {
 		exclude[id] = struct{}{}
 	}
+	for id := range returned {
+		exclude[id] = struct{}{}
+	}
 	// build list sorted by count
 	type kv struct {
 		id    bson.ObjectID
@@ -509,7 +657,7 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	kvList := []kv{}
 	for pid, c := range countByProduct {
-		if _, ok := exclude[pid]; ok {
+		if _, ok := exclude[pid]; ok || c <= 0 {
 			continue
 		}
 		kvList = append(kvList, kv{pid, c})
@@ -530,7 +678,7 @@ func RecommendationsHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		var p models.Product
-		if err := database.ProductsColl.FindOne(ctx, bson.M{"_id": kvv.id}).Decode(&p); err == nil {
+		if err := database.ProductsColl.FindOne(ctx, listedFilter(bson.M{"_id": kvv.id})).Decode(&p); err == nil {
 			resProducts = append(resProducts, p)
 		}
 	}
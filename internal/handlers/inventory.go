@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Stock changes are single conditional updates, so concurrent buyers can
+// never take stock below zero.
+
+var (
+	errOutOfStock      = errors.New("out of stock")
+	errProductNotFound = errors.New("product not found")
+)
+
+// changeStock applies inc to the product, or to one of its variants and the
+// product totals, if the stock fields match guard. It tells a missing
+// product or variant apart from a failed guard.
+func changeStock(ctx context.Context, productID, variantID bson.ObjectID, guard bson.M, inc bson.M) error {
+	filter := bson.M{"_id": productID}
+	update := bson.M{}
+	for k, v := range inc {
+		update[k] = v
+	}
+	if variantID.IsZero() {
+		for k, v := range guard {
+			filter[k] = v
+		}
+	} else {
+		match := bson.M{"_id": variantID}
+		for k, v := range guard {
+			match[k] = v
+		}
+		filter["variants"] = bson.M{"$elemMatch": match}
+		for k, v := range inc {
+			update["variants.$."+k] = v
+		}
+	}
+	res, err := database.ProductsColl.UpdateOne(ctx, filter, bson.M{"$inc": update, "$set": bson.M{"updated_at": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount > 0 {
+		return nil
+	}
+	exists := bson.M{"_id": productID}
+	if !variantID.IsZero() {
+		exists["variants._id"] = variantID
+	}
+	n, err := database.ProductsColl.CountDocuments(ctx, exists)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errProductNotFound
+	}
+	return errOutOfStock
+}
+
+// reserveStock holds qty units for an order that is not paid yet.
+func reserveStock(ctx context.Context, productID, variantID bson.ObjectID, qty int) error {
+	return changeStock(ctx, productID, variantID, bson.M{"stock": bson.M{"$gte": qty}}, bson.M{"stock": -qty, "reserved": qty})
+}
+
+// releaseStock returns held units to sale, e.g. when an order is cancelled.
+func releaseStock(ctx context.Context, productID, variantID bson.ObjectID, qty int) error {
+	return changeStock(ctx, productID, variantID, bson.M{"reserved": bson.M{"$gte": qty}}, bson.M{"stock": qty, "reserved": -qty})
+}
+
+// commitReservation turns held units into sold ones.
+func commitReservation(ctx context.Context, productID, variantID bson.ObjectID, qty int) error {
+	return changeStock(ctx, productID, variantID, bson.M{"reserved": bson.M{"$gte": qty}}, bson.M{"reserved": -qty})
+}
+
+// restock puts sold units back, e.g. after a return.
+func restock(ctx context.Context, productID, variantID bson.ObjectID, qty int) error {
+	return changeStock(ctx, productID, variantID, nil, bson.M{"stock": qty})
+}
+
+// buyableVariant resolves the variant a buyer picked. Products with
+// variants can only be bought as one of them.
+func buyableVariant(p models.Product, variantID bson.ObjectID) (*models.ProductVariant, error) {
+	if p.Hidden {
+		return nil, errors.New("product not available")
+	}
+	if variantID.IsZero() {
+		if len(p.Variants) > 0 {
+			return nil, errors.New("variant_id required")
+		}
+		return nil, nil
+	}
+	v := p.Variant(variantID)
+	if v == nil {
+		return nil, errors.New("unknown variant")
+	}
+	return v, nil
+}
+
+// listedFilter narrows filter to products buyers may see, leaving out those
+// of stores that are not trading, see syncStoreListing.
+func listedFilter(filter bson.M) bson.M {
+	filter["hidden"] = bson.M{"$ne": true}
+	return filter
+}
+
+// addInStockFilter narrows filter by ?in_stock=true|false and leaves it
+// alone when the parameter is absent.
+func addInStockFilter(r *http.Request, filter bson.M) bson.M {
+	v, err := strconv.ParseBool(r.URL.Query().Get("in_stock"))
+	if err != nil {
+		return filter
+	}
+	if v {
+		filter["stock"] = bson.M{"$gt": 0}
+	} else {
+		filter["stock"] = bson.M{"$not": bson.M{"$gt": 0}}
+	}
+	return filter
+}
+
+// UpdateStockHandler sets the stock level ("stock") or adjusts it
+// ("delta"), and optionally the low-stock threshold. Products with variants
+// are stocked per variant.
+func UpdateStockHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		VariantID         string `json:"variant_id"`
+		Stock             *int   `json:"stock"`
+		Delta             *int   `json:"delta"`
+		LowStockThreshold *int   `json:"low_stock_threshold"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if payload.Stock != nil && payload.Delta != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "send either stock or delta")
+		return
+	}
+	if (payload.Stock != nil && *payload.Stock < 0) || (payload.LowStockThreshold != nil && *payload.LowStockThreshold < 0) {
+		helpers.RespondError(w, http.StatusBadRequest, "stock and low_stock_threshold must not be negative")
+		return
+	}
+	var variantID bson.ObjectID
+	if payload.VariantID != "" {
+		id, err := bson.ObjectIDFromHex(payload.VariantID)
+		if err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+			return
+		}
+		variantID = id
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, ok := ownedProduct(ctx, w, r)
+	if !ok {
+		return
+	}
+
+	filter := bson.M{"_id": p.ID}
+	update := bson.M{}
+	set := bson.M{"updated_at": time.Now()}
+	if payload.LowStockThreshold != nil {
+		set["low_stock_threshold"] = *payload.LowStockThreshold
+	}
+	update["$set"] = set
+
+	changing := payload.Stock != nil || payload.Delta != nil
+	switch {
+	case !changing:
+	case variantID.IsZero() && len(p.Variants) > 0:
+		helpers.RespondError(w, http.StatusBadRequest, "variant_id required")
+		return
+	case variantID.IsZero():
+		if payload.Stock != nil {
+			set["stock"] = *payload.Stock
+		} else {
+			update["$inc"] = bson.M{"stock": *payload.Delta}
+			if *payload.Delta < 0 {
+				filter["stock"] = bson.M{"$gte": -*payload.Delta}
+			}
+		}
+	default:
+		v := p.Variant(variantID)
+		if v == nil {
+			helpers.RespondError(w, http.StatusNotFound, "variant not found")
+			return
+		}
+		// the product total moves with the variant, so an absolute level
+		// becomes a delta guarded on the level it was computed from
+		match := bson.M{"_id": variantID}
+		delta := 0
+		if payload.Stock != nil {
+			delta = *payload.Stock - v.Stock
+			match["stock"] = v.Stock
+		} else {
+			delta = *payload.Delta
+			if delta < 0 {
+				match["stock"] = bson.M{"$gte": -delta}
+			}
+		}
+		filter["variants"] = bson.M{"$elemMatch": match}
+		update["$inc"] = bson.M{"stock": delta, "variants.$.stock": delta}
+	}
+
+	err := database.ProductsColl.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusConflict, "stock changed or not enough to remove, retry")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, p)
+}
+
+// LowStockHandler lists products at or below their low-stock threshold:
+// the caller's own products, or all of them for admins.
+func LowStockHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	page, limit, skip := helpers.Pagination(r, 50, 200)
+
+	filter := bson.M{
+		"low_stock_threshold": bson.M{"$gt": 0},
+		"$expr":               bson.M{"$lte": bson.A{"$stock", "$low_stock_threshold"}},
+	}
+	if !principal.HasRole(models.RoleAdmin) {
+		filter["owner_id"] = principal.UserID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := database.ProductsColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "stock", Value: 1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Product{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"page":  page,
+	})
+}
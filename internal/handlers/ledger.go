@@ -0,0 +1,565 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// defaultCommissionRate applies when no commission rule matches.
+const defaultCommissionRate = 10.0
+
+var (
+	errUnbalanced    = errors.New("ledger transaction does not balance")
+	errSaleNotBooked = errors.New("sale is not booked yet")
+)
+
+func activeCommissionRules(ctx context.Context) ([]models.CommissionRule, error) {
+	cursor, err := database.CommissionColl.Find(ctx, bson.M{"active": true})
+	if err != nil {
+		return nil, err
+	}
+	var rules []models.CommissionRule
+	err = cursor.All(ctx, &rules)
+	return rules, err
+}
+
+// commissionRate picks the most specific rule for the seller and category:
+// seller and category, then seller, then category, then a catch-all rule.
+func commissionRate(rules []models.CommissionRule, sellerID bson.ObjectID, category string) float64 {
+	rate, bestScore := defaultCommissionRate, -1
+	for _, rule := range rules {
+		score := 0
+		if !rule.SellerID.IsZero() {
+			if rule.SellerID != sellerID {
+				continue
+			}
+			score += 2
+		}
+		if rule.Category != "" {
+			if !strings.EqualFold(rule.Category, category) {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			rate, bestScore = rule.Rate, score
+		}
+	}
+	return rate
+}
+
+// postLedger writes a balanced transaction. Legs are keyed on txKey and
+// their position, so posting the same transaction again only fills in legs
+// a failed attempt left out; a transaction written in full is left as it
+// is. If the legs a failed attempt wrote differ from the ones computed now,
+// e.g. because a commission rule changed in between, they are taken out
+// and the transaction written afresh, so it never mixes two calculations.
+func postLedger(ctx context.Context, txKey, kind string, legs []models.LedgerEntry) error {
+	var sum int64
+	var written []models.LedgerEntry
+	now := time.Now()
+	for i, leg := range legs {
+		if leg.Amount.IsZero() {
+			continue
+		}
+		sum += leg.Amount.Amount
+		leg.Key = fmt.Sprintf("%s:%d", txKey, i)
+		leg.TxKey = txKey
+		leg.Kind = kind
+		leg.CreatedAt = now
+		written = append(written, leg)
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: %s is off by %d", errUnbalanced, txKey, sum)
+	}
+	if len(written) == 0 {
+		return nil
+	}
+	want := map[string]models.LedgerEntry{}
+	docs := make([]interface{}, 0, len(written))
+	for _, leg := range written {
+		leg.TxLegs = len(written)
+		want[leg.Key] = leg
+		docs = append(docs, leg)
+	}
+
+	cursor, err := database.LedgerColl.Find(ctx, bson.M{"tx_key": txKey})
+	if err != nil {
+		return err
+	}
+	var existing []models.LedgerEntry
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+	if complete(existing) {
+		return nil
+	}
+	if !sameLegs(existing, want) {
+		log.Printf("Ledger transaction %s was partly written from another calculation; rewriting it", txKey)
+		if _, err := database.LedgerColl.DeleteMany(ctx, bson.M{"tx_key": txKey}); err != nil {
+			return err
+		}
+	}
+	_, err = database.LedgerColl.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if onlyDuplicateKeys(err) {
+		// the legs that were there already
+		return nil
+	}
+	return err
+}
+
+// complete reports whether the legs are a whole transaction. Legs written
+// before they carried their count are taken as whole if they balance.
+func complete(legs []models.LedgerEntry) bool {
+	if len(legs) == 0 {
+		return false
+	}
+	if n := legs[0].TxLegs; n > 0 {
+		return len(legs) == n
+	}
+	var sum int64
+	for _, l := range legs {
+		sum += l.Amount.Amount
+	}
+	return sum == 0
+}
+
+// sameLegs reports whether every written leg is the one computed now for
+// its key.
+func sameLegs(existing []models.LedgerEntry, want map[string]models.LedgerEntry) bool {
+	for _, e := range existing {
+		w, ok := want[e.Key]
+		if !ok || e.Account != w.Account || e.SellerID != w.SellerID || e.Amount != w.Amount ||
+			e.ProductID != w.ProductID || e.VariantID != w.VariantID {
+			return false
+		}
+	}
+	return true
+}
+
+// onlyDuplicateKeys reports whether err is a bulk write that failed only
+// because some of the documents exist already.
+func onlyDuplicateKeys(err error) bool {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if !mongo.IsDuplicateKeyError(we.WriteError) {
+			return false
+		}
+	}
+	return true
+}
+
+// postSale records a paid order: per line, the buyer's payment into cash,
+// split into commission, the seller's earnings and tax. Lines without a
+// seller are the platform's own and all revenue. Shipping, and any tax on
+// it, is booked once for the order.
+func postSale(ctx context.Context, o models.Order) error {
+	amounts := []money.Money{o.Shipping, o.Tax}
+	for _, it := range o.Items {
+		amounts = append(amounts, it.LineTotal, it.Discount, it.Tax)
+	}
+	if err := money.Check(o.Currency, amounts...); err != nil {
+		return fmt.Errorf("order %s: %w", o.ID.Hex(), err)
+	}
+
+	rules, err := activeCommissionRules(ctx)
+	if err != nil {
+		return err
+	}
+	products := map[bson.ObjectID]models.Product{}
+	ids := make([]bson.ObjectID, 0, len(o.Items))
+	for _, it := range o.Items {
+		ids = append(ids, it.ProductID)
+	}
+	cursor, err := database.ProductsColl.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var found []models.Product
+	if err := cursor.All(ctx, &found); err != nil {
+		return err
+	}
+	for _, p := range found {
+		products[p.ID] = p
+	}
+
+	var legs []models.LedgerEntry
+	itemTax := money.Zero(o.Currency)
+	for _, it := range o.Items {
+		line := models.LedgerEntry{OrderID: o.ID, ProductID: it.ProductID, VariantID: it.VariantID, Memo: it.Name}
+		leg := func(account string, amount money.Money) models.LedgerEntry {
+			l := line
+			l.Account, l.Amount = account, amount
+			return l
+		}
+		net := it.LineTotal.Sub(it.Discount)
+		commission := net
+		if !it.SellerID.IsZero() {
+			commission = net.Percent(commissionRate(rules, it.SellerID, products[it.ProductID].Category))
+		}
+		earnings := leg(models.AccountSellerPayable, money.Zero(o.Currency).Sub(net.Sub(commission)))
+		earnings.SellerID = it.SellerID
+		legs = append(legs,
+			leg(models.AccountCash, net.Add(it.Tax)),
+			leg(models.AccountCommission, money.Zero(o.Currency).Sub(commission)),
+			earnings,
+			leg(models.AccountTaxPayable, money.Zero(o.Currency).Sub(it.Tax)),
+		)
+		itemTax = itemTax.Add(it.Tax)
+	}
+	shippingTax := o.Tax.Sub(itemTax)
+	legs = append(legs,
+		models.LedgerEntry{Account: models.AccountCash, OrderID: o.ID, Amount: o.Shipping.Add(shippingTax), Memo: "shipping"},
+		models.LedgerEntry{Account: models.AccountShipping, OrderID: o.ID, Amount: money.Zero(o.Currency).Sub(o.Shipping), Memo: "shipping"},
+		models.LedgerEntry{Account: models.AccountTaxPayable, OrderID: o.ID, Amount: money.Zero(o.Currency).Sub(shippingTax), Memo: "shipping tax"},
+	)
+	return postLedger(ctx, "sale:"+o.ID.Hex(), models.LedgerKindSale, legs)
+}
+
+// postReturnRefund reverses the returned units' share of their lines' sale
+// legs: cash goes back to the buyer, taken from commission, the seller's
+// earnings and tax in the proportions they were booked.
+func postReturnRefund(ctx context.Context, ret models.ReturnRequest) error {
+	cursor, err := database.LedgerColl.Find(ctx, bson.M{"tx_key": "sale:" + ret.OrderID.Hex()})
+	if err != nil {
+		return err
+	}
+	var sale []models.LedgerEntry
+	if err := cursor.All(ctx, &sale); err != nil {
+		return err
+	}
+	if !complete(sale) {
+		return errSaleNotBooked
+	}
+
+	var legs []models.LedgerEntry
+	for _, it := range ret.Items {
+		var credits []models.LedgerEntry
+		var weights []int64
+		for _, l := range sale {
+			if l.ProductID == it.ProductID && l.VariantID == it.VariantID && l.Amount.Amount < 0 {
+				credits = append(credits, l)
+				weights = append(weights, -l.Amount.Amount)
+			}
+		}
+		if len(credits) == 0 {
+			continue
+		}
+		legs = append(legs, models.LedgerEntry{
+			Account: models.AccountCash, OrderID: ret.OrderID, ProductID: it.ProductID, VariantID: it.VariantID,
+			ReturnID: ret.ID, Amount: money.Zero(it.Refund.Currency).Sub(it.Refund), Memo: it.Name,
+		})
+		for i, share := range it.Refund.Allocate(weights) {
+			l := credits[i]
+			legs = append(legs, models.LedgerEntry{
+				Account: l.Account, SellerID: l.SellerID, OrderID: ret.OrderID, ProductID: it.ProductID, VariantID: it.VariantID,
+				ReturnID: ret.ID, Amount: share, Memo: it.Name,
+			})
+		}
+	}
+	return postLedger(ctx, "return:"+ret.ID.Hex(), models.LedgerKindRefund, legs)
+}
+
+// postOrderRefund reverses whatever the ledger still holds for the order,
+// after any returns already refunded. Its own legs are left out of the sum
+// so a retry computes the same transaction.
+func postOrderRefund(ctx context.Context, o models.Order) error {
+	txKey := "order-refund:" + o.ID.Hex()
+	cursor, err := database.LedgerColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"order_id": o.ID, "tx_key": bson.M{"$ne": txKey}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"account":    "$account",
+				"seller_id":  "$seller_id",
+				"product_id": "$product_id",
+				"variant_id": "$variant_id",
+				"memo":       "$memo",
+			},
+			"amount": bson.M{"$sum": "$amount.amount"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.product_id", Value: 1}, {Key: "_id.variant_id", Value: 1}, {Key: "_id.account", Value: 1}, {Key: "_id.memo", Value: 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		ID struct {
+			Account   string        `bson:"account"`
+			SellerID  bson.ObjectID `bson:"seller_id"`
+			ProductID bson.ObjectID `bson:"product_id"`
+			VariantID bson.ObjectID `bson:"variant_id"`
+			Memo      string        `bson:"memo"`
+		} `bson:"_id"`
+		Amount int64 `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return err
+	}
+	legs := make([]models.LedgerEntry, 0, len(rows))
+	for _, row := range rows {
+		legs = append(legs, models.LedgerEntry{
+			Account: row.ID.Account, SellerID: row.ID.SellerID, OrderID: o.ID,
+			ProductID: row.ID.ProductID, VariantID: row.ID.VariantID,
+			Amount: money.New(-row.Amount, o.Currency), Memo: row.ID.Memo,
+		})
+	}
+	return postLedger(ctx, txKey, models.LedgerKindRefund, legs)
+}
+
+// bookOrder brings the ledger up to the order's status: the sale once it is
+// paid, and its reversal once refunded, after any refunded returns. Each
+// step is idempotent, and the order records what is booked, so
+// ReconcileLedger can finish what a failure left out.
+func bookOrder(ctx context.Context, o models.Order) error {
+	var booked string
+	switch o.Status {
+	case models.OrderStatusPaid, models.OrderStatusShipped, models.OrderStatusDelivered:
+		booked = models.OrderStatusPaid
+	case models.OrderStatusRefunded:
+		booked = models.OrderStatusRefunded
+	}
+	if booked == "" || o.LedgerStatus == booked {
+		return nil
+	}
+	if err := postSale(ctx, o); err != nil {
+		return err
+	}
+	if booked == models.OrderStatusRefunded {
+		// the order refund reverses what the returns left
+		cursor, err := database.ReturnsColl.Find(ctx, bson.M{
+			"order_id":      o.ID,
+			"status":        models.ReturnStatusRefunded,
+			"ledger_posted": bson.M{"$ne": true},
+		})
+		if err != nil {
+			return err
+		}
+		var rets []models.ReturnRequest
+		if err := cursor.All(ctx, &rets); err != nil {
+			return err
+		}
+		for _, ret := range rets {
+			if err := bookReturn(ctx, ret); err != nil {
+				return err
+			}
+		}
+		if err := postOrderRefund(ctx, o); err != nil {
+			return err
+		}
+	}
+	_, err := database.OrdersColl.UpdateOne(ctx, bson.M{"_id": o.ID}, bson.M{"$set": bson.M{"ledger_status": booked}})
+	return err
+}
+
+// bookReturn books a refunded return once.
+func bookReturn(ctx context.Context, ret models.ReturnRequest) error {
+	if ret.Status != models.ReturnStatusRefunded || ret.LedgerPosted {
+		return nil
+	}
+	if err := postReturnRefund(ctx, ret); err != nil {
+		return err
+	}
+	_, err := database.ReturnsColl.UpdateOne(ctx, bson.M{"_id": ret.ID}, bson.M{"$set": bson.M{"ledger_posted": true}})
+	return err
+}
+
+// ReconcileLedger books what status changes left out of the ledger, and
+// orders paid before there was one. main runs it periodically; failures
+// are logged and retried on the next run.
+func ReconcileLedger(ctx context.Context) error {
+	cursor, err := database.OrdersColl.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{
+			"status":        bson.M{"$in": bson.A{models.OrderStatusPaid, models.OrderStatusShipped, models.OrderStatusDelivered}},
+			"ledger_status": bson.M{"$exists": false},
+		},
+		bson.M{"status": models.OrderStatusRefunded, "ledger_status": bson.M{"$ne": models.OrderStatusRefunded}},
+	}})
+	if err != nil {
+		return err
+	}
+	var orders []models.Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return err
+	}
+	var failed int
+	for _, o := range orders {
+		if err := bookOrder(ctx, o); err != nil {
+			log.Printf("Error booking order %s: %v", o.ID.Hex(), err)
+			failed++
+		}
+	}
+
+	cursor, err = database.ReturnsColl.Find(ctx, bson.M{"status": models.ReturnStatusRefunded, "ledger_posted": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	var rets []models.ReturnRequest
+	if err := cursor.All(ctx, &rets); err != nil {
+		return err
+	}
+	for _, ret := range rets {
+		if err := bookReturn(ctx, ret); err != nil {
+			log.Printf("Error booking return %s: %v", ret.ID.Hex(), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d bookings failed", failed, len(orders)+len(rets))
+	}
+	return nil
+}
+
+// commissionRuleInput holds the editable fields of a commission rule; nil
+// means unchanged.
+type commissionRuleInput struct {
+	SellerID *string  `json:"seller_id"`
+	Category *string  `json:"category"`
+	Rate     *float64 `json:"rate"`
+	Active   *bool    `json:"active"`
+}
+
+func (in commissionRuleInput) apply(c *models.CommissionRule) error {
+	if in.SellerID != nil {
+		c.SellerID = bson.ObjectID{}
+		if *in.SellerID != "" {
+			id, err := bson.ObjectIDFromHex(*in.SellerID)
+			if err != nil {
+				return errors.New("invalid seller id")
+			}
+			c.SellerID = id
+		}
+	}
+	if in.Category != nil {
+		c.Category = strings.TrimSpace(*in.Category)
+	}
+	if in.Rate != nil {
+		c.Rate = *in.Rate
+	}
+	if in.Active != nil {
+		c.Active = *in.Active
+	}
+	if c.Rate < 0 || c.Rate > 100 {
+		return errors.New("rate must be a percentage in [0, 100]")
+	}
+	return nil
+}
+
+func ListCommissionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := database.CommissionColl.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "seller_id", Value: 1}, {Key: "category", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.CommissionRule{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items":        items,
+		"default_rate": defaultCommissionRate,
+	})
+}
+
+func CreateCommissionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var in commissionRuleInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if in.Rate == nil {
+		helpers.RespondError(w, http.StatusBadRequest, "rate required")
+		return
+	}
+	now := time.Now()
+	c := models.CommissionRule{Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := in.apply(&c); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.CommissionColl.InsertOne(ctx, c)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	c.ID = res.InsertedID.(bson.ObjectID)
+	helpers.RespondJSON(w, http.StatusCreated, c)
+}
+
+func UpdateCommissionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in commissionRuleInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var c models.CommissionRule
+	if err := database.CommissionColl.FindOne(ctx, bson.M{"_id": id}).Decode(&c); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "commission rule not found")
+		return
+	}
+	if err := in.apply(&c); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	c.UpdatedAt = time.Now()
+	if _, err := database.CommissionColl.ReplaceOne(ctx, bson.M{"_id": id}, c); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, c)
+}
+
+// DeleteCommissionRuleHandler removes a rule. Sales already booked keep the
+// commission they were charged.
+func DeleteCommissionRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.CommissionColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		helpers.RespondError(w, http.StatusNotFound, "commission rule not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/oidc"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// OIDCProviders are the external identity providers users can sign in
+// with, keyed by the name used in the URL. main sets them from the
+// environment, see oidc.ProvidersFromEnv.
+var OIDCProviders = map[string]*oidc.Provider{}
+
+const oidcStateTTL = 10 * time.Minute
+
+var usernameCleaner = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// OIDCStartHandler redirects the browser to the provider's login page.
+func OIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := OIDCProviders[name]
+	if !ok {
+		helpers.RespondError(w, http.StatusNotFound, "unknown provider")
+		return
+	}
+
+	state, err := helpers.NewToken(32)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+	nonce, err := helpers.NewToken(16)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not start login")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err = database.OIDCStatesColl.InsertOne(ctx, models.OIDCState{
+		StateHash:    helpers.HashToken(state),
+		Provider:     name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    now.Add(oidcStateTTL),
+		CreatedAt:    now,
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, challenge)
+	if err != nil {
+		log.Printf("Error building %s authorization URL: %v", name, err)
+		helpers.RespondError(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler finishes the login: it redeems the code, finds or
+// creates the linked user and issues the usual marketplace tokens.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := OIDCProviders[name]
+	if !ok {
+		helpers.RespondError(w, http.StatusNotFound, "unknown provider")
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		helpers.RespondError(w, http.StatusUnauthorized, "login failed: "+e)
+		return
+	}
+	code, state := q.Get("code"), q.Get("state")
+	if code == "" || state == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "code and state required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// a state can only be used once
+	var st models.OIDCState
+	err := database.OIDCStatesColl.FindOneAndDelete(ctx, bson.M{
+		"state_hash": helpers.HashToken(state),
+		"provider":   name,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&st)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid or expired state")
+		return
+	}
+
+	claims, err := provider.Exchange(ctx, code, st.CodeVerifier)
+	if err != nil {
+		log.Printf("Error exchanging %s code: %v", name, err)
+		helpers.RespondError(w, http.StatusUnauthorized, "could not verify login")
+		return
+	}
+	if claims.Nonce != st.Nonce {
+		helpers.RespondError(w, http.StatusUnauthorized, "could not verify login")
+		return
+	}
+
+	user, err := userForIdentity(ctx, name, claims)
+	if err != nil {
+		log.Printf("Error linking %s identity: %v", name, err)
+		helpers.RespondError(w, http.StatusInternalServerError, "could not sign in")
+		return
+	}
+
+	completeLogin(ctx, w, user, newLoginAttempt(r, user.Username))
+}
+
+// userForIdentity returns the user linked to the external account. If there
+// is none yet, an existing user is linked when the provider vouches for the
+// same verified email, otherwise a new user is created.
+func userForIdentity(ctx context.Context, provider string, claims *oidc.Claims) (models.User, error) {
+	key := models.IdentityKey(provider, claims.Subject)
+	var user models.User
+	err := database.UsersColl.FindOne(ctx, bson.M{"identities.key": key}).Decode(&user)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return user, err
+	}
+
+	identity := models.Identity{
+		Key:      key,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	}
+	email, emailErr := normalizeEmail(claims.Email)
+	verified := emailErr == nil && bool(claims.EmailVerified)
+
+	// both sides must have verified the address, or anybody could take
+	// over an account by registering its email elsewhere
+	if verified {
+		err = database.UsersColl.FindOneAndUpdate(ctx,
+			bson.M{"email": email, "email_verified": true},
+			bson.M{"$push": bson.M{"identities": identity}},
+		).Decode(&user)
+		if err == nil {
+			user.Identities = append(user.Identities, identity)
+			return user, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return user, err
+		}
+	}
+
+	username, err := freeUsername(ctx, claims)
+	if err != nil {
+		return user, err
+	}
+	user = models.User{
+		Username:    username,
+		DisplayName: claims.Name,
+		Roles:       []string{models.RoleBuyer},
+		Identities:  []models.Identity{identity},
+		CreatedAt:   time.Now(),
+	}
+	if emailErr == nil {
+		if n, _ := database.UsersColl.CountDocuments(ctx, bson.M{"email": email}); n == 0 {
+			user.Email = email
+			user.EmailVerified = verified
+		}
+	}
+	if validateAvatarURL(claims.Picture) == nil {
+		user.AvatarURL = claims.Picture
+	}
+	res, err := database.UsersColl.InsertOne(ctx, user)
+	if err != nil {
+		return user, err
+	}
+	user.ID = res.InsertedID.(bson.ObjectID)
+	return user, nil
+}
+
+// freeUsername derives a username from the ID token and adds a random
+// suffix if it is already taken.
+func freeUsername(ctx context.Context, claims *oidc.Claims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = usernameCleaner.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	candidate := base
+	for i := 0; i < 5; i++ {
+		n, err := database.UsersColl.CountDocuments(ctx, bson.M{"username": candidate})
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return candidate, nil
+		}
+		suffix, err := helpers.NewToken(3)
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + strings.ToLower(suffix)
+	}
+	return "", errors.New("could not find a free username")
+}
@@ -0,0 +1,766 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// orderTransitions lists, per target status, the statuses an order may
+// move there from.
+var orderTransitions = map[string][]string{
+	models.OrderStatusPaid:      {models.OrderStatusPending},
+	models.OrderStatusShipped:   {models.OrderStatusPaid},
+	models.OrderStatusDelivered: {models.OrderStatusShipped},
+	models.OrderStatusCancelled: {models.OrderStatusPending},
+	models.OrderStatusRefunded:  {models.OrderStatusPaid, models.OrderStatusShipped, models.OrderStatusDelivered},
+}
+
+// pendingOrderTTL is how long an order holds its stock waiting for payment.
+const pendingOrderTTL = 30 * time.Minute
+
+var (
+	errInvalidTransition = errors.New("order is not in a state that allows this")
+	errOrderChanged      = errors.New("order changed, retry")
+)
+
+// setOrderStatus moves the order to status if the transition is allowed and
+// nobody moved it first, then applies the stock and recommendation side
+// effects. extra is merged into the $set.
+func setOrderStatus(ctx context.Context, o models.Order, status string, by bson.ObjectID, note string, extra bson.M) (models.Order, error) {
+	if !slices.Contains(orderTransitions[status], o.Status) {
+		return o, errInvalidTransition
+	}
+	now := time.Now()
+	set := bson.M{"status": status, "updated_at": now, status + "_at": now}
+	for k, v := range extra {
+		set[k] = v
+	}
+	change := models.OrderStatusChange{Status: status, By: by, Note: strings.TrimSpace(note), At: now}
+
+	from := o.Status
+	err := database.OrdersColl.FindOneAndUpdate(ctx,
+		bson.M{"_id": o.ID, "status": from},
+		bson.M{"$set": set, "$push": bson.M{"status_history": change}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&o)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return o, errOrderChanged
+	}
+	if err != nil {
+		return o, err
+	}
+
+	// the status is the source of truth; a failed side effect is logged
+	// rather than undoing a transition that already happened
+	for _, it := range o.Items {
+		var err error
+		switch {
+		case status == models.OrderStatusPaid:
+			err = commitReservation(ctx, it.ProductID, it.VariantID, it.Quantity)
+		case status == models.OrderStatusCancelled:
+			err = releaseStock(ctx, it.ProductID, it.VariantID, it.Quantity)
+		case status == models.OrderStatusRefunded && from == models.OrderStatusPaid:
+			// never shipped, so the goods are still on the shelf
+			err = restock(ctx, it.ProductID, it.VariantID, it.Quantity)
+		}
+		if err != nil {
+			log.Printf("Error updating stock for order %s: %v", o.ID.Hex(), err)
+		}
+	}
+	if status == models.OrderStatusCancelled && o.CouponCode != "" {
+		if err := releaseCoupon(ctx, o.ID); err != nil {
+			log.Printf("Error releasing coupon of order %s: %v", o.ID.Hex(), err)
+		}
+	}
+	if status == models.OrderStatusPaid && !o.UserID.IsZero() {
+		if err := recordPurchases(ctx, o); err != nil {
+			log.Printf("Error recording purchases for order %s: %v", o.ID.Hex(), err)
+		}
+	}
+	if err := bookOrder(ctx, o); err != nil {
+		log.Printf("Error booking order %s, left to reconciliation: %v", o.ID.Hex(), err)
+	}
+	return o, nil
+}
+
+// recordPurchases writes the purchase interactions recommendations feed on.
+func recordPurchases(ctx context.Context, o models.Order) error {
+	docs := make([]interface{}, 0, len(o.Items))
+	for _, it := range o.Items {
+		docs = append(docs, models.Interaction{
+			UserID:     o.UserID,
+			ProductID:  it.ProductID,
+			VariantID:  it.VariantID,
+			ActionType: "purchase",
+			Timestamp:  time.Now(),
+		})
+	}
+	_, err := database.InteractionsColl.InsertMany(ctx, docs)
+	return err
+}
+
+// ExpirePendingOrders cancels the orders left unpaid past their expiry,
+// which hands back their stock and coupon uses. Orders with a payment
+// still in flight are left for the payment to settle. main runs it
+// periodically.
+func ExpirePendingOrders(ctx context.Context) error {
+	cursor, err := database.OrdersColl.Find(ctx, bson.M{
+		"status":     models.OrderStatusPending,
+		"expires_at": bson.M{"$lte": time.Now()},
+	})
+	if err != nil {
+		return err
+	}
+	var orders []models.Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return err
+	}
+	for _, o := range orders {
+		active, err := activePayment(ctx, o.ID)
+		if err != nil {
+			return err
+		}
+		if active != nil {
+			continue
+		}
+		_, err = setOrderStatus(ctx, o, models.OrderStatusCancelled, bson.ObjectID{}, "not paid in time", nil)
+		if err != nil && !errors.Is(err, errOrderChanged) {
+			return err
+		}
+	}
+	return nil
+}
+
+func respondOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errOrderChanged):
+		helpers.RespondError(w, http.StatusConflict, err.Error())
+	default:
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+	}
+}
+
+// checkoutAddress picks the shipping address: an inline one, one of the
+// user's saved addresses by id, or the default one.
+func checkoutAddress(user models.User, addressID string, inline *models.Address) (models.Address, error) {
+	if inline != nil {
+		addrs, err := normalizeAddresses([]models.Address{*inline})
+		if err != nil {
+			return models.Address{}, err
+		}
+		return addrs[0], nil
+	}
+	for _, a := range user.Addresses {
+		if (addressID == "" && a.IsDefault) || a.ID.Hex() == addressID {
+			return a, nil
+		}
+	}
+	if addressID != "" {
+		return models.Address{}, errors.New("address not found")
+	}
+	return models.Address{}, errors.New("shipping address required")
+}
+
+// claimCart empties the cart of the lines checkout read, unless it changed
+// since: then errCartChanged.
+func claimCart(ctx context.Context, cart models.Cart, now time.Time) error {
+	ids := make([]bson.ObjectID, 0, len(cart.Items))
+	for _, it := range cart.Items {
+		ids = append(ids, it.ID)
+	}
+	res, err := database.CartsColl.UpdateOne(ctx,
+		bson.M{"_id": cart.ID, "updated_at": cart.UpdatedAt, "items._id": bson.M{"$all": ids}},
+		bson.M{
+			"$pull":  bson.M{"items": bson.M{"_id": bson.M{"$in": ids}}},
+			"$set":   bson.M{"updated_at": now},
+			"$unset": bson.M{"coupon_code": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errCartChanged
+	}
+	return nil
+}
+
+// restoreCart puts claimed lines and the coupon back after a checkout that
+// failed.
+func restoreCart(ctx context.Context, cart models.Cart) error {
+	set := bson.M{"updated_at": time.Now()}
+	if cart.CouponCode != "" {
+		set["coupon_code"] = cart.CouponCode
+	}
+	_, err := database.CartsColl.UpdateOne(ctx, bson.M{"_id": cart.ID}, bson.M{
+		"$push": bson.M{"items": bson.M{"$each": cart.Items}},
+		"$set":  set,
+	})
+	return err
+}
+
+// CheckoutHandler turns the caller's cart into a pending order. Stock is
+// reserved here and committed once the order is paid; an order not paid
+// within pendingOrderTTL is cancelled by ExpirePendingOrders.
+func CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		AddressID        string          `json:"address_id"`
+		Address          *models.Address `json:"address"`
+		ShippingMethodID string          `json:"shipping_method_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	var methodID bson.ObjectID
+	if payload.ShippingMethodID != "" {
+		var err error
+		if methodID, err = bson.ObjectIDFromHex(payload.ShippingMethodID); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid shipping method id")
+			return
+		}
+	}
+	cur, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	addr, err := checkoutAddress(user, payload.AddressID, payload.Address)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	owner := cartOwner{userID: user.ID}
+	cart, err := loadCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if len(cart.Items) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "cart is empty")
+		return
+	}
+	lines, err := validateCart(ctx, cart)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for _, l := range lines {
+		if l.status != "ok" || l.priceChanged {
+			view, err := cartView(ctx, cart, cur)
+			if err != nil {
+				helpers.RespondError(w, http.StatusInternalServerError, "db error")
+				return
+			}
+			helpers.RespondJSON(w, http.StatusConflict, map[string]interface{}{
+				"error": "cart changed, review it before checking out",
+				"cart":  view,
+			})
+			return
+		}
+	}
+
+	var coupon *couponResult
+	if cart.CouponCode != "" {
+		c, err := findCoupon(ctx, cart.CouponCode)
+		if err == nil {
+			coupon, err = evaluateCoupon(ctx, c, user.ID, lines)
+		}
+		var reason couponError
+		if errors.As(err, &reason) {
+			helpers.RespondError(w, http.StatusConflict, "coupon "+cart.CouponCode+": "+reason.Error())
+			return
+		}
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	quote, err := quoteOrder(ctx, lines, coupon, addr, methodID)
+	var reason shippingError
+	if errors.As(err, &reason) {
+		helpers.RespondError(w, http.StatusUnprocessableEntity, reason.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(pendingOrderTTL)
+	order := models.Order{
+		ID:              bson.NewObjectID(),
+		UserID:          user.ID,
+		ShippingAddress: addr,
+		Subtotal:        quote.subtotal,
+		Discount:        quote.discount,
+		Shipping:        quote.shipping,
+		Tax:             quote.tax,
+		Total:           quote.total,
+		Currency:        money.Default,
+		Status:          models.OrderStatusPending,
+		ExpiresAt:       &expires,
+		StatusHistory:   []models.OrderStatusChange{{Status: models.OrderStatusPending, By: user.ID, At: now}},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	for _, l := range lines {
+		it := models.OrderItem{
+			ProductID: l.item.ProductID,
+			VariantID: l.item.VariantID,
+			SellerID:  l.product.SellerID,
+			Name:      l.product.Name,
+			Quantity:  l.item.Quantity,
+			UnitPrice: l.price,
+			LineTotal: l.price.Mul(l.item.Quantity),
+		}
+		if l.variant != nil {
+			it.SKU, it.Size, it.Color = l.variant.SKU, l.variant.Size, l.variant.Color
+		}
+		if coupon != nil {
+			it.Discount = coupon.lineDiscounts[l.item.ID]
+		}
+		it.Tax = quote.lineTax[l.item.ID]
+		order.Items = append(order.Items, it)
+		if !it.SellerID.IsZero() && !slices.Contains(order.SellerIDs, it.SellerID) {
+			order.SellerIDs = append(order.SellerIDs, it.SellerID)
+		}
+	}
+	if quote.method != nil {
+		order.ShippingMethodID = quote.method.ID
+		order.ShippingMethod = quote.method.Name
+	}
+
+	// take the lines out of the cart first, so a second checkout of the
+	// same cart running alongside finds nothing to order
+	if err := claimCart(ctx, cart, now); err != nil {
+		if errors.Is(err, errCartChanged) {
+			helpers.RespondError(w, http.StatusConflict, "cart changed, review it before checking out")
+			return
+		}
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	unclaim := func() {
+		if err := restoreCart(ctx, cart); err != nil {
+			log.Printf("Error restoring cart %s: %v", cart.ID.Hex(), err)
+		}
+	}
+
+	if coupon != nil {
+		order.CouponCode = coupon.coupon.Code
+		order.FreeShipping = coupon.freeShipping
+		if err := redeemCoupon(ctx, coupon.coupon, user.ID, order.ID, coupon.discount); err != nil {
+			unclaim()
+			var reason couponError
+			if errors.As(err, &reason) {
+				helpers.RespondError(w, http.StatusConflict, "coupon "+coupon.coupon.Code+": "+reason.Error())
+				return
+			}
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	// reserve line by line, handing back what we got (and the coupon use
+	// and the cart lines) if one line fails
+	release := func(items []models.OrderItem) {
+		for _, it := range items {
+			if err := releaseStock(ctx, it.ProductID, it.VariantID, it.Quantity); err != nil {
+				log.Printf("Error releasing stock of product %s: %v", it.ProductID.Hex(), err)
+			}
+		}
+		if coupon != nil {
+			if err := releaseCoupon(ctx, order.ID); err != nil {
+				log.Printf("Error releasing coupon of order %s: %v", order.ID.Hex(), err)
+			}
+		}
+		unclaim()
+	}
+	for i, it := range order.Items {
+		if err := reserveStock(ctx, it.ProductID, it.VariantID, it.Quantity); err != nil {
+			release(order.Items[:i])
+			if errors.Is(err, errOutOfStock) || errors.Is(err, errProductNotFound) {
+				helpers.RespondError(w, http.StatusConflict, fmt.Sprintf("%s is no longer available in that quantity", it.Name))
+				return
+			}
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	if _, err := database.OrdersColl.InsertOne(ctx, order); err != nil {
+		release(order.Items)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	localizeOrder(&order, cur)
+	helpers.RespondJSON(w, http.StatusCreated, order)
+}
+
+// listOrders answers a paginated order listing for filter, newest first.
+// Without ?status= the given default filter on status applies.
+func listOrders(w http.ResponseWriter, r *http.Request, filter bson.M, defaultStatus interface{}, view func(models.Order) models.Order) {
+	page, limit, skip := helpers.Pagination(r, 20, 100)
+	cur, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	} else if defaultStatus != nil {
+		filter["status"] = defaultStatus
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := database.OrdersColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.OrdersColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Order{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	for i := range items {
+		if view != nil {
+			items[i] = view(items[i])
+		}
+		localizeOrder(&items[i], cur)
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+// ListMyOrdersHandler is the caller's order history.
+func ListMyOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	listOrders(w, r, bson.M{"user_id": principal.UserID}, nil, nil)
+}
+
+// myOrder loads the order named in the URL if it is the caller's, or if
+// the caller is an admin. It writes the error response itself.
+func myOrder(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Order, *middleware.Principal, bool) {
+	var o models.Order
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return o, nil, false
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return o, nil, false
+	}
+	err = database.OrdersColl.FindOne(ctx, bson.M{"_id": id}).Decode(&o)
+	if err != nil || (o.UserID != principal.UserID && !principal.HasRole(models.RoleAdmin)) {
+		helpers.RespondError(w, http.StatusNotFound, "order not found")
+		return o, nil, false
+	}
+	return o, principal, true
+}
+
+func GetOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	o, _, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	localizeOrder(&o, cur)
+	helpers.RespondJSON(w, http.StatusOK, o)
+}
+
+// CancelOrderHandler lets the buyer cancel an order that is not paid yet.
+// An order whose payment already went through is moved to paid instead.
+func CancelOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	o, principal, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	p, err := activePayment(ctx, o.ID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if p != nil {
+		switch p.Status {
+		case models.PaymentStatusSucceeded:
+			// the money came in but the order never caught up; cancelling now
+			// would keep the payment without a refund
+			if _, err := applyPaymentStatus(ctx, *p, models.PaymentStatusSucceeded, ""); err != nil {
+				log.Printf("Error marking order %s paid: %v", o.ID.Hex(), err)
+			}
+			helpers.RespondError(w, http.StatusConflict, "this order is already paid")
+			return
+		case models.PaymentStatusCreated, models.PaymentStatusProcessing:
+			helpers.RespondError(w, http.StatusConflict, "a payment for this order is in progress")
+			return
+		}
+	}
+	o, err = setOrderStatus(ctx, o, models.OrderStatusCancelled, principal.UserID, payload.Reason, nil)
+	if err != nil {
+		respondOrderError(w, err)
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, o)
+}
+
+// sellerOrderView trims an order to the seller's own items and hides the
+// buyer's account.
+func sellerOrderView(sellerID bson.ObjectID) func(models.Order) models.Order {
+	return func(o models.Order) models.Order {
+		items := []models.OrderItem{}
+		subtotal, discount, tax := money.Zero(o.Currency), money.Zero(o.Currency), money.Zero(o.Currency)
+		for _, it := range o.Items {
+			if it.SellerID == sellerID {
+				items = append(items, it)
+				subtotal = subtotal.Add(it.LineTotal)
+				discount = discount.Add(it.Discount)
+				tax = tax.Add(it.Tax)
+			}
+		}
+		// shipping is the store's, not the seller's
+		o.Items = items
+		o.Subtotal = subtotal
+		o.Discount = discount
+		o.Shipping = money.Money{}
+		o.Tax = tax
+		o.Total = subtotal.Sub(discount).Add(tax)
+		o.UserID = bson.ObjectID{}
+		return o
+	}
+}
+
+// sellerFor returns the caller's store in any status, so suspended sellers
+// can still fulfil what they sold. It writes the error response itself.
+func sellerFor(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Seller, bool) {
+	var s models.Seller
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return s, false
+	}
+	if err := database.SellersColl.FindOne(ctx, bson.M{"user_id": principal.UserID}).Decode(&s); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "you have no store")
+		return s, false
+	}
+	return s, true
+}
+
+// SellerOrdersHandler lists orders containing the caller's products. Unpaid
+// orders are left out unless asked for with ?status=pending.
+func SellerOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	listOrders(w, r, bson.M{"seller_ids": s.ID}, bson.M{"$ne": models.OrderStatusPending}, sellerOrderView(s.ID))
+}
+
+// SellerUpdateOrderHandler lets a seller mark an order shipped or
+// delivered. Orders with items from other stores are fulfilled by admins.
+func SellerUpdateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Status         string `json:"status"`
+		TrackingNumber string `json:"tracking_number"`
+		Note           string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if payload.Status != models.OrderStatusShipped && payload.Status != models.OrderStatusDelivered {
+		helpers.RespondError(w, http.StatusBadRequest, "status must be shipped or delivered")
+		return
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	var o models.Order
+	if err := database.OrdersColl.FindOne(ctx, bson.M{"_id": id, "seller_ids": s.ID}).Decode(&o); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "order not found")
+		return
+	}
+	if len(o.SellerIDs) != 1 {
+		helpers.RespondError(w, http.StatusConflict, "order has items from other stores")
+		return
+	}
+
+	extra := bson.M{}
+	if tn := strings.TrimSpace(payload.TrackingNumber); tn != "" {
+		extra["tracking_number"] = tn
+	}
+	o, err = setOrderStatus(ctx, o, payload.Status, s.UserID, payload.Note, extra)
+	if err != nil {
+		respondOrderError(w, err)
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, sellerOrderView(s.ID)(o))
+}
+
+func AdminListOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if uid := r.URL.Query().Get("user_id"); uid != "" {
+		id, err := bson.ObjectIDFromHex(uid)
+		if err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid user id")
+			return
+		}
+		filter["user_id"] = id
+	}
+	listOrders(w, r, filter, nil, nil)
+}
+
+// AdminSetOrderStatusHandler moves an order along any allowed transition.
+func AdminSetOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Status         string `json:"status"`
+		TrackingNumber string `json:"tracking_number"`
+		Note           string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if _, ok := orderTransitions[payload.Status]; !ok {
+		helpers.RespondError(w, http.StatusBadRequest, "unknown status")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	o, principal, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	extra := bson.M{}
+	if tn := strings.TrimSpace(payload.TrackingNumber); tn != "" {
+		extra["tracking_number"] = tn
+	}
+	if payload.Status == models.OrderStatusRefunded && slices.Contains(orderTransitions[payload.Status], o.Status) {
+		err := refundOrderPayment(ctx, o, 0, "order-refund:"+o.ID.Hex())
+		if err != nil && !errors.Is(err, errNoPayment) {
+			log.Printf("Error refunding order %s: %v", o.ID.Hex(), err)
+			helpers.RespondError(w, http.StatusBadGateway, "refund failed")
+			return
+		}
+	}
+	o, err := setOrderStatus(ctx, o, payload.Status, principal.UserID, payload.Note, extra)
+	if err != nil {
+		respondOrderError(w, err)
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, o)
+}
+
+// anonymizeOrders detaches a deleted user's orders and payments from the
+// account. Unpaid orders are cancelled; the rest are kept for the sellers'
+// books with the shipping address cut down to the country.
+func anonymizeOrders(ctx context.Context, userID bson.ObjectID) error {
+	cursor, err := database.OrdersColl.Find(ctx, bson.M{"user_id": userID, "status": models.OrderStatusPending})
+	if err != nil {
+		return err
+	}
+	var pending []models.Order
+	if err := cursor.All(ctx, &pending); err != nil {
+		return err
+	}
+	for _, o := range pending {
+		if _, err := setOrderStatus(ctx, o, models.OrderStatusCancelled, userID, "account deleted", nil); err != nil && !errors.Is(err, errOrderChanged) {
+			return err
+		}
+	}
+	_, err = database.OrdersColl.UpdateMany(ctx, bson.M{"user_id": userID}, bson.A{
+		bson.M{"$set": bson.M{"shipping_address": bson.M{"country": "$shipping_address.country"}}},
+		bson.M{"$unset": "user_id"},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = database.PaymentsColl.UpdateMany(ctx, bson.M{"user_id": userID}, bson.M{"$unset": bson.M{"user_id": ""}})
+	if err != nil {
+		return err
+	}
+	// the slot only means something per user
+	_, err = database.RedemptionsColl.UpdateMany(ctx, bson.M{"user_id": userID}, bson.M{"$unset": bson.M{"user_id": "", "slot": ""}})
+	if err != nil {
+		return err
+	}
+	_, err = database.ReturnsColl.UpdateMany(ctx, bson.M{"user_id": userID}, bson.M{"$unset": bson.M{"user_id": ""}})
+	return err
+}
@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/payments"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// PaymentProvider takes the payments. It is set in main.
+var PaymentProvider payments.Provider
+
+const maxWebhookBody = 1 << 20
+
+var errNoPayment = errors.New("order has no captured payment")
+
+// activePayment returns the order's payment that is in flight or went
+// through, if any.
+func activePayment(ctx context.Context, orderID bson.ObjectID) (*models.Payment, error) {
+	var p models.Payment
+	err := database.PaymentsColl.FindOne(ctx, bson.M{
+		"order_id": orderID,
+		"status":   bson.M{"$in": bson.A{models.PaymentStatusCreated, models.PaymentStatusProcessing, models.PaymentStatusSucceeded, models.PaymentStatusRefunded}},
+	}, options.FindOne().SetSort(bson.D{{Key: "attempt", Value: -1}})).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// applyPaymentStatus records the provider's verdict on a payment and moves
+// the order along. It is safe to call repeatedly with the same verdict, as
+// both the pay request and the webhook report it.
+func applyPaymentStatus(ctx context.Context, p models.Payment, status, failureReason string) (models.Payment, error) {
+	from := bson.A{models.PaymentStatusCreated, models.PaymentStatusProcessing}
+	if status == models.PaymentStatusProcessing {
+		from = bson.A{models.PaymentStatusCreated}
+	}
+	set := bson.M{"status": status, "updated_at": time.Now()}
+	if failureReason != "" {
+		set["failure_reason"] = failureReason
+	}
+	err := database.PaymentsColl.FindOneAndUpdate(ctx,
+		bson.M{"_id": p.ID, "status": bson.M{"$in": from}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// already recorded; still make sure the order caught up
+		err = database.PaymentsColl.FindOne(ctx, bson.M{"_id": p.ID}).Decode(&p)
+	}
+	if err != nil || p.Status != models.PaymentStatusSucceeded {
+		return p, err
+	}
+
+	var o models.Order
+	if err := database.OrdersColl.FindOne(ctx, bson.M{"_id": p.OrderID}).Decode(&o); err != nil {
+		return p, err
+	}
+	switch o.Status {
+	case models.OrderStatusPending:
+		_, err = setOrderStatus(ctx, o, models.OrderStatusPaid, bson.ObjectID{}, "payment "+p.IntentID, nil)
+		if errors.Is(err, errOrderChanged) {
+			err = nil
+		}
+	case models.OrderStatusCancelled:
+		// the money arrived after the order was given up on
+		err = refundPayment(ctx, &p, p.Amount-p.AmountRefunded, "cancelled:"+p.ID.Hex())
+	}
+	return p, err
+}
+
+// refundPayment refunds amount of a succeeded payment through the provider.
+func refundPayment(ctx context.Context, p *models.Payment, amount int64, idempotencyKey string) error {
+	if amount <= 0 {
+		return nil
+	}
+	re, err := PaymentProvider.Refund(ctx, p.IntentID, amount, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	return recordRefund(ctx, p, p.AmountRefunded+re.Amount)
+}
+
+// recordRefund stores the payment's refunded total; $max makes replays of
+// the same refund harmless.
+func recordRefund(ctx context.Context, p *models.Payment, refunded int64) error {
+	update := bson.A{
+		bson.M{"$set": bson.M{"amount_refunded": bson.M{"$max": bson.A{"$amount_refunded", refunded}}, "updated_at": time.Now()}},
+		bson.M{"$set": bson.M{"status": bson.M{"$cond": bson.A{
+			bson.M{"$gte": bson.A{"$amount_refunded", "$amount"}}, models.PaymentStatusRefunded, "$status",
+		}}}},
+	}
+	return database.PaymentsColl.FindOneAndUpdate(ctx, bson.M{"_id": p.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(p)
+}
+
+// refundOrderPayment refunds amount (everything left when zero) of the
+// order's payment. Orders marked paid by hand have none: errNoPayment.
+func refundOrderPayment(ctx context.Context, o models.Order, amount int64, idempotencyKey string) error {
+	var p models.Payment
+	err := database.PaymentsColl.FindOne(ctx, bson.M{
+		"order_id": o.ID,
+		"status":   bson.M{"$in": bson.A{models.PaymentStatusSucceeded, models.PaymentStatusRefunded}},
+	}).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errNoPayment
+	}
+	if err != nil {
+		return err
+	}
+	if amount == 0 {
+		amount = p.Amount - p.AmountRefunded
+	}
+	return refundPayment(ctx, &p, amount, idempotencyKey)
+}
+
+// PayOrderHandler pays a pending order. The answer is 200 when the payment
+// went through, 202 while the provider is still deciding and 402 when it
+// was declined.
+func PayOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PaymentMethod string `json:"payment_method"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	o, principal, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	if o.UserID != principal.UserID {
+		helpers.RespondError(w, http.StatusForbidden, "only the buyer can pay")
+		return
+	}
+	if o.Status != models.OrderStatusPending {
+		helpers.RespondError(w, http.StatusConflict, "order is not awaiting payment")
+		return
+	}
+	if o.ExpiresAt != nil && !time.Now().Before(*o.ExpiresAt) {
+		helpers.RespondError(w, http.StatusConflict, "order expired, check out again")
+		return
+	}
+	active, err := activePayment(ctx, o.ID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if active != nil {
+		helpers.RespondError(w, http.StatusConflict, "a payment for this order is already in progress")
+		return
+	}
+
+	attempts, err := database.PaymentsColl.CountDocuments(ctx, bson.M{"order_id": o.ID})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	now := time.Now()
+	p := models.Payment{
+		OrderID:   o.ID,
+		UserID:    o.UserID,
+		Attempt:   int(attempts) + 1,
+		Provider:  PaymentProvider.Name(),
+		Amount:    o.Total.Amount,
+		Currency:  o.Total.Currency,
+		Status:    models.PaymentStatusCreated,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	res, err := database.PaymentsColl.InsertOne(ctx, p)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "a payment for this order is already in progress")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	p.ID = res.InsertedID.(bson.ObjectID)
+
+	intent, err := PaymentProvider.CreateIntent(ctx, payments.IntentRequest{
+		Reference:      p.ID.Hex(),
+		Amount:         p.Amount,
+		Currency:       p.Currency,
+		PaymentMethod:  payload.PaymentMethod,
+		IdempotencyKey: p.ID.Hex(),
+	})
+	if err != nil {
+		log.Printf("Error creating payment for order %s: %v", o.ID.Hex(), err)
+		if _, err := applyPaymentStatus(ctx, p, models.PaymentStatusFailed, "provider_error"); err != nil {
+			log.Printf("Error recording failed payment %s: %v", p.ID.Hex(), err)
+		}
+		helpers.RespondError(w, http.StatusBadGateway, "payment provider unavailable")
+		return
+	}
+	if _, err := database.PaymentsColl.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"intent_id": intent.ID}}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	p.IntentID = intent.ID
+
+	code := http.StatusOK
+	switch intent.Status {
+	case payments.StatusSucceeded:
+		p, err = applyPaymentStatus(ctx, p, models.PaymentStatusSucceeded, "")
+	case payments.StatusFailed:
+		p, err = applyPaymentStatus(ctx, p, models.PaymentStatusFailed, intent.FailureReason)
+		code = http.StatusPaymentRequired
+	default:
+		p, err = applyPaymentStatus(ctx, p, models.PaymentStatusProcessing, "")
+		code = http.StatusAccepted
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := database.OrdersColl.FindOne(ctx, bson.M{"_id": o.ID}).Decode(&o); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, code, map[string]interface{}{
+		"order":   o,
+		"payment": p,
+	})
+}
+
+// PaymentWebhookHandler receives provider callbacks. Each event is handled
+// once: it is recorded before processing and forgotten again if processing
+// fails, so the provider's retry gets another go.
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if PaymentProvider == nil || mux.Vars(r)["provider"] != PaymentProvider.Name() {
+		helpers.RespondError(w, http.StatusNotFound, "unknown provider")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "could not read body")
+		return
+	}
+	ev, err := PaymentProvider.VerifyWebhook(r.Header, body)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	record := models.PaymentEvent{ID: PaymentProvider.Name() + ":" + ev.ID, Type: ev.Type, IntentID: ev.IntentID, ReceivedAt: time.Now()}
+	if _, err := database.PaymentEventsColl.InsertOne(ctx, record); mongo.IsDuplicateKeyError(err) {
+		helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "duplicate"})
+		return
+	} else if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if err := processPaymentEvent(ctx, ev); err != nil {
+		log.Printf("Error processing payment event %s: %v", ev.ID, err)
+		if _, err := database.PaymentEventsColl.DeleteOne(ctx, bson.M{"_id": record.ID}); err != nil {
+			log.Printf("Error forgetting payment event %s: %v", ev.ID, err)
+		}
+		helpers.RespondError(w, http.StatusInternalServerError, "could not process event")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "processed"})
+}
+
+func processPaymentEvent(ctx context.Context, ev *payments.Event) error {
+	// the reference is our payment id; the intent id may not be stored yet
+	id, err := bson.ObjectIDFromHex(ev.Reference)
+	if err != nil {
+		return err
+	}
+	var p models.Payment
+	if err := database.PaymentsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&p); err != nil {
+		return err
+	}
+	if p.IntentID == "" {
+		p.IntentID = ev.IntentID
+		if _, err := database.PaymentsColl.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"intent_id": ev.IntentID}}); err != nil {
+			return err
+		}
+	}
+
+	switch ev.Type {
+	case payments.EventPaymentSucceeded:
+		_, err = applyPaymentStatus(ctx, p, models.PaymentStatusSucceeded, "")
+	case payments.EventPaymentFailed:
+		_, err = applyPaymentStatus(ctx, p, models.PaymentStatusFailed, ev.FailureReason)
+	case payments.EventRefundSucceeded:
+		err = recordRefund(ctx, &p, ev.AmountRefunded)
+	}
+	return err
+}
+
+// ListOrderPaymentsHandler lists the payment attempts of an order.
+func ListOrderPaymentsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	o, _, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	cursor, err := database.PaymentsColl.Find(ctx, bson.M{"order_id": o.ID}, options.Find().SetSort(bson.D{{Key: "attempt", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Payment{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// AdminSettleFakePaymentHandler finishes an async payment of the fake
+// provider, standing in for the bank. It only exists with the fake.
+func AdminSettleFakePaymentHandler(w http.ResponseWriter, r *http.Request) {
+	fake, ok := PaymentProvider.(*payments.Fake)
+	if !ok {
+		helpers.RespondError(w, http.StatusNotFound, "not using the fake payment provider")
+		return
+	}
+	var payload struct {
+		Succeed bool `json:"succeed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	intent, err := fake.Settle(ctx, mux.Vars(r)["intentId"], payload.Succeed)
+	if errors.Is(err, payments.ErrUnknownIntent) {
+		helpers.RespondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	// apply it right away too, so this works without webhook delivery
+	ev := &payments.Event{Type: payments.EventPaymentFailed, IntentID: intent.ID, Reference: intent.Reference, FailureReason: intent.FailureReason}
+	if intent.Status == payments.StatusSucceeded {
+		ev.Type = payments.EventPaymentSucceeded
+	}
+	if err := processPaymentEvent(ctx, ev); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, intent)
+}
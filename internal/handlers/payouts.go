@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// payoutHold keeps recent earnings back until returns are unlikely.
+	payoutHold = 7 * 24 * time.Hour
+
+	// payoutRunTimeout bounds a payout run. A batch still running after
+	// payoutLease died with its server and no longer blocks new runs.
+	payoutRunTimeout = 2 * time.Minute
+	payoutLease      = 5 * time.Minute
+
+	defaultStatementRange = 31 * 24 * time.Hour
+	maxStatementRange     = 366 * 24 * time.Hour
+)
+
+// sellerBalances sums the payable account per seller from the ledger:
+// earnings and refunds booked up to until, and every payout so far. A
+// zero sellerID means all sellers. Only entries in the store currency
+// count; amounts booked under a former one are settled by hand.
+func sellerBalances(ctx context.Context, sellerID bson.ObjectID, until time.Time) (map[bson.ObjectID]money.Money, error) {
+	match := bson.M{
+		"account":         models.AccountSellerPayable,
+		"amount.currency": money.Default,
+		"$or": bson.A{
+			bson.M{"created_at": bson.M{"$lte": until}},
+			bson.M{"kind": models.LedgerKindPayout},
+		},
+	}
+	if !sellerID.IsZero() {
+		match["seller_id"] = sellerID
+	}
+	cursor, err := database.LedgerColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": "$seller_id", "amount": bson.M{"$sum": "$amount.amount"}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		SellerID bson.ObjectID `bson:"_id"`
+		Amount   int64         `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	balances := make(map[bson.ObjectID]money.Money, len(rows))
+	for _, row := range rows {
+		// payable is a credit account: what is owed shows as negative
+		balances[row.SellerID] = money.New(-row.Amount, money.Default)
+	}
+	return balances, nil
+}
+
+// sellerBalanceView is a seller's balance, what of it can be paid out and
+// what was paid out so far, all from the ledger.
+func sellerBalanceView(ctx context.Context, sellerID bson.ObjectID) (map[string]interface{}, error) {
+	now := time.Now()
+	all, err := sellerBalances(ctx, sellerID, now)
+	if err != nil {
+		return nil, err
+	}
+	settled, err := sellerBalances(ctx, sellerID, now.Add(-payoutHold))
+	if err != nil {
+		return nil, err
+	}
+	balance, available := all[sellerID], settled[sellerID]
+	if balance.Currency == "" {
+		balance = money.Zero(money.Default)
+	}
+	if available.Currency == "" {
+		available = money.Zero(money.Default)
+	}
+
+	cursor, err := database.LedgerColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"account": models.AccountSellerPayable, "amount.currency": money.Default, "seller_id": sellerID, "kind": models.LedgerKindPayout}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "amount": bson.M{"$sum": "$amount.amount"}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Amount int64 `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	paidOut := money.Zero(money.Default)
+	if len(rows) > 0 {
+		paidOut = money.New(rows[0].Amount, money.Default)
+	}
+
+	return map[string]interface{}{
+		"seller_id": sellerID,
+		"currency":  money.Default,
+		"balance":   balance,
+		"available": available,
+		"pending":   balance.Sub(available),
+		"paid_out":  paidOut,
+	}, nil
+}
+
+func respondSellerBalance(w http.ResponseWriter, sellerID bson.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	view, err := sellerBalanceView(ctx, sellerID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, view)
+}
+
+func SellerBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	respondSellerBalance(w, s.ID)
+}
+
+func AdminSellerBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	respondSellerBalance(w, id)
+}
+
+type statementLine struct {
+	At       time.Time     `json:"at"`
+	Kind     string        `json:"kind"`
+	OrderID  bson.ObjectID `json:"order_id,omitzero"`
+	ReturnID bson.ObjectID `json:"return_id,omitzero"`
+	PayoutID bson.ObjectID `json:"payout_id,omitzero"`
+	Memo     string        `json:"memo,omitempty"`
+	Amount   money.Money   `json:"amount"`
+	Balance  money.Money   `json:"balance"`
+}
+
+// respondStatement lists the seller's payable entries in [from, to) with a
+// running balance, as JSON or, with ?format=csv, as a CSV download.
+// Amounts are from the seller's side: earnings positive, refunds and
+// payouts negative. Like balances, it covers the store currency only.
+func respondStatement(w http.ResponseWriter, r *http.Request, sellerID bson.ObjectID) {
+	q := r.URL.Query()
+	var err error
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		if to, err = parseHistoryTime(s); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid to")
+			return
+		}
+	}
+	from := to.Add(-defaultStatementRange)
+	if s := q.Get("from"); s != "" {
+		if from, err = parseHistoryTime(s); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid from")
+			return
+		}
+	}
+	if !from.Before(to) || to.Sub(from) > maxStatementRange {
+		helpers.RespondError(w, http.StatusBadRequest, "from must be before to and at most a year apart")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	entriesAt := func(at bson.M) bson.M {
+		return bson.M{"account": models.AccountSellerPayable, "amount.currency": money.Default, "seller_id": sellerID, "created_at": at}
+	}
+	cursor, err := database.LedgerColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: entriesAt(bson.M{"$lt": from})}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "amount": bson.M{"$sum": "$amount.amount"}}}},
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	var opening []struct {
+		Amount int64 `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &opening); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	balance := money.Zero(money.Default)
+	if len(opening) > 0 {
+		balance = money.New(-opening[0].Amount, money.Default)
+	}
+	openingBalance := balance
+
+	cursor, err = database.LedgerColl.Find(ctx, entriesAt(bson.M{"$gte": from, "$lt": to}),
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	var entries []models.LedgerEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	lines := make([]statementLine, 0, len(entries))
+	for _, e := range entries {
+		amount := money.Zero(e.Amount.Currency).Sub(e.Amount)
+		balance = balance.Add(amount)
+		lines = append(lines, statementLine{
+			At: e.CreatedAt, Kind: e.Kind, OrderID: e.OrderID, ReturnID: e.ReturnID, PayoutID: e.PayoutID,
+			Memo: e.Memo, Amount: amount, Balance: balance,
+		})
+	}
+
+	if q.Get("format") != "csv" {
+		helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+			"seller_id":       sellerID,
+			"currency":        money.Default,
+			"from":            from,
+			"to":              to,
+			"opening_balance": openingBalance,
+			"closing_balance": balance,
+			"entries":         lines,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s-%s.csv"`,
+		sellerID.Hex(), from.Format("20060102"), to.Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+	hex := func(id bson.ObjectID) string {
+		if id.IsZero() {
+			return ""
+		}
+		return id.Hex()
+	}
+	amount := func(m money.Money) string {
+		return strconv.FormatFloat(m.Major(), 'f', money.Exponent(m.Currency), 64)
+	}
+	cw := csv.NewWriter(w)
+	rows := [][]string{
+		{"date", "kind", "order_id", "return_id", "payout_id", "memo", "amount", "balance", "currency"},
+		{from.UTC().Format(time.RFC3339), "opening_balance", "", "", "", "", "", amount(openingBalance), money.Default},
+	}
+	for _, l := range lines {
+		rows = append(rows, []string{
+			l.At.UTC().Format(time.RFC3339), l.Kind, hex(l.OrderID), hex(l.ReturnID), hex(l.PayoutID),
+			csvText(l.Memo), amount(l.Amount), amount(l.Balance), l.Amount.Currency,
+		})
+	}
+	rows = append(rows, []string{to.UTC().Format(time.RFC3339), "closing_balance", "", "", "", "", "", amount(balance), money.Default})
+	if err := cw.WriteAll(rows); err != nil {
+		log.Printf("Error writing statement of seller %s: %v", sellerID.Hex(), err)
+	}
+}
+
+// csvText makes free text safe for spreadsheets: a cell starting with one
+// of =+-@, a tab or a carriage return would be read as a formula, so it is
+// prefixed with a quote. Memos are product names, which sellers choose.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func SellerStatementHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	respondStatement(w, r, s.ID)
+}
+
+func AdminSellerStatementHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	respondStatement(w, r, id)
+}
+
+// RunPayoutsHandler pays every seller with a positive balance earned up to
+// period_end (payoutHold ago by default). Each payout moves the amount from
+// the seller's payable account to cash; the transfer itself is made from
+// the batch outside the platform. Only one run can be in progress; one
+// running for longer than payoutLease is given up as failed.
+func RunPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		PeriodEnd *time.Time `json:"period_end"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+	}
+	now := time.Now()
+	periodEnd := now.Add(-payoutHold)
+	if payload.PeriodEnd != nil {
+		periodEnd = *payload.PeriodEnd
+	}
+	if periodEnd.After(now) {
+		helpers.RespondError(w, http.StatusBadRequest, "period_end must not be in the future")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), payoutRunTimeout)
+	defer cancel()
+
+	// a run whose server died never got to mark its batch
+	_, err := database.PayoutsColl.UpdateMany(ctx,
+		bson.M{"status": models.PayoutStatusRunning, "created_at": bson.M{"$lt": now.Add(-payoutLease)}},
+		bson.M{"$set": bson.M{"status": models.PayoutStatusFailed, "failure": "abandoned"}})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	batch := models.PayoutBatch{
+		PeriodEnd: periodEnd,
+		Status:    models.PayoutStatusRunning,
+		Payouts:   []models.Payout{},
+		Total:     money.Zero(money.Default),
+		CreatedBy: principal.UserID,
+		CreatedAt: now,
+	}
+	res, err := database.PayoutsColl.InsertOne(ctx, batch)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "a payout run is already in progress")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	batch.ID = res.InsertedID.(bson.ObjectID)
+
+	// a failed run frees the way for the next one, which counts the
+	// payouts this one booked already. The run's own context may be what
+	// ran out, so the batch is marked with a fresh one.
+	fail := func(cause error) {
+		log.Printf("Error running payout batch %s: %v", batch.ID.Hex(), cause)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := database.PayoutsColl.UpdateOne(ctx, bson.M{"_id": batch.ID}, bson.M{"$set": bson.M{
+			"status": models.PayoutStatusFailed, "payouts": batch.Payouts, "total": batch.Total, "failure": cause.Error(),
+		}})
+		if err != nil {
+			log.Printf("Error marking payout batch %s failed: %v", batch.ID.Hex(), err)
+		}
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+	}
+	balances, err := sellerBalances(ctx, bson.ObjectID{}, periodEnd)
+	if err != nil {
+		fail(err)
+		return
+	}
+	for sellerID, amount := range balances {
+		if sellerID.IsZero() || amount.Amount <= 0 {
+			continue
+		}
+		err := postLedger(ctx, "payout:"+batch.ID.Hex()+":"+sellerID.Hex(), models.LedgerKindPayout, []models.LedgerEntry{
+			{Account: models.AccountSellerPayable, SellerID: sellerID, PayoutID: batch.ID, Amount: amount, Memo: "payout"},
+			{Account: models.AccountCash, SellerID: sellerID, PayoutID: batch.ID, Amount: money.Zero(amount.Currency).Sub(amount), Memo: "payout"},
+		})
+		if err != nil {
+			fail(fmt.Errorf("seller %s: %w", sellerID.Hex(), err))
+			return
+		}
+		batch.Payouts = append(batch.Payouts, models.Payout{SellerID: sellerID, Amount: amount})
+		batch.Total = batch.Total.Add(amount)
+	}
+
+	completed := time.Now()
+	batch.Status, batch.CompletedAt = models.PayoutStatusCompleted, &completed
+	_, err = database.PayoutsColl.UpdateOne(ctx, bson.M{"_id": batch.ID}, bson.M{"$set": bson.M{
+		"status":       batch.Status,
+		"payouts":      batch.Payouts,
+		"total":        batch.Total,
+		"completed_at": completed,
+	}})
+	if err != nil {
+		fail(err)
+		return
+	}
+	helpers.RespondJSON(w, http.StatusCreated, batch)
+}
+
+func ListPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit, skip := helpers.Pagination(r, 20, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := database.PayoutsColl.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.PayoutsColl.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.PayoutBatch{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func GetPayoutHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var batch models.PayoutBatch
+	if err := database.PayoutsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&batch); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "payout batch not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, batch)
+}
@@ -0,0 +1,317 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultPriceHistoryRange = 90 * 24 * time.Hour
+	maxPriceHistoryRange     = 2 * 366 * 24 * time.Hour
+)
+
+func priceSnapshot(p models.Product) models.PriceChange {
+	c := models.PriceChange{
+		ProductID:      p.ID,
+		Price:          p.Price,
+		CompareAtPrice: p.CompareAtPrice,
+		SalePrice:      p.SalePrice,
+		SaleStartsAt:   p.SaleStartsAt,
+		SaleEndsAt:     p.SaleEndsAt,
+	}
+	for _, v := range p.Variants {
+		if v.Price != nil {
+			if c.VariantPrices == nil {
+				c.VariantPrices = map[string]money.Money{}
+			}
+			c.VariantPrices[v.ID.Hex()] = *v.Price
+		}
+	}
+	return c
+}
+
+// pricedProduct turns a snapshot back into a product PriceAt understands.
+func pricedProduct(c models.PriceChange) models.Product {
+	return models.Product{
+		ID:             c.ProductID,
+		Price:          c.Price,
+		CompareAtPrice: c.CompareAtPrice,
+		SalePrice:      c.SalePrice,
+		SaleStartsAt:   c.SaleStartsAt,
+		SaleEndsAt:     c.SaleEndsAt,
+	}
+}
+
+func samePricing(a, b models.PriceChange) bool {
+	sameAmount := func(x, y *money.Money) bool { return x == y || (x != nil && y != nil && *x == *y) }
+	// stored times lose everything below a millisecond
+	sameTime := func(x, y *time.Time) bool {
+		return x == y || (x != nil && y != nil && x.Truncate(time.Millisecond).Equal(y.Truncate(time.Millisecond)))
+	}
+	return a.Price == b.Price &&
+		sameAmount(a.CompareAtPrice, b.CompareAtPrice) &&
+		sameAmount(a.SalePrice, b.SalePrice) &&
+		sameTime(a.SaleStartsAt, b.SaleStartsAt) &&
+		sameTime(a.SaleEndsAt, b.SaleEndsAt) &&
+		maps.Equal(a.VariantPrices, b.VariantPrices)
+}
+
+// recordPriceChange appends the product's pricing to its history unless it
+// is the same as the last entry.
+func recordPriceChange(ctx context.Context, p models.Product, by bson.ObjectID) error {
+	c := priceSnapshot(p)
+	var last models.PriceChange
+	err := database.PriceHistoryColl.FindOne(ctx, bson.M{"product_id": p.ID},
+		options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}})).Decode(&last)
+	if err == nil && samePricing(last, c) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	c.ChangedBy = by
+	c.At = time.Now()
+	_, err = database.PriceHistoryColl.InsertOne(ctx, c)
+	return err
+}
+
+// notePriceChange records the pricing after a product write. The write has
+// already happened, so a failure is only logged.
+func notePriceChange(ctx context.Context, r *http.Request, p models.Product) {
+	var by bson.ObjectID
+	if principal, ok := middleware.UserFrom(r.Context()); ok {
+		by = principal.UserID
+	}
+	if err := recordPriceChange(ctx, p, by); err != nil {
+		log.Printf("Error recording price of product %s: %v", p.ID.Hex(), err)
+	}
+}
+
+type pricePoint struct {
+	At       time.Time   `json:"at"`
+	Price    money.Money `json:"price"`
+	WasPrice money.Money `json:"was_price,omitzero"`
+	OnSale   bool        `json:"on_sale"`
+}
+
+// priceSeries turns pricing snapshots (oldest first) into the points where
+// the selling price of the product, or of variant vid, changed within
+// [from, to). Sales starting or ending inside a snapshot's span are points
+// too.
+func priceSeries(changes []models.PriceChange, vid bson.ObjectID, from, to time.Time) []pricePoint {
+	points := []pricePoint{}
+	for i, c := range changes {
+		start, end := c.At, to
+		if i+1 < len(changes) {
+			end = changes[i+1].At
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if !start.Before(end) {
+			continue
+		}
+
+		p := pricedProduct(c)
+		var v *models.ProductVariant
+		if !vid.IsZero() {
+			v = &models.ProductVariant{ID: vid}
+			if price, ok := c.VariantPrices[vid.Hex()]; ok {
+				v.Price = &price
+			}
+		}
+		breaks := []time.Time{start}
+		for _, t := range []*time.Time{c.SaleStartsAt, c.SaleEndsAt} {
+			if t != nil && t.After(start) && t.Before(end) {
+				breaks = append(breaks, *t)
+			}
+		}
+		slices.SortFunc(breaks, func(a, b time.Time) int { return a.Compare(b) })
+
+		for _, t := range breaks {
+			pt := pricePoint{At: t, Price: p.PriceAt(v, t), WasPrice: p.WasPriceAt(v, t), OnSale: p.OnSaleAt(t) && (v == nil || v.Price == nil)}
+			if n := len(points); n > 0 && points[n-1].Price == pt.Price && points[n-1].WasPrice == pt.WasPrice && points[n-1].OnSale == pt.OnSale {
+				continue
+			}
+			points = append(points, pt)
+		}
+	}
+	return points
+}
+
+// parseHistoryTime accepts RFC 3339 times and plain dates.
+func parseHistoryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// PriceHistoryHandler charts a product's selling price over time. With
+// ?interactions=true it adds daily interaction counts for the same range.
+func PriceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	q := r.URL.Query()
+	var vid bson.ObjectID
+	if s := q.Get("variant_id"); s != "" {
+		if vid, err = bson.ObjectIDFromHex(s); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+			return
+		}
+	}
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		if to, err = parseHistoryTime(s); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid to")
+			return
+		}
+	}
+	from := to.Add(-defaultPriceHistoryRange)
+	if s := q.Get("from"); s != "" {
+		if from, err = parseHistoryTime(s); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid from")
+			return
+		}
+	}
+	if !from.Before(to) || to.Sub(from) > maxPriceHistoryRange {
+		helpers.RespondError(w, http.StatusBadRequest, "from must be before to and at most two years apart")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var p models.Product
+	if err := database.ProductsColl.FindOne(ctx, listedFilter(bson.M{"_id": id})).Decode(&p); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "product not found")
+		return
+	}
+	var v *models.ProductVariant
+	if !vid.IsZero() {
+		if v = p.Variant(vid); v == nil {
+			helpers.RespondError(w, http.StatusNotFound, "variant not found")
+			return
+		}
+	}
+
+	// the pricing in force at from, then every change up to to
+	changes := []models.PriceChange{}
+	var first models.PriceChange
+	err = database.PriceHistoryColl.FindOne(ctx, bson.M{"product_id": id, "at": bson.M{"$lte": from}},
+		options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}})).Decode(&first)
+	if err == nil {
+		changes = append(changes, first)
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.PriceHistoryColl.Find(ctx, bson.M{"product_id": id, "at": bson.M{"$gt": from, "$lte": to}},
+		options.Find().SetSort(bson.D{{Key: "at", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	var rest []models.PriceChange
+	if err := cursor.All(ctx, &rest); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	changes = append(changes, rest...)
+	if len(changes) == 0 {
+		// products from before price history, or left unchanged since
+		c := priceSnapshot(p)
+		c.At = p.CreatedAt
+		changes = append(changes, c)
+	}
+
+	now := time.Now()
+	resp := map[string]interface{}{
+		"product_id": p.ID,
+		"currency":   money.Default,
+		"from":       from,
+		"to":         to,
+		"points":     priceSeries(changes, vid, from, to),
+		"current": pricePoint{
+			At:       now,
+			Price:    p.PriceAt(v, now),
+			WasPrice: p.WasPriceAt(v, now),
+			OnSale:   p.OnSaleAt(now) && (v == nil || v.Price == nil),
+		},
+	}
+	if !vid.IsZero() {
+		resp["variant_id"] = vid
+	}
+
+	if q.Get("interactions") == "true" {
+		daily, err := dailyInteractions(ctx, id, vid, from, to)
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		resp["interactions"] = daily
+	}
+	helpers.RespondJSON(w, http.StatusOK, resp)
+}
+
+// dailyInteractions counts a product's interactions per UTC day and type.
+func dailyInteractions(ctx context.Context, productID, variantID bson.ObjectID, from, to time.Time) ([]map[string]interface{}, error) {
+	match := bson.M{"product_id": productID, "timestamp": bson.M{"$gte": from, "$lt": to}}
+	if !variantID.IsZero() {
+		match["variant_id"] = variantID
+	}
+	cursor, err := database.InteractionsColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"day":    bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp"}},
+				"action": "$action_type",
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id.day": 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID struct {
+			Day    string `bson:"day"`
+			Action string `bson:"action"`
+		} `bson:"_id"`
+		Count int `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	days := []map[string]interface{}{}
+	for _, row := range rows {
+		if n := len(days); n == 0 || days[n-1]["date"] != row.ID.Day {
+			days = append(days, map[string]interface{}{"date": row.ID.Day})
+		}
+		days[len(days)-1][row.ID.Action] = row.Count
+	}
+	return days, nil
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	maxProductNameLen        = 200
+	maxProductDescriptionLen = 5000
+	maxCategoryLen           = 64
+)
+
+// productInput holds the editable fields of a product. Pointers tell PATCH
+// which fields were sent; POST and PUT require all of them.
+type productInput struct {
+	Name        *string      `json:"name"`
+	Description *string      `json:"description"`
+	Category    *string      `json:"category"`
+	Price       *money.Money `json:"price"`
+	ImageURL    *string      `json:"image_url"`
+
+	LowStockThreshold *int `json:"low_stock_threshold"`
+	WeightGrams       *int `json:"weight_grams"`
+
+	// A sale needs sale_price; the window may be left open on either side.
+	CompareAtPrice      *money.Money `json:"compare_at_price"`
+	ClearCompareAtPrice bool         `json:"clear_compare_at_price"`
+	SalePrice           *money.Money `json:"sale_price"`
+	SaleStartsAt        *time.Time   `json:"sale_starts_at"`
+	SaleEndsAt          *time.Time   `json:"sale_ends_at"`
+	ClearSale           bool         `json:"clear_sale"`
+}
+
+func (in productInput) complete() bool {
+	return in.Name != nil && in.Description != nil && in.Category != nil && in.Price != nil
+}
+
+// apply validates the sent fields and copies them onto p.
+func (in productInput) apply(p *models.Product) error {
+	if in.Name != nil {
+		name := strings.TrimSpace(*in.Name)
+		if name == "" || len(name) > maxProductNameLen {
+			return errors.New("name must be 1-200 characters")
+		}
+		p.Name = name
+	}
+	if in.Description != nil {
+		if len(*in.Description) > maxProductDescriptionLen {
+			return errors.New("description too long")
+		}
+		p.Description = strings.TrimSpace(*in.Description)
+	}
+	if in.Category != nil {
+		cat := strings.TrimSpace(*in.Category)
+		if cat == "" || len(cat) > maxCategoryLen {
+			return errors.New("category must be 1-64 characters")
+		}
+		p.Category = cat
+	}
+	if in.Price != nil {
+		if err := checkPrice("price", *in.Price); err != nil {
+			return err
+		}
+		p.Price = *in.Price
+	}
+	if in.ImageURL != nil {
+		if *in.ImageURL != "" && !isImageURL(*in.ImageURL) {
+			return errors.New("image_url must be an http(s) URL")
+		}
+		p.ImageURL = *in.ImageURL
+	}
+	if in.LowStockThreshold != nil {
+		if *in.LowStockThreshold < 0 {
+			return errors.New("low_stock_threshold must not be negative")
+		}
+		p.LowStockThreshold = *in.LowStockThreshold
+	}
+	if in.WeightGrams != nil {
+		if *in.WeightGrams < 0 {
+			return errors.New("weight_grams must not be negative")
+		}
+		p.WeightGrams = *in.WeightGrams
+	}
+
+	if in.ClearCompareAtPrice {
+		p.CompareAtPrice = nil
+	} else if in.CompareAtPrice != nil {
+		if err := checkPrice("compare_at_price", *in.CompareAtPrice); err != nil {
+			return err
+		}
+		price := *in.CompareAtPrice
+		p.CompareAtPrice = &price
+	}
+	if in.ClearSale {
+		p.SalePrice, p.SaleStartsAt, p.SaleEndsAt = nil, nil, nil
+	} else {
+		if in.SalePrice != nil {
+			if err := checkPrice("sale_price", *in.SalePrice); err != nil {
+				return err
+			}
+			price := *in.SalePrice
+			p.SalePrice = &price
+		}
+		if in.SaleStartsAt != nil {
+			p.SaleStartsAt = in.SaleStartsAt
+		}
+		if in.SaleEndsAt != nil {
+			p.SaleEndsAt = in.SaleEndsAt
+		}
+	}
+	if p.SalePrice == nil && (p.SaleStartsAt != nil || p.SaleEndsAt != nil) {
+		return errors.New("sale_price required for a sale window")
+	}
+	for _, m := range []*money.Money{&p.Price, p.CompareAtPrice, p.SalePrice} {
+		if m != nil && !m.In(money.Default) {
+			return errors.New("prices must be in " + money.Default + "; set price, compare_at_price and sale_price again")
+		}
+	}
+	if p.SalePrice != nil && !p.SalePrice.Less(p.Price) {
+		return errors.New("sale_price must be below price")
+	}
+	if p.SaleStartsAt != nil && p.SaleEndsAt != nil && !p.SaleEndsAt.After(*p.SaleStartsAt) {
+		return errors.New("sale_ends_at must be after sale_starts_at")
+	}
+	return nil
+}
+
+func checkPrice(field string, m money.Money) error {
+	if err := checkStoreAmount(m); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+func isImageURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ownedProduct loads the product named in the URL if the caller may change
+// it: admins may change any product, sellers only their own. It writes the
+// error response itself.
+func ownedProduct(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Product, bool) {
+	var p models.Product
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return p, false
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return p, false
+	}
+	if err := database.ProductsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&p); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "product not found")
+		return p, false
+	}
+	if !principal.HasRole(models.RoleAdmin) && p.OwnerID != principal.UserID {
+		helpers.RespondError(w, http.StatusForbidden, "not your product")
+		return p, false
+	}
+	return p, true
+}
+
+func CreateProductHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	// stock is only set here; afterwards it changes through the stock endpoint
+	var in struct {
+		productInput
+		Stock int `json:"stock"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if in.Stock < 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "stock must not be negative")
+		return
+	}
+	if !in.complete() {
+		helpers.RespondError(w, http.StatusBadRequest, "name, description, category and price required")
+		return
+	}
+	now := time.Now()
+	p := models.Product{OwnerID: principal.UserID, Stock: in.Stock, CreatedAt: now, UpdatedAt: now}
+	if err := in.apply(&p); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// sellers list under their store; admins may list platform products
+	seller, err := approvedSellerFor(ctx, principal.UserID)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if seller != nil {
+		p.SellerID = seller.ID
+	} else if !principal.HasRole(models.RoleAdmin) {
+		helpers.RespondError(w, http.StatusForbidden, "your store is not approved")
+		return
+	}
+
+	res, err := database.ProductsColl.InsertOne(ctx, p)
+	if err != nil {
+		log.Printf("Error creating product: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	p.ID = res.InsertedID.(bson.ObjectID)
+	notePriceChange(ctx, r, p)
+	helpers.RespondJSON(w, http.StatusCreated, p)
+}
+
+// UpdateProductHandler serves both PUT (all fields required) and PATCH.
+func UpdateProductHandler(w http.ResponseWriter, r *http.Request) {
+	var in productInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if r.Method == http.MethodPut && !in.complete() {
+		helpers.RespondError(w, http.StatusBadRequest, "name, description, category and price required")
+		return
+	}
+	if r.Method == http.MethodPut && in.ImageURL == nil {
+		empty := ""
+		in.ImageURL = &empty
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, ok := ownedProduct(ctx, w, r)
+	if !ok {
+		return
+	}
+	if err := in.apply(&p); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.UpdatedAt = time.Now()
+
+	update := productUpdate(p)
+
+	err := database.ProductsColl.FindOneAndUpdate(ctx, bson.M{"_id": p.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusNotFound, "product not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating product: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	notePriceChange(ctx, r, p)
+	helpers.RespondJSON(w, http.StatusOK, p)
+}
+
+// productUpdate builds the update that stores the editable fields of p.
+// Optional fields that are nil are unset, so clearing a sale or the
+// compare-at price removes it from the document as well.
+func productUpdate(p models.Product) bson.M {
+	set := bson.M{
+		"name":        p.Name,
+		"description": p.Description,
+		"category":    p.Category,
+		"price":       p.Price,
+		"image_url":   p.ImageURL,
+		"updated_at":  p.UpdatedAt,
+
+		"low_stock_threshold": p.LowStockThreshold,
+		"weight_grams":        p.WeightGrams,
+	}
+	unset := bson.M{}
+	if p.CompareAtPrice != nil {
+		set["compare_at_price"] = *p.CompareAtPrice
+	} else {
+		unset["compare_at_price"] = ""
+	}
+	if p.SalePrice != nil {
+		set["sale_price"] = *p.SalePrice
+	} else {
+		unset["sale_price"] = ""
+	}
+	if p.SaleStartsAt != nil {
+		set["sale_starts_at"] = *p.SaleStartsAt
+	} else {
+		unset["sale_starts_at"] = ""
+	}
+	if p.SaleEndsAt != nil {
+		set["sale_ends_at"] = *p.SaleEndsAt
+	} else {
+		unset["sale_ends_at"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+func DeleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, ok := ownedProduct(ctx, w, r)
+	if !ok {
+		return
+	}
+	if _, err := database.ProductsColl.DeleteOne(ctx, bson.M{"_id": p.ID}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
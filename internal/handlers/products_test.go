@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestProductUpdateAppliesAndClearsSale(t *testing.T) {
+	p := models.Product{Name: "Kettle", Category: "kitchen", Price: money.New(10000, money.Default)}
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+	sale := money.New(7500, money.Default)
+	compareAt := money.New(12000, money.Default)
+
+	in := productInput{SalePrice: &sale, SaleStartsAt: &start, SaleEndsAt: &end, CompareAtPrice: &compareAt}
+	if err := in.apply(&p); err != nil {
+		t.Fatalf("apply sale: %v", err)
+	}
+	if got := p.UnitPrice(nil); got != sale {
+		t.Errorf("unit price during the sale = %v, want %v", got, sale)
+	}
+	update := productUpdate(p)
+	set := update["$set"].(bson.M)
+	for field, want := range map[string]interface{}{
+		"sale_price":       sale,
+		"compare_at_price": compareAt,
+		"sale_starts_at":   start,
+		"sale_ends_at":     end,
+	} {
+		if set[field] != want {
+			t.Errorf("$set %s = %v, want %v", field, set[field], want)
+		}
+	}
+	if _, ok := update["$unset"]; ok {
+		t.Errorf("unexpected $unset %v", update["$unset"])
+	}
+
+	in = productInput{ClearSale: true, ClearCompareAtPrice: true}
+	if err := in.apply(&p); err != nil {
+		t.Fatalf("clear sale: %v", err)
+	}
+	if got := p.UnitPrice(nil); got != p.Price {
+		t.Errorf("unit price after clearing the sale = %v, want %v", got, p.Price)
+	}
+	update = productUpdate(p)
+	set = update["$set"].(bson.M)
+	unset, _ := update["$unset"].(bson.M)
+	for _, field := range []string{"sale_price", "compare_at_price", "sale_starts_at", "sale_ends_at"} {
+		if _, ok := unset[field]; !ok {
+			t.Errorf("%s not unset", field)
+		}
+		if _, ok := set[field]; ok {
+			t.Errorf("%s still set", field)
+		}
+	}
+}
+
+func TestProductUpdateRequiresSalePriceForWindow(t *testing.T) {
+	p := models.Product{Name: "Kettle", Category: "kitchen", Price: money.New(10000, money.Default)}
+	start := time.Now()
+	if err := (productInput{SaleStartsAt: &start}).apply(&p); err == nil {
+		t.Error("sale window without sale_price accepted")
+	}
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	maxDisplayNameLen = 64
+	maxAddresses      = 10
+)
+
+func validateAvatarURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("avatar_url must be an http(s) URL")
+	}
+	return nil
+}
+
+// normalizeAddresses validates the addresses, assigns IDs to new ones and
+// makes sure exactly one is the default.
+func normalizeAddresses(addrs []models.Address) ([]models.Address, error) {
+	if len(addrs) > maxAddresses {
+		return nil, errors.New("too many addresses")
+	}
+	defaultSeen := false
+	for i := range addrs {
+		a := &addrs[i]
+		a.FullName = strings.TrimSpace(a.FullName)
+		a.Line1 = strings.TrimSpace(a.Line1)
+		a.City = strings.TrimSpace(a.City)
+		a.PostalCode = strings.TrimSpace(a.PostalCode)
+		a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+		if a.FullName == "" || a.Line1 == "" || a.City == "" || a.PostalCode == "" {
+			return nil, errors.New("address needs full_name, line1, city and postal_code")
+		}
+		if len(a.Country) != 2 {
+			return nil, errors.New("address country must be a two-letter ISO code")
+		}
+		if a.ID.IsZero() {
+			a.ID = bson.NewObjectID()
+		}
+		if a.IsDefault && defaultSeen {
+			a.IsDefault = false
+		}
+		defaultSeen = defaultSeen || a.IsDefault
+	}
+	if !defaultSeen && len(addrs) > 0 {
+		addrs[0].IsDefault = true
+	}
+	return addrs, nil
+}
+
+// UpdateMeHandler edits the caller's profile. Changing the username, email
+// or password requires current_password. Accounts created through an
+// identity provider have none, they may set a password without it and need
+// one before changing the username or email.
+func UpdateMeHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		DisplayName     *string           `json:"display_name"`
+		AvatarURL       *string           `json:"avatar_url"`
+		Addresses       *[]models.Address `json:"addresses"`
+		Username        *string           `json:"username"`
+		Email           *string           `json:"email"`
+		NewPassword     *string           `json:"new_password"`
+		CurrentPassword string            `json:"current_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	set := bson.M{}
+	if payload.DisplayName != nil {
+		name := strings.TrimSpace(*payload.DisplayName)
+		if len(name) > maxDisplayNameLen {
+			helpers.RespondError(w, http.StatusBadRequest, "display_name too long")
+			return
+		}
+		set["display_name"] = name
+	}
+	if payload.AvatarURL != nil {
+		if err := validateAvatarURL(*payload.AvatarURL); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		set["avatar_url"] = *payload.AvatarURL
+	}
+	if payload.Addresses != nil {
+		addrs, err := normalizeAddresses(*payload.Addresses)
+		if err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		set["addresses"] = addrs
+	}
+
+	sensitive := payload.Username != nil || payload.Email != nil || payload.NewPassword != nil
+	if sensitive && user.PasswordHash == "" {
+		if payload.Username != nil || payload.Email != nil {
+			helpers.RespondError(w, http.StatusForbidden, "set a password first")
+			return
+		}
+	} else if sensitive {
+		// re-authentication shares the login's failure budget, or a stolen
+		// session could be used to guess the password
+		attempt := newLoginAttempt(r, user.Username)
+		if wait := attempt.lockedFor(ctx); wait > 0 {
+			respondLocked(w, wait)
+			return
+		}
+		if err := helpers.CheckPassword(user.PasswordHash, payload.CurrentPassword); err != nil {
+			attempt.recordFailure(ctx, user.ID, "wrong current password")
+			helpers.RespondError(w, http.StatusUnauthorized, "current_password is wrong")
+			return
+		}
+	}
+	if payload.Username != nil && *payload.Username != user.Username {
+		username := strings.TrimSpace(*payload.Username)
+		if username == "" {
+			helpers.RespondError(w, http.StatusBadRequest, "username required")
+			return
+		}
+		count, _ := database.UsersColl.CountDocuments(ctx, bson.M{"username": username})
+		if count > 0 {
+			helpers.RespondError(w, http.StatusBadRequest, "username already taken")
+			return
+		}
+		set["username"] = username
+	}
+	emailChanged := false
+	if payload.Email != nil {
+		email, err := normalizeEmail(*payload.Email)
+		if err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if email != user.Email {
+			count, _ := database.UsersColl.CountDocuments(ctx, bson.M{"email": email})
+			if count > 0 {
+				helpers.RespondError(w, http.StatusBadRequest, "email already registered")
+				return
+			}
+			set["email"] = email
+			set["email_verified"] = false
+			emailChanged = true
+		}
+	}
+	if payload.NewPassword != nil {
+		if err := validatePassword(*payload.NewPassword); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		hash, err := helpers.HashPassword(*payload.NewPassword)
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "could not hash password")
+			return
+		}
+		set["password_hash"] = hash
+	}
+
+	if len(set) == 0 {
+		helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"user": user})
+		return
+	}
+	set["updated_at"] = time.Now()
+	if _, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("Error updating user: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": user.ID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if payload.NewPassword != nil {
+		if err := middleware.RevokeOtherSessions(ctx, user.ID, principal.TokenID); err != nil {
+			log.Printf("Error revoking sessions after password change: %v", err)
+		}
+	}
+	if emailChanged {
+		if err := sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"user": user})
+}
+
+// DeleteMeHandler deletes the caller's account after re-checking the password
+// and, with 2FA enabled, a second factor. Accounts without a password have
+// to set one first.
+func DeleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if user.PasswordHash == "" {
+		helpers.RespondError(w, http.StatusForbidden, "set a password first")
+		return
+	}
+	attempt := newLoginAttempt(r, user.Username)
+	if wait := attempt.lockedFor(ctx); wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+	if err := helpers.CheckPassword(user.PasswordHash, payload.Password); err != nil {
+		attempt.recordFailure(ctx, user.ID, "wrong current password")
+		helpers.RespondError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	// as hard to do as turning 2FA off, see DisableTOTPHandler
+	if user.TOTPEnabled {
+		err := checkSecondFactor(ctx, user, payload.Code, payload.RecoveryCode)
+		if errors.Is(err, errInvalidSecondFactor) {
+			attempt.recordFailure(ctx, user.ID, "wrong second factor")
+			helpers.RespondError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+
+	if err := deleteAccount(ctx, user); err != nil {
+		log.Printf("Error deleting user %s: %v", user.ID.Hex(), err)
+		helpers.RespondError(w, http.StatusInternalServerError, "could not delete account")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "account deleted"})
+}
+
+// deleteAccount removes the user and everything that belongs to them.
+// Security logs are kept but no longer point at the person.
+func deleteAccount(ctx context.Context, user models.User) error {
+	if err := middleware.RevokeUserSessions(ctx, user.ID); err != nil {
+		return err
+	}
+	if _, err := database.InteractionsColl.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	if _, err := database.RefreshTokensColl.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	if _, err := database.EmailTokensColl.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	if err := anonymizeOrders(ctx, user.ID); err != nil {
+		return err
+	}
+	if _, err := database.CartsColl.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	if _, err := database.APIKeysColl.DeleteMany(ctx, bson.M{"user_id": user.ID}); err != nil {
+		return err
+	}
+	// the store's listings may still be in open orders, so it is only closed
+	_, err := database.SellersColl.UpdateOne(ctx, bson.M{"user_id": user.ID}, bson.M{"$set": bson.M{
+		"status": models.SellerStatusSuspended, "status_reason": "account deleted", "updated_at": time.Now(),
+	}})
+	if err != nil {
+		return err
+	}
+	if err := syncStoreListing(ctx, user.ID); err != nil {
+		return err
+	}
+	attempt := loginAttempt{username: strings.ToLower(user.Username)}
+	if _, err := database.LoginThrottleColl.DeleteOne(ctx, bson.M{"_id": attempt.accountKey()}); err != nil {
+		return err
+	}
+	_, err = database.LoginEventsColl.UpdateMany(ctx,
+		bson.M{"user_id": user.ID},
+		bson.M{"$unset": bson.M{"user_id": "", "user_agent": ""}, "$set": bson.M{"username": ""}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = database.UsersColl.DeleteOne(ctx, bson.M{"_id": user.ID})
+	return err
+}
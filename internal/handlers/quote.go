@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// shippingError is a reason an order cannot be shipped that can be shown
+// to the buyer.
+type shippingError string
+
+func (e shippingError) Error() string { return string(e) }
+
+type shippingOption struct {
+	ID      bson.ObjectID `json:"id"`
+	Name    string        `json:"name"`
+	Price   money.Money   `json:"price"`
+	MinDays int           `json:"min_days,omitempty"`
+	MaxDays int           `json:"max_days,omitempty"`
+}
+
+// orderQuote breaks down what an order of the cart lines costs delivered
+// to an address. lineTax is keyed by cart item id. method is nil when the
+// store has no shipping methods set up, which ships for free.
+type orderQuote struct {
+	subtotal    money.Money
+	discount    money.Money
+	shipping    money.Money
+	tax         money.Money
+	total       money.Money
+	weightGrams int
+	method      *shippingOption
+	options     []shippingOption
+	lineTax     map[bson.ObjectID]money.Money
+}
+
+// quoteOrder prices the lines for delivery to addr with the shipping
+// method methodID, or the cheapest one if zero. Tax is worked out per line
+// on the discounted line total. Reasons the order cannot ship are
+// shippingErrors.
+func quoteOrder(ctx context.Context, lines []cartLine, coupon *couponResult, addr models.Address, methodID bson.ObjectID) (*orderQuote, error) {
+	q := &orderQuote{
+		subtotal: money.Zero(money.Default),
+		discount: money.Zero(money.Default),
+		shipping: money.Zero(money.Default),
+		tax:      money.Zero(money.Default),
+		lineTax:  map[bson.ObjectID]money.Money{},
+	}
+	var priced []cartLine
+	for _, l := range lines {
+		if l.product == nil || l.status == "out_of_stock" {
+			continue
+		}
+		priced = append(priced, l)
+		q.subtotal = q.subtotal.Add(l.price.Mul(l.item.Quantity))
+		q.weightGrams += l.product.UnitWeight(l.variant) * l.item.Quantity
+	}
+	if coupon != nil {
+		q.discount = coupon.discount
+	}
+	value := q.subtotal.Sub(q.discount)
+
+	methods, err := activeShippingMethods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range methods {
+		if !shipsTo(m, addr) || !shippingInCurrency(m, money.Default) {
+			continue
+		}
+		price, ok := shippingPrice(m, q.weightGrams, value)
+		if !ok {
+			continue
+		}
+		if coupon != nil && coupon.freeShipping {
+			price = money.Zero(money.Default)
+		}
+		q.options = append(q.options, shippingOption{ID: m.ID, Name: m.Name, Price: price, MinDays: m.MinDays, MaxDays: m.MaxDays})
+	}
+	sort.SliceStable(q.options, func(i, j int) bool { return q.options[i].Price.Less(q.options[j].Price) })
+	if len(methods) > 0 {
+		if len(q.options) == 0 {
+			return nil, shippingError("no shipping method delivers this order to that address")
+		}
+		q.method = &q.options[0]
+		if !methodID.IsZero() {
+			q.method = nil
+			for i := range q.options {
+				if q.options[i].ID == methodID {
+					q.method = &q.options[i]
+				}
+			}
+			if q.method == nil {
+				return nil, shippingError("shipping method is not available for this order")
+			}
+		}
+		q.shipping = q.method.Price
+	}
+
+	rules, err := taxRulesFor(ctx, addr.Country)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range priced {
+		rule := matchTaxRule(rules, addr.Region, l.product.Category)
+		if rule == nil {
+			continue
+		}
+		taxable := l.price.Mul(l.item.Quantity)
+		if coupon != nil {
+			taxable = taxable.Sub(coupon.lineDiscounts[l.item.ID])
+		}
+		tax := taxable.Percent(rule.Rate)
+		q.lineTax[l.item.ID] = tax
+		q.tax = q.tax.Add(tax)
+	}
+	if rule := shippingTaxRule(rules, addr.Region); rule != nil {
+		q.tax = q.tax.Add(q.shipping.Percent(rule.Rate))
+	}
+
+	q.total = value.Add(q.shipping).Add(q.tax)
+	return q, nil
+}
+
+// view renders the breakdown, with the amounts also in the display
+// currency cur.
+func (q *orderQuote) view(cur string) map[string]interface{} {
+	options := q.options
+	if options == nil {
+		options = []shippingOption{}
+	}
+	return map[string]interface{}{
+		"subtotal":         q.subtotal,
+		"discount":         q.discount,
+		"shipping":         q.shipping,
+		"tax":              q.tax,
+		"total":            q.total,
+		"weight_grams":     q.weightGrams,
+		"shipping_method":  q.method,
+		"shipping_options": options,
+		"display": displayAmounts(cur, map[string]money.Money{
+			"subtotal": q.subtotal,
+			"discount": q.discount,
+			"shipping": q.shipping,
+			"tax":      q.tax,
+			"total":    q.total,
+		}),
+	}
+}
+
+// quoteAddress reads an address to quote for. Only the country is needed,
+// with the region where rules depend on it, so buyers can see totals
+// before filling in the rest.
+func quoteAddress(a models.Address) (models.Address, error) {
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.Region = strings.TrimSpace(a.Region)
+	if len(a.Country) != 2 {
+		return a, errors.New("address country must be a two-letter ISO code")
+	}
+	return a, nil
+}
+
+// QuoteHandler prices the caller's cart delivered to an address: one of
+// the user's saved ones, or an inline one, which guests must give. Carts
+// that cannot ship there answer 422 with the reason.
+func QuoteHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		AddressID        string          `json:"address_id"`
+		Address          *models.Address `json:"address"`
+		ShippingMethodID string          `json:"shipping_method_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	var methodID bson.ObjectID
+	if payload.ShippingMethodID != "" {
+		var err error
+		if methodID, err = bson.ObjectIDFromHex(payload.ShippingMethodID); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid shipping method id")
+			return
+		}
+	}
+	cur, err := displayCurrency(r)
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	owner, _, ok := resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var addr models.Address
+	switch {
+	case payload.Address != nil:
+		addr, err = quoteAddress(*payload.Address)
+	case !owner.userID.IsZero():
+		var user models.User
+		if err := database.UsersColl.FindOne(ctx, bson.M{"_id": owner.userID}).Decode(&user); err != nil {
+			helpers.RespondError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		addr, err = checkoutAddress(user, payload.AddressID, nil)
+	default:
+		err = errors.New("shipping address required")
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	cart, err := loadCart(ctx, owner)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if len(cart.Items) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "cart is empty")
+		return
+	}
+	lines, err := validateCart(ctx, cart)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	valid := true
+	for _, l := range lines {
+		if l.status != "ok" {
+			valid = false
+		}
+	}
+
+	// a coupon that stopped applying is left out, with its reason
+	var coupon *couponResult
+	var couponView map[string]interface{}
+	if cart.CouponCode != "" {
+		couponView = map[string]interface{}{"code": cart.CouponCode, "valid": false}
+		c, err := findCoupon(ctx, cart.CouponCode)
+		if err == nil {
+			coupon, err = evaluateCoupon(ctx, c, owner.userID, lines)
+		}
+		var reason couponError
+		switch {
+		case errors.As(err, &reason):
+			couponView["reason"] = reason.Error()
+		case err != nil:
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		default:
+			couponView["valid"] = true
+			couponView["free_shipping"] = coupon.freeShipping
+		}
+	}
+
+	q, err := quoteOrder(ctx, lines, coupon, addr, methodID)
+	var reason shippingError
+	if errors.As(err, &reason) {
+		helpers.RespondError(w, http.StatusUnprocessableEntity, reason.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	resp := q.view(cur)
+	resp["valid"] = valid
+	resp["country"] = addr.Country
+	if addr.Region != "" {
+		resp["region"] = addr.Region
+	}
+	if couponView != nil {
+		resp["coupon"] = couponView
+	}
+	helpers.RespondJSON(w, http.StatusOK, resp)
+}
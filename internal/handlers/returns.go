@@ -0,0 +1,515 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	returnWindow          = 30 * 24 * time.Hour
+	maxReturnPhotos       = 5
+	maxReturnCommentLen   = 2000
+	returnInteractionType = "return"
+)
+
+// returnTransitions lists, per target status, the statuses a return may
+// move there from. Goods that fail inspection are rejected after receipt.
+var returnTransitions = map[string][]string{
+	models.ReturnStatusApproved: {models.ReturnStatusRequested},
+	models.ReturnStatusRejected: {models.ReturnStatusRequested, models.ReturnStatusReceived},
+	models.ReturnStatusReceived: {models.ReturnStatusApproved},
+	models.ReturnStatusRefunded: {models.ReturnStatusReceived},
+}
+
+var (
+	errInvalidReturnTransition = errors.New("return is not in a state that allows this")
+	errReturnChanged           = errors.New("return changed, retry")
+	errReturnQuantity          = errors.New("more units than are left to return")
+)
+
+func respondReturnError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidReturnTransition), errors.Is(err, errReturnChanged):
+		helpers.RespondError(w, http.StatusConflict, err.Error())
+	default:
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+	}
+}
+
+func findOrderItem(o models.Order, productID, variantID bson.ObjectID) *models.OrderItem {
+	for i := range o.Items {
+		if o.Items[i].ProductID == productID && o.Items[i].VariantID == variantID {
+			return &o.Items[i]
+		}
+	}
+	return nil
+}
+
+// itemRefund is what the buyer paid for qty units of the line.
+func itemRefund(it models.OrderItem, qty int) money.Money {
+	paid := it.LineTotal.Sub(it.Discount).Add(it.Tax)
+	return money.New(paid.Amount*int64(qty)/int64(it.Quantity), paid.Currency)
+}
+
+// holdReturnQuantity counts qty units of the line as being returned, unless
+// that would return more than was ordered.
+func holdReturnQuantity(ctx context.Context, orderID bson.ObjectID, it models.OrderItem, qty int) error {
+	match := bson.M{
+		"product_id": it.ProductID,
+		"returned":   bson.M{"$not": bson.M{"$gt": it.Quantity - qty}},
+	}
+	if !it.VariantID.IsZero() {
+		match["variant_id"] = it.VariantID
+	}
+	res, err := database.OrdersColl.UpdateOne(ctx,
+		bson.M{"_id": orderID, "items": bson.M{"$elemMatch": match}},
+		bson.M{"$inc": bson.M{"items.$.returned": qty}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errReturnQuantity
+	}
+	return nil
+}
+
+// releaseReturnQuantities undoes holdReturnQuantity for the items.
+func releaseReturnQuantities(ctx context.Context, orderID bson.ObjectID, items []models.ReturnItem) {
+	for _, it := range items {
+		match := bson.M{"product_id": it.ProductID}
+		if !it.VariantID.IsZero() {
+			match["variant_id"] = it.VariantID
+		}
+		_, err := database.OrdersColl.UpdateOne(ctx,
+			bson.M{"_id": orderID, "items": bson.M{"$elemMatch": match}},
+			bson.M{"$inc": bson.M{"items.$.returned": -it.Quantity}})
+		if err != nil {
+			log.Printf("Error releasing returned quantity of order %s: %v", orderID.Hex(), err)
+		}
+	}
+}
+
+// setReturnStatus moves the return to status if the transition is allowed
+// and nobody moved it first, then applies the side effects: rejected units
+// can be returned again, refunded ones go back on sale and count against
+// the product in recommendations.
+func setReturnStatus(ctx context.Context, ret models.ReturnRequest, status string, by bson.ObjectID, note string) (models.ReturnRequest, error) {
+	if !slices.Contains(returnTransitions[status], ret.Status) {
+		return ret, errInvalidReturnTransition
+	}
+	now := time.Now()
+	set := bson.M{"status": status, "updated_at": now}
+	if status == models.ReturnStatusRefunded {
+		set["refunded_at"] = now
+	}
+	change := models.OrderStatusChange{Status: status, By: by, Note: strings.TrimSpace(note), At: now}
+	err := database.ReturnsColl.FindOneAndUpdate(ctx,
+		bson.M{"_id": ret.ID, "status": ret.Status},
+		bson.M{"$set": set, "$push": bson.M{"status_history": change}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ret)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ret, errReturnChanged
+	}
+	if err != nil {
+		return ret, err
+	}
+
+	// as with orders, the status stands even if a side effect fails
+	switch status {
+	case models.ReturnStatusRejected:
+		releaseReturnQuantities(ctx, ret.OrderID, ret.Items)
+	case models.ReturnStatusRefunded:
+		for _, it := range ret.Items {
+			if err := restock(ctx, it.ProductID, it.VariantID, it.Quantity); err != nil {
+				log.Printf("Error restocking return %s: %v", ret.ID.Hex(), err)
+			}
+		}
+		if err := bookReturn(ctx, ret); err != nil {
+			log.Printf("Error booking refund of return %s, left to reconciliation: %v", ret.ID.Hex(), err)
+		}
+		if !ret.UserID.IsZero() {
+			if err := recordReturns(ctx, ret); err != nil {
+				log.Printf("Error recording return %s for recommendations: %v", ret.ID.Hex(), err)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// recordReturns writes the interactions recommendations count against the
+// returned products.
+func recordReturns(ctx context.Context, ret models.ReturnRequest) error {
+	docs := make([]interface{}, 0, len(ret.Items))
+	for _, it := range ret.Items {
+		docs = append(docs, models.Interaction{
+			UserID:     ret.UserID,
+			ProductID:  it.ProductID,
+			VariantID:  it.VariantID,
+			ActionType: returnInteractionType,
+			Timestamp:  time.Now(),
+		})
+	}
+	_, err := database.InteractionsColl.InsertMany(ctx, docs)
+	return err
+}
+
+// CreateReturnHandler asks to return lines of one of the caller's delivered
+// orders, within returnWindow of delivery. Items must all come from one
+// store.
+func CreateReturnHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Items []struct {
+			ProductID string `json:"product_id"`
+			VariantID string `json:"variant_id"`
+			Quantity  int    `json:"quantity"`
+		} `json:"items"`
+		Reason  string   `json:"reason"`
+		Comment string   `json:"comment"`
+		Photos  []string `json:"photos"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if !slices.Contains(models.ReturnReasons, payload.Reason) {
+		helpers.RespondError(w, http.StatusBadRequest, "reason must be one of "+strings.Join(models.ReturnReasons, ", "))
+		return
+	}
+	payload.Comment = strings.TrimSpace(payload.Comment)
+	if len(payload.Comment) > maxReturnCommentLen {
+		helpers.RespondError(w, http.StatusBadRequest, "comment too long")
+		return
+	}
+	if len(payload.Photos) > maxReturnPhotos {
+		helpers.RespondError(w, http.StatusBadRequest, "too many photos")
+		return
+	}
+	for _, u := range payload.Photos {
+		if !isImageURL(u) {
+			helpers.RespondError(w, http.StatusBadRequest, "photos must be http(s) URLs")
+			return
+		}
+	}
+	if len(payload.Items) == 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "items required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	o, principal, ok := myOrder(ctx, w, r)
+	if !ok {
+		return
+	}
+	if o.UserID != principal.UserID {
+		helpers.RespondError(w, http.StatusNotFound, "order not found")
+		return
+	}
+	if o.Status != models.OrderStatusDelivered || o.DeliveredAt == nil {
+		helpers.RespondError(w, http.StatusConflict, "only delivered orders can be returned")
+		return
+	}
+	if time.Since(*o.DeliveredAt) > returnWindow {
+		helpers.RespondError(w, http.StatusConflict, "the return window for this order has closed")
+		return
+	}
+
+	now := time.Now()
+	ret := models.ReturnRequest{
+		OrderID:       o.ID,
+		UserID:        o.UserID,
+		Reason:        payload.Reason,
+		Comment:       payload.Comment,
+		Photos:        payload.Photos,
+		Status:        models.ReturnStatusRequested,
+		StatusHistory: []models.OrderStatusChange{{Status: models.ReturnStatusRequested, By: principal.UserID, At: now}},
+		RefundAmount:  money.Zero(o.Currency),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	for i, in := range payload.Items {
+		pid, err := bson.ObjectIDFromHex(in.ProductID)
+		if err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "invalid product id")
+			return
+		}
+		var vid bson.ObjectID
+		if in.VariantID != "" {
+			if vid, err = bson.ObjectIDFromHex(in.VariantID); err != nil {
+				helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+				return
+			}
+		}
+		it := findOrderItem(o, pid, vid)
+		if it == nil {
+			helpers.RespondError(w, http.StatusBadRequest, "item is not part of the order")
+			return
+		}
+		if in.Quantity <= 0 || in.Quantity > it.Quantity-it.Returned {
+			helpers.RespondError(w, http.StatusBadRequest, it.Name+": "+errReturnQuantity.Error())
+			return
+		}
+		if slices.ContainsFunc(ret.Items, func(x models.ReturnItem) bool { return x.ProductID == pid && x.VariantID == vid }) {
+			helpers.RespondError(w, http.StatusBadRequest, "each item may be listed once")
+			return
+		}
+		if i == 0 {
+			ret.SellerID = it.SellerID
+		} else if it.SellerID != ret.SellerID {
+			helpers.RespondError(w, http.StatusBadRequest, "return items from one store at a time")
+			return
+		}
+		refund := itemRefund(*it, in.Quantity)
+		ret.Items = append(ret.Items, models.ReturnItem{ProductID: pid, VariantID: vid, Name: it.Name, Quantity: in.Quantity, Refund: refund})
+		ret.RefundAmount = ret.RefundAmount.Add(refund)
+	}
+
+	// hold the quantities line by line, handing back what we got if one
+	// line was taken by a concurrent request
+	for i, it := range ret.Items {
+		if err := holdReturnQuantity(ctx, o.ID, *findOrderItem(o, it.ProductID, it.VariantID), it.Quantity); err != nil {
+			releaseReturnQuantities(ctx, o.ID, ret.Items[:i])
+			if errors.Is(err, errReturnQuantity) {
+				helpers.RespondError(w, http.StatusConflict, it.Name+": "+err.Error())
+				return
+			}
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+	}
+	res, err := database.ReturnsColl.InsertOne(ctx, ret)
+	if err != nil {
+		releaseReturnQuantities(ctx, o.ID, ret.Items)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	ret.ID = res.InsertedID.(bson.ObjectID)
+	helpers.RespondJSON(w, http.StatusCreated, ret)
+}
+
+// listReturns answers a paginated return listing for filter, newest first,
+// optionally narrowed by ?status=.
+func listReturns(w http.ResponseWriter, r *http.Request, filter bson.M) {
+	page, limit, skip := helpers.Pagination(r, 20, 100)
+	if s := r.URL.Query().Get("status"); s != "" {
+		filter["status"] = s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := database.ReturnsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.ReturnsColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.ReturnRequest{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func ListMyReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	listReturns(w, r, bson.M{"user_id": principal.UserID})
+}
+
+func SellerReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	listReturns(w, r, bson.M{"seller_id": s.ID})
+}
+
+func AdminListReturnsHandler(w http.ResponseWriter, r *http.Request) {
+	listReturns(w, r, bson.M{})
+}
+
+// GetReturnHandler shows one of the caller's returns, or any to admins.
+func GetReturnHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var ret models.ReturnRequest
+	err = database.ReturnsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&ret)
+	if err != nil || (ret.UserID != principal.UserID && !principal.HasRole(models.RoleAdmin)) {
+		helpers.RespondError(w, http.StatusNotFound, "return not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, ret)
+}
+
+// updateReturnStatus reads the new status from the request and applies it.
+// A refund goes through the payment provider first; it is keyed on the
+// return, so retrying after a failed status update does not pay twice.
+// Orders without a payment through the provider can only be refunded by an
+// admin who confirms with manual_refund that the money went back some other
+// way.
+func updateReturnStatus(ctx context.Context, w http.ResponseWriter, r *http.Request, ret models.ReturnRequest, by bson.ObjectID, admin bool) {
+	var payload struct {
+		Status       string `json:"status"`
+		Note         string `json:"note"`
+		ManualRefund bool   `json:"manual_refund"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if _, ok := returnTransitions[payload.Status]; !ok {
+		helpers.RespondError(w, http.StatusBadRequest, "status must be approved, rejected, received or refunded")
+		return
+	}
+
+	if payload.Status == models.ReturnStatusRefunded && slices.Contains(returnTransitions[payload.Status], ret.Status) {
+		var o models.Order
+		if err := database.OrdersColl.FindOne(ctx, bson.M{"_id": ret.OrderID}).Decode(&o); err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "db error")
+			return
+		}
+		err := refundOrderPayment(ctx, o, ret.RefundAmount.Amount, "return:"+ret.ID.Hex())
+		switch {
+		case errors.Is(err, errNoPayment):
+			if !admin || !payload.ManualRefund {
+				helpers.RespondError(w, http.StatusConflict, "the order has no payment to refund; an admin must refund it by hand and confirm with manual_refund")
+				return
+			}
+			if strings.TrimSpace(payload.Note) == "" {
+				payload.Note = "refunded manually"
+			}
+		case err != nil:
+			log.Printf("Error refunding return %s: %v", ret.ID.Hex(), err)
+			helpers.RespondError(w, http.StatusBadGateway, "refund failed")
+			return
+		}
+	}
+	ret, err := setReturnStatus(ctx, ret, payload.Status, by, payload.Note)
+	if err != nil {
+		respondReturnError(w, err)
+		return
+	}
+	if ret.Status == models.ReturnStatusRefunded {
+		refundReturnedOrder(ctx, ret.OrderID, by)
+	}
+	helpers.RespondJSON(w, http.StatusOK, ret)
+}
+
+// refundReturnedOrder marks an order refunded once every unit of it came
+// back and was refunded. What the returns left of the payment, such as
+// shipping, goes back to the buyer too. A failure is logged; an admin can
+// still refund the order directly.
+func refundReturnedOrder(ctx context.Context, orderID, by bson.ObjectID) {
+	var o models.Order
+	if err := database.OrdersColl.FindOne(ctx, bson.M{"_id": orderID}).Decode(&o); err != nil {
+		log.Printf("Error loading order %s after a return: %v", orderID.Hex(), err)
+		return
+	}
+	for _, it := range o.Items {
+		if it.Returned < it.Quantity {
+			return
+		}
+	}
+	open, err := database.ReturnsColl.CountDocuments(ctx, bson.M{
+		"order_id": orderID,
+		"status":   bson.M{"$in": bson.A{models.ReturnStatusRequested, models.ReturnStatusApproved, models.ReturnStatusReceived}},
+	})
+	if err != nil || open > 0 {
+		if err != nil {
+			log.Printf("Error checking returns of order %s: %v", orderID.Hex(), err)
+		}
+		return
+	}
+	if err := refundOrderPayment(ctx, o, 0, "order-refund:"+o.ID.Hex()); err != nil && !errors.Is(err, errNoPayment) {
+		log.Printf("Error refunding the rest of returned order %s: %v", o.ID.Hex(), err)
+		return
+	}
+	if _, err := setOrderStatus(ctx, o, models.OrderStatusRefunded, by, "all items returned", nil); err != nil && !errors.Is(err, errOrderChanged) {
+		log.Printf("Error marking returned order %s refunded: %v", o.ID.Hex(), err)
+	}
+}
+
+// SellerUpdateReturnHandler moves a return of the caller's store along.
+func SellerUpdateReturnHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	s, ok := sellerFor(ctx, w, r)
+	if !ok {
+		return
+	}
+	var ret models.ReturnRequest
+	if err := database.ReturnsColl.FindOne(ctx, bson.M{"_id": id, "seller_id": s.ID}).Decode(&ret); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "return not found")
+		return
+	}
+	updateReturnStatus(ctx, w, r, ret, s.UserID, false)
+}
+
+func AdminUpdateReturnHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	var ret models.ReturnRequest
+	if err := database.ReturnsColl.FindOne(ctx, bson.M{"_id": id}).Decode(&ret); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "return not found")
+		return
+	}
+	updateReturnStatus(ctx, w, r, ret, principal.UserID, true)
+}
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	maxStoreNameLen   = 80
+	maxStoreDescLen   = 2000
+	minSlugLen        = 3
+	maxSlugLen        = 64
+	storefrontPerPage = 24
+)
+
+var (
+	slugPattern  = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	slugCleaner  = regexp.MustCompile(`[^a-z0-9]+`)
+	reservedSlug = map[string]bool{"me": true, "apply": true, "admin": true}
+)
+
+func slugify(s string) string {
+	return strings.Trim(slugCleaner.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func validateSlug(slug string) error {
+	if len(slug) < minSlugLen || len(slug) > maxSlugLen || !slugPattern.MatchString(slug) || reservedSlug[slug] {
+		return errors.New("slug must be 3-64 lowercase letters, digits and dashes")
+	}
+	return nil
+}
+
+// approvedSellerFor returns the approved store of the user, if any.
+func approvedSellerFor(ctx context.Context, userID bson.ObjectID) (*models.Seller, error) {
+	var s models.Seller
+	err := database.SellersColl.FindOne(ctx, bson.M{"user_id": userID, "status": models.SellerStatusApproved}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ApplySellerHandler opens a store application for the caller. Rejected
+// applicants may apply again.
+func ApplySellerHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		StoreName   string `json:"store_name"`
+		Slug        string `json:"slug"`
+		Description string `json:"description"`
+		LogoURL     string `json:"logo_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	name := strings.TrimSpace(payload.StoreName)
+	if name == "" || len(name) > maxStoreNameLen {
+		helpers.RespondError(w, http.StatusBadRequest, "store_name must be 1-80 characters")
+		return
+	}
+	if len(payload.Description) > maxStoreDescLen {
+		helpers.RespondError(w, http.StatusBadRequest, "description too long")
+		return
+	}
+	if err := validateAvatarURL(payload.LogoURL); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "logo_url must be an http(s) URL")
+		return
+	}
+	slug := strings.TrimSpace(payload.Slug)
+	if slug == "" {
+		slug = slugify(name)
+	}
+	if err := validateSlug(slug); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var existing models.Seller
+	err := database.SellersColl.FindOne(ctx, bson.M{"user_id": principal.UserID}).Decode(&existing)
+	if err == nil && existing.Status != models.SellerStatusRejected {
+		helpers.RespondError(w, http.StatusConflict, "you already have a store ("+existing.Status+")")
+		return
+	}
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	now := time.Now()
+	seller := models.Seller{
+		ID:          existing.ID,
+		UserID:      principal.UserID,
+		StoreName:   name,
+		Slug:        slug,
+		Description: strings.TrimSpace(payload.Description),
+		LogoURL:     payload.LogoURL,
+		Status:      models.SellerStatusPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if seller.ID.IsZero() {
+		seller.ID = bson.NewObjectID()
+	}
+	_, err = database.SellersColl.ReplaceOne(ctx, bson.M{"_id": seller.ID}, seller, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "slug already taken")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating seller application: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusCreated, seller)
+}
+
+func MySellerHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var s models.Seller
+	if err := database.SellersColl.FindOne(ctx, bson.M{"user_id": principal.UserID}).Decode(&s); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "no store")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, s)
+}
+
+// UpdateMySellerHandler edits the store profile. The slug is permanent so
+// storefront links keep working.
+func UpdateMySellerHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		StoreName   *string `json:"store_name"`
+		Description *string `json:"description"`
+		LogoURL     *string `json:"logo_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	set := bson.M{"updated_at": time.Now()}
+	if payload.StoreName != nil {
+		name := strings.TrimSpace(*payload.StoreName)
+		if name == "" || len(name) > maxStoreNameLen {
+			helpers.RespondError(w, http.StatusBadRequest, "store_name must be 1-80 characters")
+			return
+		}
+		set["store_name"] = name
+	}
+	if payload.Description != nil {
+		if len(*payload.Description) > maxStoreDescLen {
+			helpers.RespondError(w, http.StatusBadRequest, "description too long")
+			return
+		}
+		set["description"] = strings.TrimSpace(*payload.Description)
+	}
+	if payload.LogoURL != nil {
+		if err := validateAvatarURL(*payload.LogoURL); err != nil {
+			helpers.RespondError(w, http.StatusBadRequest, "logo_url must be an http(s) URL")
+			return
+		}
+		set["logo_url"] = *payload.LogoURL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var s models.Seller
+	err := database.SellersColl.FindOneAndUpdate(ctx, bson.M{"user_id": principal.UserID}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusNotFound, "no store")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, s)
+}
+
+// storefront loads the approved store named by {slug}.
+func storefront(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Seller, bool) {
+	var s models.Seller
+	err := database.SellersColl.FindOne(ctx, bson.M{"slug": mux.Vars(r)["slug"], "status": models.SellerStatusApproved}).Decode(&s)
+	if err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "store not found")
+		return s, false
+	}
+	return s, true
+}
+
+func SellerStorefrontHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, ok := storefront(ctx, w, r)
+	if !ok {
+		return
+	}
+	count, _ := database.ProductsColl.CountDocuments(ctx, listedFilter(bson.M{"seller_id": s.ID}))
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"seller":        s,
+		"product_count": count,
+	})
+}
+
+func SellerProductsHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit, skip := helpers.Pagination(r, storefrontPerPage, 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, ok := storefront(ctx, w, r)
+	if !ok {
+		return
+	}
+	filter := listedFilter(addInStockFilter(r, bson.M{"seller_id": s.ID}))
+	total, err := database.ProductsColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.ProductsColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Product{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+func AdminListSellersHandler(w http.ResponseWriter, r *http.Request) {
+	page, limit, skip := helpers.Pagination(r, 50, 200)
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	total, err := database.SellersColl.CountDocuments(ctx, filter)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	cursor, err := database.SellersColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.Seller{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"items": items,
+		"total": total,
+		"page":  page,
+	})
+}
+
+// sellerTransitions lists which statuses an admin may move a store from.
+var sellerTransitions = map[string][]string{
+	models.SellerStatusApproved:  {models.SellerStatusPending, models.SellerStatusSuspended},
+	models.SellerStatusRejected:  {models.SellerStatusPending},
+	models.SellerStatusSuspended: {models.SellerStatusApproved},
+}
+
+// setSellerStatus moves a store to status and keeps the owner's seller role
+// in sync: only owners of approved stores hold it.
+func setSellerStatus(w http.ResponseWriter, r *http.Request, status string) {
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&payload)
+
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	set := bson.M{"status": status, "status_reason": strings.TrimSpace(payload.Reason), "updated_at": now}
+	if status == models.SellerStatusApproved {
+		set["approved_at"] = now
+	}
+	var s models.Seller
+	err = database.SellersColl.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "status": bson.M{"$in": sellerTransitions[status]}},
+		bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusConflict, "store not found or not in a state that allows this")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	if err := syncSellerRole(ctx, s.UserID, status == models.SellerStatusApproved); err != nil {
+		log.Printf("Error updating seller role: %v", err)
+	}
+	if err := syncStoreListing(ctx, s.UserID); err != nil {
+		log.Printf("Error updating listing of store %s: %v", s.ID.Hex(), err)
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, s)
+}
+
+func AdminApproveSellerHandler(w http.ResponseWriter, r *http.Request) {
+	setSellerStatus(w, r, models.SellerStatusApproved)
+}
+
+func AdminRejectSellerHandler(w http.ResponseWriter, r *http.Request) {
+	setSellerStatus(w, r, models.SellerStatusRejected)
+}
+
+func AdminSuspendSellerHandler(w http.ResponseWriter, r *http.Request) {
+	setSellerStatus(w, r, models.SellerStatusSuspended)
+}
+
+func syncSellerRole(ctx context.Context, userID bson.ObjectID, grant bool) error {
+	if !grant {
+		_, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$pull": bson.M{"roles": models.RoleSeller}})
+		return err
+	}
+	// accounts without stored roles are implicit buyers, make that explicit
+	// before adding to the list
+	_, err := database.UsersColl.UpdateOne(ctx,
+		bson.M{"_id": userID, "roles": bson.M{"$in": bson.A{nil, bson.A{}}}},
+		bson.M{"$set": bson.M{"roles": bson.A{models.RoleBuyer}}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = database.UsersColl.UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$addToSet": bson.M{"roles": models.RoleSeller}})
+	return err
+}
+
+// syncStoreListing hides the products of the store owned by userID unless
+// the store is approved and its owner is not suspended, and lists them
+// again otherwise. Users without a store are left alone.
+func syncStoreListing(ctx context.Context, userID bson.ObjectID) error {
+	var s models.Seller
+	err := database.SellersColl.FindOne(ctx, bson.M{"user_id": userID}).Decode(&s)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var owner models.User
+	err = database.UsersColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&owner)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	listed := err == nil && !owner.IsSuspended() && s.Status == models.SellerStatusApproved
+
+	update := bson.M{"$set": bson.M{"hidden": true}}
+	if listed {
+		update = bson.M{"$unset": bson.M{"hidden": ""}}
+	}
+	_, err = database.ProductsColl.UpdateMany(ctx, bson.M{"seller_id": s.ID}, update)
+	return err
+}
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// shipsTo reports whether the method's zone covers the address.
+func shipsTo(m models.ShippingMethod, addr models.Address) bool {
+	if len(m.Countries) > 0 && !slices.Contains(m.Countries, strings.ToUpper(addr.Country)) {
+		return false
+	}
+	if len(m.Regions) > 0 && !slices.ContainsFunc(m.Regions, func(r string) bool { return strings.EqualFold(r, addr.Region) }) {
+		return false
+	}
+	return true
+}
+
+// shippingPrice prices a parcel of weight grams for an order worth value.
+// ok is false when none of the method's rates covers the parcel.
+func shippingPrice(m models.ShippingMethod, grams int, value money.Money) (price money.Money, ok bool) {
+	if !m.FreeOver.IsZero() && !value.Less(m.FreeOver) {
+		return money.Zero(value.Currency), true
+	}
+	for _, rate := range m.Rates {
+		if grams < rate.MinWeightGrams || (rate.MaxWeightGrams > 0 && grams > rate.MaxWeightGrams) {
+			continue
+		}
+		if value.Less(rate.MinOrderValue) {
+			continue
+		}
+		if !ok || rate.Price.Less(price) {
+			price, ok = rate.Price, true
+		}
+	}
+	return price, ok
+}
+
+// shippingInCurrency reports whether all of the method's amounts are in
+// currency; methods set up under another store currency are not offered.
+func shippingInCurrency(m models.ShippingMethod, currency string) bool {
+	amounts := []money.Money{m.FreeOver}
+	for _, rate := range m.Rates {
+		amounts = append(amounts, rate.Price, rate.MinOrderValue)
+	}
+	return money.Check(currency, amounts...) == nil
+}
+
+func activeShippingMethods(ctx context.Context) ([]models.ShippingMethod, error) {
+	cursor, err := database.ShippingColl.Find(ctx, bson.M{"active": true}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var methods []models.ShippingMethod
+	err = cursor.All(ctx, &methods)
+	return methods, err
+}
+
+// shippingMethodInput holds the editable fields of a shipping method; nil
+// means unchanged. Rates are replaced as a whole.
+type shippingMethodInput struct {
+	Name      *string                `json:"name"`
+	Countries *[]string              `json:"countries"`
+	Regions   *[]string              `json:"regions"`
+	Rates     *[]models.ShippingRate `json:"rates"`
+	FreeOver  *money.Money           `json:"free_over"`
+	MinDays   *int                   `json:"min_days"`
+	MaxDays   *int                   `json:"max_days"`
+	Active    *bool                  `json:"active"`
+}
+
+func (in shippingMethodInput) apply(m *models.ShippingMethod) error {
+	if in.Name != nil {
+		m.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Countries != nil {
+		countries := []string{}
+		for _, c := range *in.Countries {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if len(c) != 2 {
+				return errors.New("countries must be two-letter ISO codes")
+			}
+			countries = append(countries, c)
+		}
+		m.Countries = countries
+	}
+	if in.Regions != nil {
+		regions := []string{}
+		for _, r := range *in.Regions {
+			if r = strings.TrimSpace(r); r != "" {
+				regions = append(regions, r)
+			}
+		}
+		m.Regions = regions
+	}
+	if in.Rates != nil {
+		m.Rates = *in.Rates
+	}
+	if in.FreeOver != nil {
+		m.FreeOver = *in.FreeOver
+	}
+	if in.MinDays != nil {
+		m.MinDays = *in.MinDays
+	}
+	if in.MaxDays != nil {
+		m.MaxDays = *in.MaxDays
+	}
+	if in.Active != nil {
+		m.Active = *in.Active
+	}
+
+	if m.Name == "" {
+		return errors.New("name required")
+	}
+	if len(m.Rates) == 0 {
+		return errors.New("at least one rate required")
+	}
+	for _, rate := range m.Rates {
+		if rate.MinWeightGrams < 0 || rate.MaxWeightGrams < 0 ||
+			(rate.MaxWeightGrams > 0 && rate.MaxWeightGrams < rate.MinWeightGrams) {
+			return errors.New("rate weights must be a non-negative range")
+		}
+		for _, a := range []money.Money{rate.Price, rate.MinOrderValue} {
+			if err := checkStoreAmount(a); err != nil {
+				return err
+			}
+		}
+	}
+	if err := checkStoreAmount(m.FreeOver); err != nil {
+		return err
+	}
+	if m.MinDays < 0 || m.MaxDays < 0 || (m.MaxDays > 0 && m.MaxDays < m.MinDays) {
+		return errors.New("min_days and max_days must be a non-negative range")
+	}
+	return nil
+}
+
+// ListShippingMethodsHandler lists the shipping methods, optionally only
+// those shipping to ?country= (and ?region=).
+func ListShippingMethodsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := database.ShippingColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.ShippingMethod{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	q := r.URL.Query()
+	if c := q.Get("country"); c != "" {
+		addr := models.Address{Country: c, Region: q.Get("region")}
+		items = slices.DeleteFunc(items, func(m models.ShippingMethod) bool { return !shipsTo(m, addr) })
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+func CreateShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	var in shippingMethodInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	now := time.Now()
+	m := models.ShippingMethod{Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := in.apply(&m); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.ShippingColl.InsertOne(ctx, m)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	m.ID = res.InsertedID.(bson.ObjectID)
+	helpers.RespondJSON(w, http.StatusCreated, m)
+}
+
+func UpdateShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in shippingMethodInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var m models.ShippingMethod
+	if err := database.ShippingColl.FindOne(ctx, bson.M{"_id": id}).Decode(&m); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "shipping method not found")
+		return
+	}
+	if err := in.apply(&m); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	m.UpdatedAt = time.Now()
+	if _, err := database.ShippingColl.ReplaceOne(ctx, bson.M{"_id": id}, m); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, m)
+}
+
+// DeleteShippingMethodHandler removes a method. Orders keep its name and
+// the price they were charged.
+func DeleteShippingMethodHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.ShippingColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		helpers.RespondError(w, http.StatusNotFound, "shipping method not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
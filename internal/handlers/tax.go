@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// taxRulesFor loads the active tax rules of a country.
+func taxRulesFor(ctx context.Context, country string) ([]models.TaxRule, error) {
+	cursor, err := database.TaxRulesColl.Find(ctx, bson.M{"country": strings.ToUpper(country), "active": true})
+	if err != nil {
+		return nil, err
+	}
+	var rules []models.TaxRule
+	err = cursor.All(ctx, &rules)
+	return rules, err
+}
+
+// matchTaxRule picks the most specific rule for an address region and a
+// product category: region and category, then region, then category, then
+// the country-wide rule. An empty category asks for a rule without one, as
+// for shipping.
+func matchTaxRule(rules []models.TaxRule, region, category string) *models.TaxRule {
+	var best *models.TaxRule
+	bestScore := -1
+	for i, rule := range rules {
+		score := 0
+		if rule.Region != "" {
+			if !strings.EqualFold(rule.Region, region) {
+				continue
+			}
+			score += 2
+		}
+		if rule.Category != "" {
+			if category == "" || !strings.EqualFold(rule.Category, category) {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = &rules[i], score
+		}
+	}
+	return best
+}
+
+// shippingTaxRule picks the rule that taxes shipping, if any. Shipping has
+// no category, so the most specific rule without one decides, by its
+// Shipping flag. Only where no such rule covers the region do rules for a
+// category count: the one with Shipping set and the highest rate, so a
+// region taxed only per category still taxes shipping when one of its
+// rules says so.
+func shippingTaxRule(rules []models.TaxRule, region string) *models.TaxRule {
+	if rule := matchTaxRule(rules, region, ""); rule != nil {
+		if !rule.Shipping {
+			return nil
+		}
+		return rule
+	}
+	var best *models.TaxRule
+	for i, rule := range rules {
+		if !rule.Shipping || (rule.Region != "" && !strings.EqualFold(rule.Region, region)) {
+			continue
+		}
+		if best == nil || rule.Rate > best.Rate {
+			best = &rules[i]
+		}
+	}
+	return best
+}
+
+// taxRuleInput holds the editable fields of a tax rule; nil means unchanged.
+type taxRuleInput struct {
+	Name     *string  `json:"name"`
+	Country  *string  `json:"country"`
+	Region   *string  `json:"region"`
+	Category *string  `json:"category"`
+	Rate     *float64 `json:"rate"`
+	Shipping *bool    `json:"shipping"`
+	Active   *bool    `json:"active"`
+}
+
+func (in taxRuleInput) apply(t *models.TaxRule) error {
+	if in.Name != nil {
+		t.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Country != nil {
+		t.Country = strings.ToUpper(strings.TrimSpace(*in.Country))
+	}
+	if in.Region != nil {
+		t.Region = strings.TrimSpace(*in.Region)
+	}
+	if in.Category != nil {
+		t.Category = strings.TrimSpace(*in.Category)
+	}
+	if in.Rate != nil {
+		t.Rate = *in.Rate
+	}
+	if in.Shipping != nil {
+		t.Shipping = *in.Shipping
+	}
+	if in.Active != nil {
+		t.Active = *in.Active
+	}
+
+	if len(t.Country) != 2 {
+		return errors.New("country must be a two-letter ISO code")
+	}
+	if t.Rate < 0 || t.Rate > 100 {
+		return errors.New("rate must be a percentage in [0, 100]")
+	}
+	if t.Shipping && t.Category != "" {
+		return errors.New("only rules without a category can tax shipping")
+	}
+	if t.Name == "" {
+		t.Name = t.Country
+		if t.Region != "" {
+			t.Name += " " + t.Region
+		}
+	}
+	return nil
+}
+
+func ListTaxRulesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if c := r.URL.Query().Get("country"); c != "" {
+		filter["country"] = strings.ToUpper(c)
+	}
+	cursor, err := database.TaxRulesColl.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "country", Value: 1}, {Key: "region", Value: 1}, {Key: "category", Value: 1}}))
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	items := []models.TaxRule{}
+	if err := cursor.All(ctx, &items); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+func CreateTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var in taxRuleInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if in.Country == nil || in.Rate == nil {
+		helpers.RespondError(w, http.StatusBadRequest, "country and rate required")
+		return
+	}
+	now := time.Now()
+	t := models.TaxRule{Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := in.apply(&t); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.TaxRulesColl.InsertOne(ctx, t)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	t.ID = res.InsertedID.(bson.ObjectID)
+	helpers.RespondJSON(w, http.StatusCreated, t)
+}
+
+func UpdateTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	var in taxRuleInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var t models.TaxRule
+	if err := database.TaxRulesColl.FindOne(ctx, bson.M{"_id": id}).Decode(&t); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "tax rule not found")
+		return
+	}
+	if err := in.apply(&t); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	t.UpdatedAt = time.Now()
+	if _, err := database.TaxRulesColl.ReplaceOne(ctx, bson.M{"_id": id}, t); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, t)
+}
+
+// DeleteTaxRuleHandler removes a rule. Orders keep the tax they were
+// charged.
+func DeleteTaxRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := database.TaxRulesColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	if res.DeletedCount == 0 {
+		helpers.RespondError(w, http.StatusNotFound, "tax rule not found")
+		return
+	}
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Login throttling: after accountFailureLimit failures for one username (or
+// ipFailureLimit for one address) the key is locked. The lock doubles with
+// every further failure, from baseLockout up to maxLockout. Failures older
+// than failureWindow are forgotten.
+const (
+	accountFailureLimit = 5
+	ipFailureLimit      = 20
+	baseLockout         = time.Minute
+	maxLockout          = time.Hour
+	failureWindow       = 15 * time.Minute
+)
+
+type loginAttempt struct {
+	username  string
+	ip        string
+	userAgent string
+	cartToken string // guest cart to merge once the login succeeds
+}
+
+func newLoginAttempt(r *http.Request, username string) loginAttempt {
+	return loginAttempt{
+		username:  strings.ToLower(strings.TrimSpace(username)),
+		ip:        helpers.ClientIP(r),
+		userAgent: r.UserAgent(),
+		cartToken: r.Header.Get(CartTokenHeader),
+	}
+}
+
+func (a loginAttempt) accountKey() string { return "user:" + a.username }
+func (a loginAttempt) ipKey() string      { return "ip:" + a.ip }
+
+// lockedFor returns how long the attempt still has to wait, or zero.
+func (a loginAttempt) lockedFor(ctx context.Context) time.Duration {
+	return lockedFor(ctx, a.accountKey(), a.ipKey())
+}
+
+// lockedFor returns how long the longest lock on any of the keys has left,
+// or zero.
+func lockedFor(ctx context.Context, keys ...string) time.Duration {
+	cursor, err := database.LoginThrottleColl.Find(ctx, bson.M{
+		"_id":          bson.M{"$in": keys},
+		"locked_until": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return 0
+	}
+	var locks []models.LoginThrottle
+	if err := cursor.All(ctx, &locks); err != nil {
+		return 0
+	}
+	var wait time.Duration
+	for _, l := range locks {
+		if d := time.Until(*l.LockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// recordFailure counts a failed attempt against both keys and reports
+// whether that locked either of them.
+func (a loginAttempt) recordFailure(ctx context.Context, userID bson.ObjectID, reason string) bool {
+	a.event(ctx, userID, models.LoginEventFailure, reason)
+
+	locked := false
+	for key, limit := range map[string]int{a.accountKey(): accountFailureLimit, a.ipKey(): ipFailureLimit} {
+		until, err := addFailure(ctx, key, limit)
+		if err != nil {
+			log.Printf("Error recording login failure: %v", err)
+			continue
+		}
+		if until != nil {
+			locked = true
+			a.event(ctx, userID, models.LoginEventLockout, fmt.Sprintf("%s locked until %s", key, until.Format(time.RFC3339)))
+		}
+	}
+	return locked
+}
+
+func (a loginAttempt) recordSuccess(ctx context.Context, userID bson.ObjectID) {
+	// only the account is cleared: one valid login must not reset the
+	// counter of an address that is guessing at other accounts
+	if _, err := database.LoginThrottleColl.DeleteOne(ctx, bson.M{"_id": a.accountKey()}); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+	a.event(ctx, userID, models.LoginEventSuccess, "")
+}
+
+func (a loginAttempt) event(ctx context.Context, userID bson.ObjectID, kind, reason string) {
+	recordLoginEvent(ctx, models.LoginEvent{
+		UserID:    userID,
+		Username:  a.username,
+		IP:        a.ip,
+		UserAgent: a.userAgent,
+		Type:      kind,
+		Reason:    reason,
+	})
+}
+
+func recordLoginEvent(ctx context.Context, ev models.LoginEvent) {
+	ev.CreatedAt = time.Now()
+	if _, err := database.LoginEventsColl.InsertOne(ctx, ev); err != nil {
+		log.Printf("Error recording login event: %v", err)
+	}
+}
+
+// addFailure bumps the counter of key and, once it reaches limit, locks the
+// key. It returns the lock expiry when a new lock was set.
+func addFailure(ctx context.Context, key string, limit int) (*time.Time, error) {
+	now := time.Now()
+	var t models.LoginThrottle
+	err := database.LoginThrottleColl.FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$lt": bson.A{"$last_failure_at", now.Add(-failureWindow)}},
+				1,
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+			}},
+			"last_failure_at": now,
+		}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	if t.Failures < limit {
+		return nil, nil
+	}
+
+	lockout := maxLockout
+	if n := t.Failures - limit; n < 16 {
+		if d := baseLockout << n; d < maxLockout {
+			lockout = d
+		}
+	}
+	until := now.Add(lockout)
+	// the counter must outlive the lock so the next failure escalates it
+	_, err = database.LoginThrottleColl.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"locked_until": until, "last_failure_at": until}})
+	if err != nil {
+		return nil, err
+	}
+	return &until, nil
+}
+
+func respondLocked(w http.ResponseWriter, wait time.Duration) {
+	secs := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(secs))
+	helpers.RespondError(w, http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts, try again in %d seconds", secs))
+}
+
+// UnlockUserHandler lets an admin lift the lockout of an account.
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	attempt := loginAttempt{username: strings.ToLower(user.Username), ip: helpers.ClientIP(r), userAgent: r.UserAgent()}
+	if _, err := database.LoginThrottleColl.DeleteOne(ctx, bson.M{"_id": attempt.accountKey()}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	admin, _ := middleware.UserFrom(r.Context())
+	attempt.event(ctx, user.ID, models.LoginEventUnlock, "unlocked by admin "+admin.UserID.Hex())
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "unlocked"})
+}
@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/totp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const (
+	totpIssuer        = "Marketplace"
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var errInvalidSecondFactor = errors.New("invalid code")
+
+// completeLogin is called once the password or the identity provider checked
+// out. Users with 2FA get an mfa_pending token to exchange at
+// /api/auth/login/2fa, everyone else gets a session straight away.
+func completeLogin(ctx context.Context, w http.ResponseWriter, user models.User, attempt loginAttempt) {
+	if user.IsSuspended() {
+		helpers.RespondError(w, http.StatusForbidden, "account suspended")
+		return
+	}
+	if user.MustResetPassword {
+		helpers.RespondError(w, http.StatusForbidden, "password reset required, check your email")
+		return
+	}
+	if user.TOTPEnabled {
+		mfaToken, err := middleware.CreateMFAToken(user.ID)
+		if err != nil {
+			helpers.RespondError(w, http.StatusInternalServerError, "could not create token")
+			return
+		}
+		helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int64(middleware.MFATokenTTL.Seconds()),
+		})
+		return
+	}
+
+	tokens, err := middleware.CreateToken(ctx, user)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not create token")
+		return
+	}
+	attempt.recordSuccess(ctx, user.ID)
+	if err := mergeGuestCart(ctx, attempt.cartToken, user.ID); err != nil {
+		log.Printf("Error merging guest cart of user %s: %v", user.ID.Hex(), err)
+	}
+	helpers.RespondJSON(w, http.StatusOK, authResponse(tokens, user))
+}
+
+// newRecoveryCodes returns plaintext codes like "k3m9-x2pq" and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	buf := make([]byte, 8)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		for j, b := range buf {
+			buf[j] = alphabet[int(b)%len(alphabet)]
+		}
+		codes[i] = string(buf[:4]) + "-" + string(buf[4:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return helpers.HashToken(code)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code. Both are consumed so they cannot be replayed.
+func checkSecondFactor(ctx context.Context, user models.User, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		hash := hashRecoveryCode(recoveryCode)
+		res, err := database.UsersColl.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "recovery_codes": hash},
+			bson.M{"$pull": bson.M{"recovery_codes": hash}},
+		)
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			return errInvalidSecondFactor
+		}
+		return nil
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), totpSkew)
+	if !ok {
+		return errInvalidSecondFactor
+	}
+	res, err := database.UsersColl.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "$or": []bson.M{
+			{"totp_last_step": bson.M{"$lt": step}},
+			{"totp_last_step": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"totp_last_step": step}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return errInvalidSecondFactor
+	}
+	return nil
+}
+
+// LoginTOTPHandler is the second step of a login with 2FA.
+func LoginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if payload.MFAToken == "" || (payload.Code == "" && payload.RecoveryCode == "") {
+		helpers.RespondError(w, http.StatusBadRequest, "mfa_token and code or recovery_code required")
+		return
+	}
+
+	userID, tokenID, err := middleware.ParseMFAToken(payload.MFAToken)
+	if err != nil {
+		helpers.RespondError(w, http.StatusUnauthorized, "invalid or expired mfa token")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil || !user.TOTPEnabled {
+		helpers.RespondError(w, http.StatusUnauthorized, "invalid or expired mfa token")
+		return
+	}
+	if user.IsSuspended() {
+		helpers.RespondError(w, http.StatusForbidden, "account suspended")
+		return
+	}
+
+	// codes are guessable too, they share the password's failure budget
+	attempt := newLoginAttempt(r, user.Username)
+	if wait := attempt.lockedFor(ctx); wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+
+	err = checkSecondFactor(ctx, user, payload.Code, payload.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		attempt.recordFailure(ctx, user.ID, "wrong second factor")
+		helpers.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	// a wrong code leaves the token usable, a completed login does not
+	err = middleware.ConsumeMFAToken(ctx, user.ID, tokenID)
+	if errors.Is(err, middleware.ErrMFATokenUsed) {
+		helpers.RespondError(w, http.StatusUnauthorized, "invalid or expired mfa token")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	tokens, err := middleware.CreateToken(ctx, user)
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not create token")
+		return
+	}
+	attempt.recordSuccess(ctx, user.ID)
+	if err := mergeGuestCart(ctx, attempt.cartToken, user.ID); err != nil {
+		log.Printf("Error merging guest cart of user %s: %v", user.ID.Hex(), err)
+	}
+	helpers.RespondJSON(w, http.StatusOK, authResponse(tokens, user))
+}
+
+// EnrollTOTPHandler creates a pending secret. It only takes effect once a
+// code generated from it is confirmed via EnableTOTPHandler.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if user.TOTPEnabled {
+		helpers.RespondError(w, http.StatusConflict, "two-factor authentication already enabled")
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not create secret")
+		return
+	}
+	if _, err := database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"totp_pending_secret": secret}}); err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totp.ProvisioningURI(secret, totpIssuer, user.Username),
+	})
+}
+
+// EnableTOTPHandler confirms enrollment with a code from the authenticator
+// app and returns the recovery codes. They are shown only this once.
+func EnableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Code == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "code required")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if user.TOTPEnabled {
+		helpers.RespondError(w, http.StatusConflict, "two-factor authentication already enabled")
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		helpers.RespondError(w, http.StatusBadRequest, "start enrollment first")
+		return
+	}
+	step, ok := totp.Validate(user.TOTPPendingSecret, payload.Code, time.Now(), totpSkew)
+	if !ok {
+		helpers.RespondError(w, http.StatusBadRequest, errInvalidSecondFactor.Error())
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "could not create recovery codes")
+		return
+	}
+	_, err = database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{
+			"totp_enabled":   true,
+			"totp_secret":    user.TOTPPendingSecret,
+			"totp_last_step": step,
+			"recovery_codes": hashes,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	})
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTPHandler turns 2FA off. It needs both the password and a second
+// factor so a stolen session alone cannot strip it.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	principal, ok := middleware.UserFrom(r.Context())
+	if !ok {
+		helpers.RespondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	var payload struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": principal.UserID}).Decode(&user); err != nil {
+		helpers.RespondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if !user.TOTPEnabled {
+		helpers.RespondError(w, http.StatusBadRequest, "two-factor authentication is not enabled")
+		return
+	}
+	attempt := newLoginAttempt(r, user.Username)
+	if wait := attempt.lockedFor(ctx); wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+	if err := helpers.CheckPassword(user.PasswordHash, payload.Password); err != nil {
+		attempt.recordFailure(ctx, user.ID, "wrong current password")
+		helpers.RespondError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+	err := checkSecondFactor(ctx, user, payload.Code, payload.RecoveryCode)
+	if errors.Is(err, errInvalidSecondFactor) {
+		attempt.recordFailure(ctx, user.ID, "wrong second factor")
+		helpers.RespondError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	_, err = database.UsersColl.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set":   bson.M{"totp_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	})
+	if err != nil {
+		log.Printf("Error disabling 2FA: %v", err)
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+
+	helpers.RespondJSON(w, http.StatusOK, map[string]string{"status": "two-factor authentication disabled"})
+}
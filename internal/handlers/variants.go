@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"PROJECTTEST/internal/money"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	maxVariantsPerProduct = 100
+	maxVariantAttributes  = 20
+	maxVariantImages      = 10
+	maxVariantValueLen    = 64
+)
+
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// variantInput holds the editable fields of a variant. Stock is changed
+// through the stock endpoint, except when the variant is created.
+type variantInput struct {
+	SKU        *string            `json:"sku"`
+	Size       *string            `json:"size"`
+	Color      *string            `json:"color"`
+	Attributes *map[string]string `json:"attributes"`
+	Price      *money.Money       `json:"price"`
+	ClearPrice bool               `json:"clear_price"`
+	Images     *[]string          `json:"images"`
+	// WeightGrams 0 falls back to the product weight.
+	WeightGrams *int `json:"weight_grams"`
+}
+
+func (in variantInput) apply(v *models.ProductVariant) error {
+	if in.SKU != nil {
+		sku := strings.TrimSpace(*in.SKU)
+		if !skuPattern.MatchString(sku) {
+			return errors.New("sku must be 1-64 letters, digits, '.', '_' or '-'")
+		}
+		v.SKU = normalizeSKU(sku)
+	}
+	if in.Size != nil {
+		size := strings.TrimSpace(*in.Size)
+		if len(size) > maxVariantValueLen {
+			return errors.New("size too long")
+		}
+		v.Size = size
+	}
+	if in.Color != nil {
+		color := strings.TrimSpace(*in.Color)
+		if len(color) > maxVariantValueLen {
+			return errors.New("color too long")
+		}
+		v.Color = color
+	}
+	if in.Attributes != nil {
+		attrs := map[string]string{}
+		for k, val := range *in.Attributes {
+			k = strings.TrimSpace(k)
+			if k == "" || len(k) > maxVariantValueLen || len(val) > maxVariantValueLen {
+				return errors.New("attribute names and values must be at most 64 characters")
+			}
+			attrs[k] = strings.TrimSpace(val)
+		}
+		if len(attrs) > maxVariantAttributes {
+			return errors.New("too many attributes")
+		}
+		v.Attributes = attrs
+	}
+	if in.ClearPrice {
+		v.Price = nil
+	} else if in.Price != nil {
+		if err := checkPrice("price", *in.Price); err != nil {
+			return err
+		}
+		price := *in.Price
+		v.Price = &price
+	}
+	if in.Images != nil {
+		if len(*in.Images) > maxVariantImages {
+			return errors.New("too many images")
+		}
+		for _, img := range *in.Images {
+			if !isImageURL(img) {
+				return errors.New("images must be http(s) URLs")
+			}
+		}
+		v.Images = *in.Images
+	}
+	if in.WeightGrams != nil {
+		if *in.WeightGrams < 0 {
+			return errors.New("weight_grams must not be negative")
+		}
+		v.WeightGrams = *in.WeightGrams
+	}
+	return nil
+}
+
+// ownedVariant loads the product and the variant named in the URL, like
+// ownedProduct. It writes the error response itself.
+func ownedVariant(ctx context.Context, w http.ResponseWriter, r *http.Request) (models.Product, *models.ProductVariant, bool) {
+	p, ok := ownedProduct(ctx, w, r)
+	if !ok {
+		return p, nil, false
+	}
+	id, err := bson.ObjectIDFromHex(mux.Vars(r)["variantId"])
+	if err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid variant id")
+		return p, nil, false
+	}
+	v := p.Variant(id)
+	if v == nil {
+		helpers.RespondError(w, http.StatusNotFound, "variant not found")
+		return p, nil, false
+	}
+	return p, v, true
+}
+
+// normalizeSKU upper-cases a SKU, so the unique index on variants.sku,
+// which compares exactly, treats "ab-1" and "AB-1" as the same SKU.
+func normalizeSKU(sku string) string {
+	return strings.ToUpper(sku)
+}
+
+func skuTaken(p models.Product, sku string, except bson.ObjectID) bool {
+	for _, v := range p.Variants {
+		if v.ID != except && v.SKU == sku {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateVariantHandler adds a variant. The first variant replaces the
+// product-level stock, so it is refused while product stock is reserved.
+func CreateVariantHandler(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		variantInput
+		Stock int `json:"stock"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if in.SKU == nil {
+		helpers.RespondError(w, http.StatusBadRequest, "sku required")
+		return
+	}
+	if in.Stock < 0 {
+		helpers.RespondError(w, http.StatusBadRequest, "stock must not be negative")
+		return
+	}
+	v := models.ProductVariant{ID: bson.NewObjectID(), Stock: in.Stock}
+	if err := in.apply(&v); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, ok := ownedProduct(ctx, w, r)
+	if !ok {
+		return
+	}
+	if len(p.Variants) >= maxVariantsPerProduct {
+		helpers.RespondError(w, http.StatusConflict, "too many variants")
+		return
+	}
+	if skuTaken(p, v.SKU, v.ID) {
+		helpers.RespondError(w, http.StatusConflict, "sku already in use")
+		return
+	}
+
+	now := time.Now()
+	filter := bson.M{"_id": p.ID}
+	update := bson.M{"$push": bson.M{"variants": v}}
+	if len(p.Variants) == 0 {
+		filter["variants.0"] = bson.M{"$exists": false}
+		filter["reserved"] = bson.M{"$not": bson.M{"$gt": 0}}
+		update["$set"] = bson.M{"stock": v.Stock, "updated_at": now}
+	} else {
+		filter["variants.0"] = bson.M{"$exists": true}
+		update["$inc"] = bson.M{"stock": v.Stock}
+		update["$set"] = bson.M{"updated_at": now}
+	}
+
+	err := database.ProductsColl.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&p)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "sku already in use")
+		return
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusConflict, "product stock is reserved or changed, retry")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	notePriceChange(ctx, r, p)
+	helpers.RespondJSON(w, http.StatusCreated, p)
+}
+
+// UpdateVariantHandler changes a variant's SKU, attributes, price or
+// images. It serves both PUT and PATCH; neither touches stock.
+func UpdateVariantHandler(w http.ResponseWriter, r *http.Request) {
+	var in variantInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, v, ok := ownedVariant(ctx, w, r)
+	if !ok {
+		return
+	}
+	if err := in.apply(v); err != nil {
+		helpers.RespondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if skuTaken(p, v.SKU, v.ID) {
+		helpers.RespondError(w, http.StatusConflict, "sku already in use")
+		return
+	}
+
+	set := bson.M{
+		"variants.$.sku":          v.SKU,
+		"variants.$.size":         v.Size,
+		"variants.$.color":        v.Color,
+		"variants.$.attributes":   v.Attributes,
+		"variants.$.images":       v.Images,
+		"variants.$.weight_grams": v.WeightGrams,
+		"updated_at":              time.Now(),
+	}
+	update := bson.M{"$set": set}
+	if v.Price != nil {
+		set["variants.$.price"] = *v.Price
+	} else {
+		update["$unset"] = bson.M{"variants.$.price": ""}
+	}
+
+	err := database.ProductsColl.FindOneAndUpdate(ctx, bson.M{"_id": p.ID, "variants._id": v.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&p)
+	if mongo.IsDuplicateKeyError(err) {
+		helpers.RespondError(w, http.StatusConflict, "sku already in use")
+		return
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusNotFound, "variant not found")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	notePriceChange(ctx, r, p)
+	helpers.RespondJSON(w, http.StatusOK, p)
+}
+
+// DeleteVariantHandler removes a variant and its stock from the product
+// totals. Variants with reserved units cannot be removed.
+func DeleteVariantHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, v, ok := ownedVariant(ctx, w, r)
+	if !ok {
+		return
+	}
+	if v.Reserved > 0 {
+		helpers.RespondError(w, http.StatusConflict, "variant has reserved stock")
+		return
+	}
+
+	filter := bson.M{"_id": p.ID, "variants": bson.M{"$elemMatch": bson.M{"_id": v.ID, "stock": v.Stock, "reserved": bson.M{"$lte": 0}}}}
+	update := bson.M{
+		"$pull": bson.M{"variants": bson.M{"_id": v.ID}},
+		"$inc":  bson.M{"stock": -v.Stock},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}
+	err := database.ProductsColl.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&p)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		helpers.RespondError(w, http.StatusConflict, "variant stock changed, retry")
+		return
+	}
+	if err != nil {
+		helpers.RespondError(w, http.StatusInternalServerError, "db error")
+		return
+	}
+	notePriceChange(ctx, r, p)
+	helpers.RespondJSON(w, http.StatusOK, p)
+}
+
+// variantFacets counts the products matching filter per size and color.
+func variantFacets(ctx context.Context, filter bson.M) (map[string]interface{}, error) {
+	facet := func(field string) mongo.Pipeline {
+		return mongo.Pipeline{
+			{{Key: "$unwind", Value: "$variants"}},
+			{{Key: "$match", Value: bson.M{"variants." + field: bson.M{"$gt": ""}}}},
+			{{Key: "$group", Value: bson.M{"_id": "$variants." + field, "products": bson.M{"$addToSet": "$_id"}}}},
+			{{Key: "$project", Value: bson.M{"_id": 0, "value": "$_id", "count": bson.M{"$size": "$products"}}}},
+			{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "value", Value: 1}}}},
+		}
+	}
+	cursor, err := database.ProductsColl.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: bson.M{"sizes": facet("size"), "colors": facet("color")}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	type bucket struct {
+		Value string `bson:"value" json:"value"`
+		Count int    `bson:"count" json:"count"`
+	}
+	var rows []struct {
+		Sizes  []bucket `bson:"sizes"`
+		Colors []bucket `bson:"colors"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{"sizes": []bucket{}, "colors": []bucket{}}
+	if len(rows) > 0 {
+		if rows[0].Sizes != nil {
+			out["sizes"] = rows[0].Sizes
+		}
+		if rows[0].Colors != nil {
+			out["colors"] = rows[0].Colors
+		}
+	}
+	return out, nil
+}
+
+// variantFilter reads ?size= and ?color= (comma-separated) and matches
+// products that have one variant with both.
+func variantFilter(r *http.Request) bson.M {
+	match := bson.M{}
+	for _, field := range []string{"size", "color"} {
+		var values []string
+		for _, v := range strings.Split(r.URL.Query().Get(field), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			match[field] = bson.M{"$in": values}
+		}
+	}
+	if len(match) == 0 {
+		return nil
+	}
+	return bson.M{"variants": bson.M{"$elemMatch": match}}
+}
@@ -1,11 +1,22 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"golang.org/x/crypto/bcrypt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// TrustProxyHeaders makes ClientIP believe X-Forwarded-For. Only enable it
+// when the server sits behind a proxy that overwrites that header.
+var TrustProxyHeaders bool
+
 func RespondJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -24,3 +35,50 @@ func HashPassword(password string) (string, error) {
 func CheckPassword(hash, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
+
+// NewToken returns a random URL-safe string carrying n bytes of entropy.
+func NewToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex SHA-256 of an opaque token. Only the hash is
+// stored, so a database leak does not hand out usable tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the address of the client that sent the request.
+func ClientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Pagination reads ?page= and ?limit= (1-based page, limit capped at
+// maxLimit) and returns them with the number of documents to skip.
+func Pagination(r *http.Request, defaultLimit, maxLimit int64) (page, limit, skip int64) {
+	page, limit = 1, defaultLimit
+	q := r.URL.Query()
+	if p, err := strconv.ParseInt(q.Get("page"), 10, 64); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.ParseInt(q.Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return page, limit, (page - 1) * limit
+}
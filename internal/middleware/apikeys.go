@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// APIKeyHeader carries a personal API key as an alternative to a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+// lastUsedResolution limits how often last_used_at is written for a busy key.
+const lastUsedResolution = time.Minute
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+func authenticateAPIKey(r *http.Request, key string) (*Principal, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var k models.APIKey
+	err := database.APIKeysColl.FindOne(ctx, bson.M{
+		"key_hash":   helpers.HashToken(key),
+		"revoked_at": bson.M{"$exists": false},
+	}).Decode(&k)
+	if err != nil {
+		return nil, errInvalidAPIKey
+	}
+	now := time.Now()
+	if k.ExpiresAt != nil && now.After(*k.ExpiresAt) {
+		return nil, errInvalidAPIKey
+	}
+
+	// roles come from the owner as they are now, not when the key was made
+	user, err := loadActiveUser(ctx, k.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = database.APIKeysColl.UpdateOne(ctx,
+		bson.M{"_id": k.ID, "$or": []bson.M{
+			{"last_used_at": bson.M{"$exists": false}},
+			{"last_used_at": bson.M{"$lt": now.Add(-lastUsedResolution)}},
+		}},
+		bson.M{"$set": bson.M{"last_used_at": now, "last_used_ip": helpers.ClientIP(r)}},
+	)
+	if err != nil {
+		log.Printf("Error tracking api key usage: %v", err)
+	}
+
+	return &Principal{
+		UserID:      user.ID,
+		Roles:       user.EffectiveRoles(),
+		APIKeyID:    k.ID,
+		Scopes:      k.Scopes,
+		TOTPEnabled: user.TOTPEnabled,
+	}, nil
+}
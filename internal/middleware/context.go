@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"PROJECTTEST/internal/database"
+	"PROJECTTEST/internal/models"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Principal is the authenticated caller of a request. Callers using an API
+// key have APIKeyID set and are limited to the key's scopes; for sessions
+// TokenID is the access token jti. TOTPEnabled tells whether the user has
+// enrolled a second factor, see RequireTwoFactor.
+type Principal struct {
+	UserID      bson.ObjectID
+	Roles       []string
+	TokenID     bson.ObjectID
+	APIKeyID    bson.ObjectID
+	Scopes      []string
+	TOTPEnabled bool
+}
+
+// IsAPIKey reports whether the caller authenticated with an API key.
+func (p *Principal) IsAPIKey() bool {
+	return !p.APIKeyID.IsZero()
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	if !p.IsAPIKey() {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// UserFrom returns the principal stored by AuthMiddleware or OptionalAuth.
+func UserFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey).(*Principal)
+	return p, ok && p != nil
+}
+
+func authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return authenticateAPIKey(r, key)
+	}
+	claims, err := ParseToken(r)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := bson.ObjectIDFromHex(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	tokenID, _ := bson.ObjectIDFromHex(claims.ID)
+
+	// roles and suspension are read fresh, so admin changes apply at once
+	// instead of when the access token expires
+	user, err := loadActiveUser(r.Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{UserID: userID, Roles: user.EffectiveRoles(), TokenID: tokenID, TOTPEnabled: user.TOTPEnabled}, nil
+}
+
+func loadActiveUser(ctx context.Context, userID bson.ObjectID) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := database.UsersColl.FindOne(ctx, bson.M{"_id": userID},
+		options.FindOne().SetProjection(bson.M{"roles": 1, "status": 1, "totp_enabled": 1}),
+	).Decode(&user)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.IsSuspended() {
+		return nil, ErrAccountSuspended
+	}
+	return &user, nil
+}
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Keys signs and verifies every token the server issues. main sets it up
+// with LoadKeySet or GenerateKeySet before serving requests.
+var Keys *KeySet
+
+var signingMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for verification-only keys
+	public  crypto.PublicKey
+}
+
+// KeySet holds the keys tokens are signed with, each identified by a kid.
+// Only the active key signs; all keys verify, so rotating in a new key does
+// not invalidate tokens signed with the previous one.
+type KeySet struct {
+	mu     sync.RWMutex
+	dir    string
+	active string
+	pinned string
+	keys   map[string]*signingKey
+}
+
+// LoadKeySet reads every *.pem file in dir. The file name without extension
+// is the kid. Private keys (PKCS#8 RSA or Ed25519, or PKCS#1 RSA) can sign;
+// public keys are kept for verifying tokens of a retired key. activeKID
+// selects the signing key; when empty the last private key by name wins, so
+// naming keys by date rotates them in automatically.
+func LoadKeySet(dir, activeKID string) (*KeySet, error) {
+	ks := &KeySet{dir: dir, pinned: activeKID}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// GenerateKeySet returns a set with one throwaway Ed25519 key. Tokens signed
+// with it do not survive a restart; it is meant for local development only.
+func GenerateKeySet() (*KeySet, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	kid := "ephemeral-" + time.Now().UTC().Format("20060102T150405")
+	return &KeySet{
+		active: kid,
+		keys: map[string]*signingKey{
+			kid: {kid: kid, method: jwt.SigningMethodEdDSA, private: priv, public: pub},
+		},
+	}, nil
+}
+
+// Reload re-reads the key directory, e.g. after a new key was dropped in.
+func (ks *KeySet) Reload() error {
+	if ks.dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(ks.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	keys := map[string]*signingKey{}
+	var signers []string
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := parseKey(kid, data)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kid, err)
+		}
+		keys[kid] = key
+		if key.private != nil {
+			signers = append(signers, kid)
+		}
+	}
+	if len(signers) == 0 {
+		return fmt.Errorf("no private keys found in %s", ks.dir)
+	}
+	sort.Strings(signers)
+	active := signers[len(signers)-1]
+	if ks.pinned != "" {
+		k, ok := keys[ks.pinned]
+		if !ok || k.private == nil {
+			return fmt.Errorf("active key %s not found in %s", ks.pinned, ks.dir)
+		}
+		active = ks.pinned
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.active = active
+	ks.mu.Unlock()
+	return nil
+}
+
+func parseKey(kid string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: k, public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, public: k}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: k, public: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, public: k}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", parsed)
+}
+
+// Sign signs claims with the active key and stamps its kid in the header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.keys[ks.active]
+	ks.mu.RUnlock()
+	if key == nil {
+		return "", errors.New("no signing key configured")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token against the key named by its kid.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, ks.keyFunc, jwt.WithValidMethods(signingMethods))
+}
+
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	ks.mu.RLock()
+	key := ks.keys[kid]
+	ks.mu.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("signing method does not match key")
+	}
+	return key.public, nil
+}
+
+// JWK is one entry of a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public half of every key, for other services to verify
+// our tokens.
+func (ks *KeySet) JWKS() map[string][]JWK {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	out := make([]JWK, 0, len(kids))
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		out = append(out, jwk)
+	}
+	return map[string][]JWK{"keys": out}
+}
@@ -1,7 +1,10 @@
 package middleware
 
 import (
+	"PROJECTTEST/internal/database"
 	"PROJECTTEST/internal/helpers"
+	"PROJECTTEST/internal/models"
+	"context"
 	"errors"
 	"net/http"
 	"strings"
@@ -9,46 +12,277 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-var JWTSecret []byte
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	MFATokenTTL     = 5 * time.Minute
+)
+
+// PurposeMFAPending marks the token handed out after a correct password when
+// the second factor is still missing. It is not an access token.
+const PurposeMFAPending = "mfa_pending"
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionRevoked      = errors.New("session revoked")
+	ErrAccountSuspended    = errors.New("account suspended")
+	ErrMFATokenUsed        = errors.New("mfa token already used")
+)
 
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID  string   `json:"user_id"`
+	Roles   []string `json:"roles,omitempty"`
+	Purpose string   `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func CreateToken(userID bson.ObjectID) (string, error) {
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenPair is what clients receive on login, registration and refresh.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// CreateToken starts a new session for the user: it stores a fresh refresh
+// token family in Mongo and returns it together with a short-lived access token.
+func CreateToken(ctx context.Context, user models.User) (*TokenPair, error) {
+	pair, _, err := issueTokens(ctx, user, bson.NewObjectID())
+	return pair, err
+}
+
+func issueTokens(ctx context.Context, user models.User, familyID bson.ObjectID) (*TokenPair, bson.ObjectID, error) {
+	refresh, err := helpers.NewToken(32)
+	if err != nil {
+		return nil, bson.NilObjectID, err
+	}
+	now := time.Now()
+	rt := models.RefreshToken{
+		ID:        bson.NewObjectID(),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: helpers.HashToken(refresh),
+		ExpiresAt: now.Add(RefreshTokenTTL),
+		CreatedAt: now,
+	}
+	if _, err := database.RefreshTokensColl.InsertOne(ctx, rt); err != nil {
+		return nil, bson.NilObjectID, err
+	}
+	access, err := signAccessToken(user, rt.ID, now)
+	if err != nil {
+		return nil, bson.NilObjectID, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(AccessTokenTTL.Seconds()),
+	}, rt.ID, nil
+}
+
+func signAccessToken(user models.User, sessionID bson.ObjectID, now time.Time) (string, error) {
 	claims := Claims{
-		UserID: userID.Hex(),
+		UserID: user.ID.Hex(),
+		Roles:  user.EffectiveRoles(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        sessionID.Hex(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
-	Token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return Token.SignedString(JWTSecret)
+	return Keys.Sign(claims)
 }
 
-func GetUserIDFromToken(r *http.Request) (bson.ObjectID, error) {
+// CreateMFAToken returns the short-lived token that lets a user who passed
+// the password check finish logging in with their second factor.
+func CreateMFAToken(userID bson.ObjectID) (string, error) {
+	jti, err := helpers.NewToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return Keys.Sign(Claims{
+		UserID:  userID.Hex(),
+		Purpose: PurposeMFAPending,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(now.Add(MFATokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// ParseMFAToken validates a token from CreateMFAToken and returns the user
+// and the token's jti.
+func ParseMFAToken(tokenString string) (bson.ObjectID, string, error) {
+	tkn, err := Keys.Parse(tokenString, &Claims{})
+	if err != nil {
+		return bson.NilObjectID, "", err
+	}
+	claims, ok := tkn.Claims.(*Claims)
+	if !ok || !tkn.Valid || claims.Purpose != PurposeMFAPending || claims.ID == "" {
+		return bson.NilObjectID, "", errors.New("invalid mfa token")
+	}
+	userID, err := bson.ObjectIDFromHex(claims.UserID)
+	return userID, claims.ID, err
+}
+
+// ConsumeMFAToken marks the mfa token with the given jti as used. Only the
+// first call for a jti succeeds, later ones get ErrMFATokenUsed.
+func ConsumeMFAToken(ctx context.Context, userID bson.ObjectID, tokenID string) error {
+	_, err := database.UsedMFATokensColl.InsertOne(ctx, models.UsedMFAToken{
+		ID:        tokenID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(MFATokenTTL),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrMFATokenUsed
+	}
+	return err
+}
+
+// RefreshTokens rotates a refresh token: the presented token is revoked and
+// replaced by a new one in the same family. Presenting a token that was
+// already rotated means it leaked, so the whole family is revoked.
+func RefreshTokens(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	var rt models.RefreshToken
+	err := database.RefreshTokensColl.FindOne(ctx, bson.M{"token_hash": helpers.HashToken(refreshToken)}).Decode(&rt)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if rt.RevokedAt != nil {
+		if !rt.ReplacedBy.IsZero() {
+			_ = RevokeFamily(ctx, rt.FamilyID)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// reload the user so role changes take effect on the next refresh
+	var user models.User
+	if err := database.UsersColl.FindOne(ctx, bson.M{"_id": rt.UserID}).Decode(&user); err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	if user.IsSuspended() {
+		return nil, ErrAccountSuspended
+	}
+
+	pair, nextID, err := issueTokens(ctx, user, rt.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the filter on revoked_at makes the rotation race-safe: if two requests
+	// present the same token, only one of them wins
+	res, err := database.RefreshTokensColl.UpdateOne(ctx,
+		bson.M{"_id": rt.ID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "replaced_by": nextID}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		_ = RevokeFamily(ctx, rt.FamilyID)
+		return nil, ErrInvalidRefreshToken
+	}
+	return pair, nil
+}
+
+// RevokeFamily ends a session: every refresh token in the family and every
+// access token issued with them stops working.
+func RevokeFamily(ctx context.Context, familyID bson.ObjectID) error {
+	_, err := database.RefreshTokensColl.UpdateMany(ctx,
+		bson.M{"family_id": familyID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// RevokeSession revokes the session the given access token jti belongs to.
+func RevokeSession(ctx context.Context, tokenID bson.ObjectID) error {
+	var rt models.RefreshToken
+	if err := database.RefreshTokensColl.FindOne(ctx, bson.M{"_id": tokenID}).Decode(&rt); err != nil {
+		return err
+	}
+	return RevokeFamily(ctx, rt.FamilyID)
+}
+
+// RevokeUserSessions logs the user out everywhere.
+func RevokeUserSessions(ctx context.Context, userID bson.ObjectID) error {
+	_, err := database.RefreshTokensColl.UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// RevokeOtherSessions logs the user out everywhere except the session the
+// given access token jti belongs to.
+func RevokeOtherSessions(ctx context.Context, userID, tokenID bson.ObjectID) error {
+	var current models.RefreshToken
+	if err := database.RefreshTokensColl.FindOne(ctx, bson.M{"_id": tokenID}).Decode(&current); err != nil {
+		return err
+	}
+	_, err := database.RefreshTokensColl.UpdateMany(ctx,
+		bson.M{"user_id": userID, "family_id": bson.M{"$ne": current.FamilyID}, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+	return err
+}
+
+// ParseToken validates the bearer token of the request, including that its
+// session has not been revoked or rotated away.
+func ParseToken(r *http.Request) (*Claims, error) {
 	tokenString := r.Header.Get("Authorization")
 	if tokenString == "" {
-		return bson.NilObjectID, errors.New("missing auth token")
+		return nil, errors.New("missing auth token")
 	}
 
 	parts := strings.Split(tokenString, " ")
 	if len(parts) != 2 {
-		return bson.NilObjectID, errors.New("invalid auth header")
+		return nil, errors.New("invalid auth header")
 	}
-	tkn, err := jwt.ParseWithClaims(parts[1], &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return JWTSecret, nil
-	})
+	tkn, err := Keys.Parse(parts[1], &Claims{})
 	if err != nil {
-		return bson.NilObjectID, err
+		return nil, err
 	}
 	claims, ok := tkn.Claims.(*Claims)
-	if !ok || !tkn.Valid {
-		return bson.NilObjectID, errors.New("invalid token")
+	if !ok || !tkn.Valid || claims.Purpose != "" {
+		return nil, errors.New("invalid token")
+	}
+
+	sessionID, err := bson.ObjectIDFromHex(claims.ID)
+	if err != nil {
+		return nil, errors.New("invalid token")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var rt models.RefreshToken
+	if err := database.RefreshTokensColl.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&rt); err != nil {
+		return nil, ErrSessionRevoked
+	}
+	if rt.RevokedAt != nil {
+		return nil, ErrSessionRevoked
+	}
+	return claims, nil
+}
+
+func GetUserIDFromToken(r *http.Request) (bson.ObjectID, error) {
+	claims, err := ParseToken(r)
+	if err != nil {
+		return bson.NilObjectID, err
 	}
 	id, err := bson.ObjectIDFromHex(claims.UserID)
 	if err != nil {
@@ -57,13 +291,112 @@ func GetUserIDFromToken(r *http.Request) (bson.ObjectID, error) {
 	return id, nil
 }
 
+// AuthMiddleware rejects unauthenticated requests and stores the caller in
+// the request context, see UserFrom.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := GetUserIDFromToken(r)
+		if _, ok := UserFrom(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := authenticate(r)
 		if err != nil {
 			helpers.RespondError(w, http.StatusUnauthorized, "unauthorized: "+err.Error())
 			return
 		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// OptionalAuth stores the caller in the context when a valid token is sent
+// and otherwise serves the request anonymously. It is meant for public
+// endpoints that personalize their response for signed-in users.
+func OptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get(APIKeyHeader) != "" {
+			if p, err := authenticate(r); err == nil {
+				r = r.WithContext(WithPrincipal(r.Context(), p))
+			}
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// twoFactorRoles handle money or other people's accounts. Using them
+// requires TOTP to be enabled.
+var twoFactorRoles = map[string]bool{models.RoleSeller: true, models.RoleAdmin: true}
+
+// RequireRole only lets through callers holding at least one of the given
+// roles. Seller and admin roles only count once the caller has enabled 2FA.
+// It authenticates the request itself, so it can wrap a handler directly or
+// sit behind AuthMiddleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := UserFrom(r.Context())
+			needsTwoFactor := false
+			for _, role := range roles {
+				if !p.HasRole(role) {
+					continue
+				}
+				if twoFactorRoles[role] && !p.TOTPEnabled {
+					needsTwoFactor = true
+					continue
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			if needsTwoFactor {
+				respondTwoFactorRequired(w)
+				return
+			}
+			helpers.RespondError(w, http.StatusForbidden, "forbidden")
+		}))
+	}
+}
+
+// RequireTwoFactor only lets through callers who have enabled TOTP. It
+// guards routes that are privileged without being tied to a role, like a
+// seller's own store.
+func RequireTwoFactor(next http.Handler) http.Handler {
+	return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := UserFrom(r.Context())
+		if !p.TOTPEnabled {
+			respondTwoFactorRequired(w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+func respondTwoFactorRequired(w http.ResponseWriter) {
+	helpers.RespondError(w, http.StatusForbidden, "two-factor authentication required, enroll at /api/auth/2fa/enroll")
+}
+
+// RequireScope only lets through callers whose API key carries scope.
+// Interactive sessions always pass.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := UserFrom(r.Context())
+			if !p.HasScope(scope) {
+				helpers.RespondError(w, http.StatusForbidden, "api key lacks scope "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// SessionOnly rejects API keys. It guards account management, which only
+// the user themselves should do through an interactive login.
+func SessionOnly(next http.Handler) http.Handler {
+	return AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := UserFrom(r.Context())
+		if p.IsAPIKey() {
+			helpers.RespondError(w, http.StatusForbidden, "not allowed with an api key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
@@ -1,16 +1,108 @@
 package models
 
 import (
+	"PROJECTTEST/internal/money"
+	"encoding/json"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"time"
 )
 
+const (
+	RoleBuyer  = "buyer"
+	RoleSeller = "seller"
+	RoleAdmin  = "admin"
+)
+
+// ValidRole reports whether role is one of the roles above.
+func ValidRole(role string) bool {
+	return role == RoleBuyer || role == RoleSeller || role == RoleAdmin
+}
+
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+)
+
 type User struct {
-	ID           bson.ObjectID `bson:"_id,omitempty" json:"id"`
-	Username     string        `bson:"username" json:"username"`
-	Email        string        `bson:"email" json:"email"`
-	PasswordHash string        `bson:"password_hash" json:"-"`
-	CreatedAt    time.Time     `bson:"created_at" json:"created_at"`
+	ID            bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username      string        `bson:"username" json:"username"`
+	Email         string        `bson:"email" json:"email"`
+	EmailVerified bool          `bson:"email_verified" json:"email_verified"`
+	PasswordHash  string        `bson:"password_hash" json:"-"`
+	Roles         []string      `bson:"roles" json:"roles"`
+	DisplayName   string        `bson:"display_name,omitempty" json:"display_name,omitempty"`
+	AvatarURL     string        `bson:"avatar_url,omitempty" json:"avatar_url,omitempty"`
+	Addresses     []Address     `bson:"addresses,omitempty" json:"addresses"`
+	Identities    []Identity    `bson:"identities,omitempty" json:"identities,omitempty"`
+	Status        string        `bson:"status,omitempty" json:"status,omitempty"`
+	SuspendedAt   *time.Time    `bson:"suspended_at,omitempty" json:"suspended_at,omitempty"`
+	SuspendReason string        `bson:"suspend_reason,omitempty" json:"suspend_reason,omitempty"`
+	// MustResetPassword is set by an admin; logins, including through an
+	// identity provider, are refused until the user has gone through the
+	// reset flow.
+	MustResetPassword bool      `bson:"must_reset_password,omitempty" json:"must_reset_password,omitempty"`
+	CreatedAt         time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+
+	// TOTP second factor. Recovery codes are stored hashed.
+	TOTPEnabled       bool     `bson:"totp_enabled" json:"totp_enabled"`
+	TOTPSecret        string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastStep      int64    `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string `bson:"recovery_codes,omitempty" json:"-"`
+}
+
+// Address is a shipping address saved on the user's profile.
+type Address struct {
+	ID         bson.ObjectID `bson:"_id" json:"id"`
+	Label      string        `bson:"label,omitempty" json:"label,omitempty"`
+	FullName   string        `bson:"full_name" json:"full_name"`
+	Line1      string        `bson:"line1" json:"line1"`
+	Line2      string        `bson:"line2,omitempty" json:"line2,omitempty"`
+	City       string        `bson:"city" json:"city"`
+	Region     string        `bson:"region,omitempty" json:"region,omitempty"`
+	PostalCode string        `bson:"postal_code" json:"postal_code"`
+	Country    string        `bson:"country" json:"country"` // ISO 3166-1 alpha-2
+	Phone      string        `bson:"phone,omitempty" json:"phone,omitempty"`
+	IsDefault  bool          `bson:"is_default" json:"is_default"`
+}
+
+// Identity links the user to an account at an external OpenID Connect
+// provider.
+type Identity struct {
+	Key      string    `bson:"key" json:"-"` // provider + ":" + subject, unique across users
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+func IdentityKey(provider, subject string) string {
+	return provider + ":" + subject
+}
+
+// EffectiveRoles returns the user's roles. Accounts created before roles
+// existed have none stored and are treated as buyers.
+func (u User) EffectiveRoles() []string {
+	if len(u.Roles) == 0 {
+		return []string{RoleBuyer}
+	}
+	return u.Roles
+}
+
+// IsSuspended reports whether an admin suspended the account. Accounts with
+// no status stored are active.
+func (u User) IsSuspended() bool {
+	return u.Status == UserStatusSuspended
+}
+
+func (u User) HasRole(role string) bool {
+	for _, r := range u.EffectiveRoles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 type Product struct {
@@ -18,15 +110,621 @@ type Product struct {
 	Name        string        `bson:"name" json:"name"`
 	Description string        `bson:"description" json:"description"`
 	Category    string        `bson:"category" json:"category"`
-	Price       float64       `bson:"price" json:"price"`
+	Price       money.Money   `bson:"price" json:"price"`
 	ImageURL    string        `bson:"image_url" json:"image_url"`
+	OwnerID     bson.ObjectID `bson:"owner_id,omitempty" json:"owner_id,omitempty"`
+	SellerID    bson.ObjectID `bson:"seller_id,omitempty" json:"seller_id,omitempty"`
 	CreatedAt   time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time     `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+
+	// Stock is what can still be sold; Reserved is held for unpaid orders.
+	Stock             int `bson:"stock" json:"stock"`
+	Reserved          int `bson:"reserved" json:"reserved"`
+	LowStockThreshold int `bson:"low_stock_threshold,omitempty" json:"low_stock_threshold,omitempty"`
+
+	// WeightGrams is the shipping weight of one unit.
+	WeightGrams int `bson:"weight_grams,omitempty" json:"weight_grams,omitempty"`
+
+	// Hidden takes the product off sale while its store is not approved or
+	// the store's owner is suspended.
+	Hidden bool `bson:"hidden,omitempty" json:"hidden,omitempty"`
+
+	// When a product has variants, its Stock and Reserved are the sums over
+	// them and only variants can be bought.
+	Variants []ProductVariant `bson:"variants,omitempty" json:"variants,omitempty"`
+
+	// SalePrice replaces Price between SaleStartsAt and SaleEndsAt (either
+	// may be left open). CompareAtPrice is the "was" price shown beside it.
+	CompareAtPrice *money.Money `bson:"compare_at_price,omitempty" json:"compare_at_price,omitempty"`
+	SalePrice      *money.Money `bson:"sale_price,omitempty" json:"sale_price,omitempty"`
+	SaleStartsAt   *time.Time   `bson:"sale_starts_at,omitempty" json:"sale_starts_at,omitempty"`
+	SaleEndsAt     *time.Time   `bson:"sale_ends_at,omitempty" json:"sale_ends_at,omitempty"`
+
+	// Display holds prices converted to the currency the client asked for.
+	Display map[string]money.Money `bson:"-" json:"display,omitempty"`
+}
+
+// MarshalJSON adds the price the product sells for right now.
+func (p Product) MarshalJSON() ([]byte, error) {
+	type product Product
+	now := time.Now()
+	return json.Marshal(struct {
+		product
+		CurrentPrice money.Money `json:"current_price"`
+		WasPrice     money.Money `json:"was_price,omitzero"`
+		OnSale       bool        `json:"on_sale"`
+	}{product(p), p.PriceAt(nil, now), p.WasPriceAt(nil, now), p.OnSaleAt(now)})
+}
+
+// ProductVariant is one buyable SKU of a product, e.g. a size and color.
+type ProductVariant struct {
+	ID         bson.ObjectID     `bson:"_id" json:"id"`
+	SKU        string            `bson:"sku" json:"sku"`
+	Size       string            `bson:"size,omitempty" json:"size,omitempty"`
+	Color      string            `bson:"color,omitempty" json:"color,omitempty"`
+	Attributes map[string]string `bson:"attributes,omitempty" json:"attributes,omitempty"`
+	// Price overrides the product price when set.
+	Price    *money.Money `bson:"price,omitempty" json:"price,omitempty"`
+	Stock    int          `bson:"stock" json:"stock"`
+	Reserved int          `bson:"reserved" json:"reserved"`
+	Images   []string     `bson:"images,omitempty" json:"images,omitempty"`
+	// WeightGrams overrides the product weight when set.
+	WeightGrams int `bson:"weight_grams,omitempty" json:"weight_grams,omitempty"`
+}
+
+// Variant returns the variant with the given id, or nil.
+func (p Product) Variant(id bson.ObjectID) *ProductVariant {
+	for i := range p.Variants {
+		if p.Variants[i].ID == id {
+			return &p.Variants[i]
+		}
+	}
+	return nil
+}
+
+// UnitPrice is what the product, or the variant if one is given, sells for
+// now.
+func (p Product) UnitPrice(v *ProductVariant) money.Money {
+	return p.PriceAt(v, time.Now())
+}
+
+// UnitWeight is the shipping weight in grams of one unit of the product, or
+// of the variant if one is given.
+func (p Product) UnitWeight(v *ProductVariant) int {
+	if v != nil && v.WeightGrams > 0 {
+		return v.WeightGrams
+	}
+	return p.WeightGrams
+}
+
+// OnSaleAt reports whether the sale price applies at t.
+func (p Product) OnSaleAt(t time.Time) bool {
+	return p.SalePrice != nil &&
+		(p.SaleStartsAt == nil || !t.Before(*p.SaleStartsAt)) &&
+		(p.SaleEndsAt == nil || t.Before(*p.SaleEndsAt))
+}
+
+// PriceAt is the selling price at t. A variant's own price wins over the
+// product's, sale or not.
+func (p Product) PriceAt(v *ProductVariant, t time.Time) money.Money {
+	if v != nil && v.Price != nil {
+		return *v.Price
+	}
+	if p.OnSaleAt(t) {
+		return *p.SalePrice
+	}
+	return p.Price
+}
+
+// WasPriceAt is the "was" price to show beside PriceAt: CompareAtPrice, or
+// the regular price during a sale. It is zero unless higher than PriceAt.
+func (p Product) WasPriceAt(v *ProductVariant, t time.Time) money.Money {
+	now := p.PriceAt(v, t)
+	was := money.Zero(now.Currency)
+	if p.CompareAtPrice != nil {
+		was = *p.CompareAtPrice
+	} else if p.OnSaleAt(t) && (v == nil || v.Price == nil) {
+		was = p.Price
+	}
+	if !now.Less(was) {
+		return money.Zero(now.Currency)
+	}
+	return was
+}
+
+// PriceChange is a snapshot of a product's pricing, written whenever it
+// changes. VariantPrices holds the variants' own prices by variant id.
+type PriceChange struct {
+	ID             bson.ObjectID          `bson:"_id,omitempty" json:"id"`
+	ProductID      bson.ObjectID          `bson:"product_id" json:"product_id"`
+	Price          money.Money            `bson:"price" json:"price"`
+	CompareAtPrice *money.Money           `bson:"compare_at_price,omitempty" json:"compare_at_price,omitempty"`
+	SalePrice      *money.Money           `bson:"sale_price,omitempty" json:"sale_price,omitempty"`
+	SaleStartsAt   *time.Time             `bson:"sale_starts_at,omitempty" json:"sale_starts_at,omitempty"`
+	SaleEndsAt     *time.Time             `bson:"sale_ends_at,omitempty" json:"sale_ends_at,omitempty"`
+	VariantPrices  map[string]money.Money `bson:"variant_prices,omitempty" json:"variant_prices,omitempty"`
+	ChangedBy      bson.ObjectID          `bson:"changed_by,omitempty" json:"-"`
+	At             time.Time              `bson:"at" json:"at"`
 }
 
 type Interaction struct {
 	ID         bson.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserID     bson.ObjectID `bson:"user_id" json:"user_id"`
 	ProductID  bson.ObjectID `bson:"product_id" json:"product_id"`
-	ActionType string        `bson:"action_type" json:"action_type"` // "view" | "like" | "purchase"
+	VariantID  bson.ObjectID `bson:"variant_id,omitempty" json:"variant_id,omitempty"`
+	ActionType string        `bson:"action_type" json:"action_type"` // "view" | "like" | "purchase" | "return"
 	Timestamp  time.Time     `bson:"timestamp" json:"timestamp"`
 }
+
+// RefreshToken is one link in a rotating refresh-token chain. Every login
+// starts a new family; each refresh revokes the presented token and issues
+// its successor in the same family. The record ID doubles as the jti of the
+// access token issued alongside it.
+type RefreshToken struct {
+	ID         bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     bson.ObjectID `bson:"user_id" json:"user_id"`
+	FamilyID   bson.ObjectID `bson:"family_id" json:"family_id"`
+	TokenHash  string        `bson:"token_hash" json:"-"`
+	ReplacedBy bson.ObjectID `bson:"replaced_by,omitempty" json:"-"`
+	ExpiresAt  time.Time     `bson:"expires_at" json:"expires_at"`
+	RevokedAt  *time.Time    `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt  time.Time     `bson:"created_at" json:"created_at"`
+}
+
+const (
+	EmailTokenVerify        = "verify_email"
+	EmailTokenPasswordReset = "password_reset"
+)
+
+// EmailToken is a single-use secret mailed to the user, e.g. to verify their
+// address or reset their password.
+type EmailToken struct {
+	ID        bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    bson.ObjectID `bson:"user_id" json:"user_id"`
+	Purpose   string        `bson:"purpose" json:"purpose"`
+	Email     string        `bson:"email" json:"email"`
+	TokenHash string        `bson:"token_hash" json:"-"`
+	ExpiresAt time.Time     `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time    `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+}
+
+// LoginThrottle counts recent failed logins for one key, either an account
+// ("user:<username>") or a client address ("ip:<addr>").
+type LoginThrottle struct {
+	Key           string     `bson:"_id" json:"key"`
+	Failures      int        `bson:"failures" json:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at" json:"last_failure_at"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+}
+
+const (
+	LoginEventSuccess = "success"
+	LoginEventFailure = "failure"
+	LoginEventLockout = "lockout"
+	LoginEventUnlock  = "unlock"
+)
+
+type LoginEvent struct {
+	ID        bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    bson.ObjectID `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	Username  string        `bson:"username" json:"username"`
+	IP        string        `bson:"ip" json:"ip"`
+	UserAgent string        `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	Type      string        `bson:"type" json:"type"`
+	Reason    string        `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+}
+
+// OIDCState remembers a login started at an external provider until the
+// browser comes back to the callback.
+type OIDCState struct {
+	ID           bson.ObjectID `bson:"_id,omitempty"`
+	StateHash    string        `bson:"state_hash"`
+	Provider     string        `bson:"provider"`
+	Nonce        string        `bson:"nonce"`
+	CodeVerifier string        `bson:"code_verifier"`
+	ExpiresAt    time.Time     `bson:"expires_at"`
+	CreatedAt    time.Time     `bson:"created_at"`
+}
+
+// UsedMFAToken records the jti of an mfa_pending token that completed a
+// login, so the token cannot be replayed.
+type UsedMFAToken struct {
+	ID        string        `bson:"_id"`
+	UserID    bson.ObjectID `bson:"user_id"`
+	ExpiresAt time.Time     `bson:"expires_at"`
+}
+
+// Scopes an API key can be granted. Interactive sessions are not limited by
+// scopes.
+const (
+	ScopeProductsWrite       = "products:write"
+	ScopeInteractionsRead    = "interactions:read"
+	ScopeInteractionsWrite   = "interactions:write"
+	ScopeRecommendationsRead = "recommendations:read"
+)
+
+var APIKeyScopes = []string{ScopeProductsWrite, ScopeInteractionsRead, ScopeInteractionsWrite, ScopeRecommendationsRead}
+
+func ValidScope(scope string) bool {
+	for _, s := range APIKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKey is a personal access key for server-to-server clients. Only the
+// hash of the key is stored; Prefix is kept so users can tell keys apart.
+type APIKey struct {
+	ID         bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     bson.ObjectID `bson:"user_id" json:"user_id"`
+	Name       string        `bson:"name" json:"name"`
+	Prefix     string        `bson:"prefix" json:"prefix"`
+	KeyHash    string        `bson:"key_hash" json:"-"`
+	Scopes     []string      `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time     `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time    `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time    `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	LastUsedIP string        `bson:"last_used_ip,omitempty" json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time    `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+const (
+	SellerStatusPending   = "pending"
+	SellerStatusApproved  = "approved"
+	SellerStatusRejected  = "rejected"
+	SellerStatusSuspended = "suspended"
+)
+
+// Seller is a storefront on the marketplace, run by one user. A user applies
+// for a store and can list products once an admin approved it.
+type Seller struct {
+	ID           bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID       bson.ObjectID `bson:"user_id" json:"user_id"`
+	StoreName    string        `bson:"store_name" json:"store_name"`
+	Slug         string        `bson:"slug" json:"slug"`
+	Description  string        `bson:"description" json:"description"`
+	LogoURL      string        `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+	Status       string        `bson:"status" json:"status"`
+	StatusReason string        `bson:"status_reason,omitempty" json:"status_reason,omitempty"`
+	ApprovedAt   *time.Time    `bson:"approved_at,omitempty" json:"approved_at,omitempty"`
+	CreatedAt    time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+// Cart belongs either to a user or, before login, to a guest holding the
+// cart token whose hash is stored here.
+type Cart struct {
+	ID             bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID         bson.ObjectID `bson:"user_id,omitempty" json:"-"`
+	GuestTokenHash string        `bson:"guest_token_hash,omitempty" json:"-"`
+	Items          []CartItem    `bson:"items" json:"items"`
+	CouponCode     string        `bson:"coupon_code,omitempty" json:"coupon_code,omitempty"`
+	CreatedAt      time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time     `bson:"updated_at" json:"updated_at"`
+	ExpiresAt      *time.Time    `bson:"expires_at,omitempty" json:"-"`
+}
+
+// CartItem keeps the unit price the buyer was last shown.
+type CartItem struct {
+	ID        bson.ObjectID `bson:"_id" json:"id"`
+	ProductID bson.ObjectID `bson:"product_id" json:"product_id"`
+	VariantID bson.ObjectID `bson:"variant_id,omitempty" json:"variant_id,omitempty"`
+	Quantity  int           `bson:"quantity" json:"quantity"`
+	UnitPrice money.Money   `bson:"unit_price" json:"unit_price"`
+	AddedAt   time.Time     `bson:"added_at" json:"added_at"`
+}
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusPaid      = "paid"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+// Order is a checked-out cart. Items copy what the buyer saw at checkout, so
+// later product edits don't change past orders.
+type Order struct {
+	ID               bson.ObjectID       `bson:"_id,omitempty" json:"id"`
+	UserID           bson.ObjectID       `bson:"user_id,omitempty" json:"user_id,omitempty"`
+	SellerIDs        []bson.ObjectID     `bson:"seller_ids,omitempty" json:"-"`
+	Items            []OrderItem         `bson:"items" json:"items"`
+	ShippingAddress  Address             `bson:"shipping_address" json:"shipping_address"`
+	Subtotal         money.Money         `bson:"subtotal" json:"subtotal"`
+	Discount         money.Money         `bson:"discount,omitempty" json:"discount,omitzero"`
+	CouponCode       string              `bson:"coupon_code,omitempty" json:"coupon_code,omitempty"`
+	FreeShipping     bool                `bson:"free_shipping,omitempty" json:"free_shipping,omitempty"`
+	ShippingMethodID bson.ObjectID       `bson:"shipping_method_id,omitempty" json:"shipping_method_id,omitzero"`
+	ShippingMethod   string              `bson:"shipping_method,omitempty" json:"shipping_method,omitempty"`
+	Shipping         money.Money         `bson:"shipping,omitempty" json:"shipping,omitzero"`
+	Tax              money.Money         `bson:"tax,omitempty" json:"tax,omitzero"`
+	Total            money.Money         `bson:"total" json:"total"`
+	Currency         string              `bson:"currency" json:"currency"`
+	Status           string              `bson:"status" json:"status"`
+	StatusHistory    []OrderStatusChange `bson:"status_history" json:"status_history"`
+	TrackingNumber   string              `bson:"tracking_number,omitempty" json:"tracking_number,omitempty"`
+	CreatedAt        time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time           `bson:"updated_at" json:"updated_at"`
+	PaidAt           *time.Time          `bson:"paid_at,omitempty" json:"paid_at,omitempty"`
+	ShippedAt        *time.Time          `bson:"shipped_at,omitempty" json:"shipped_at,omitempty"`
+	DeliveredAt      *time.Time          `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	CancelledAt      *time.Time          `bson:"cancelled_at,omitempty" json:"cancelled_at,omitempty"`
+	// LedgerStatus is the last status booked in the ledger: paid once the
+	// sale is, refunded once its refund is.
+	LedgerStatus string `bson:"ledger_status,omitempty" json:"-"`
+	// ExpiresAt is when a pending order is cancelled if still unpaid.
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	RefundedAt *time.Time `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"`
+
+	// Display holds the amounts converted to the currency the client asked
+	// for; the order is charged in Currency.
+	Display map[string]money.Money `bson:"-" json:"display,omitempty"`
+}
+
+type OrderItem struct {
+	ProductID bson.ObjectID `bson:"product_id" json:"product_id"`
+	VariantID bson.ObjectID `bson:"variant_id,omitempty" json:"variant_id,omitempty"`
+	SellerID  bson.ObjectID `bson:"seller_id,omitempty" json:"seller_id,omitempty"`
+	Name      string        `bson:"name" json:"name"`
+	SKU       string        `bson:"sku,omitempty" json:"sku,omitempty"`
+	Size      string        `bson:"size,omitempty" json:"size,omitempty"`
+	Color     string        `bson:"color,omitempty" json:"color,omitempty"`
+	Quantity  int           `bson:"quantity" json:"quantity"`
+	UnitPrice money.Money   `bson:"unit_price" json:"unit_price"`
+	LineTotal money.Money   `bson:"line_total" json:"line_total"`
+	Discount  money.Money   `bson:"discount,omitempty" json:"discount,omitzero"` // share of the order discount
+	Tax       money.Money   `bson:"tax,omitempty" json:"tax,omitzero"`
+	// Returned counts the units in open or completed return requests.
+	Returned int `bson:"returned,omitempty" json:"returned,omitempty"`
+}
+
+type OrderStatusChange struct {
+	Status string        `bson:"status" json:"status"`
+	By     bson.ObjectID `bson:"by,omitempty" json:"by,omitempty"`
+	Note   string        `bson:"note,omitempty" json:"note,omitempty"`
+	At     time.Time     `bson:"at" json:"at"`
+}
+
+const (
+	PaymentStatusCreated    = "created"
+	PaymentStatusProcessing = "processing"
+	PaymentStatusSucceeded  = "succeeded"
+	PaymentStatusFailed     = "failed"
+	PaymentStatusRefunded   = "refunded"
+)
+
+// Payment is one attempt to pay an order. Amounts are in minor units.
+type Payment struct {
+	ID             bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrderID        bson.ObjectID `bson:"order_id" json:"order_id"`
+	UserID         bson.ObjectID `bson:"user_id,omitempty" json:"-"`
+	Attempt        int           `bson:"attempt" json:"attempt"`
+	Provider       string        `bson:"provider" json:"provider"`
+	IntentID       string        `bson:"intent_id,omitempty" json:"intent_id,omitempty"`
+	Amount         int64         `bson:"amount" json:"amount"`
+	AmountRefunded int64         `bson:"amount_refunded" json:"amount_refunded"`
+	Currency       string        `bson:"currency" json:"currency"`
+	Status         string        `bson:"status" json:"status"`
+	FailureReason  string        `bson:"failure_reason,omitempty" json:"failure_reason,omitempty"`
+	CreatedAt      time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+// PaymentEvent records a processed webhook so redeliveries are ignored.
+// ID is "<provider>:<event id>".
+type PaymentEvent struct {
+	ID         string    `bson:"_id" json:"id"`
+	Type       string    `bson:"type" json:"type"`
+	IntentID   string    `bson:"intent_id" json:"intent_id"`
+	ReceivedAt time.Time `bson:"received_at" json:"received_at"`
+}
+
+const (
+	CouponTypePercentage   = "percentage"
+	CouponTypeFixed        = "fixed"
+	CouponTypeFreeShipping = "free_shipping"
+)
+
+// Coupon is a discount code. Zero limits mean unlimited; empty Categories
+// or SellerIDs mean no restriction. Coupons made by a seller carry the
+// store in OwnerSellerID and only apply to its products.
+type Coupon struct {
+	ID            bson.ObjectID   `bson:"_id,omitempty" json:"id"`
+	Code          string          `bson:"code" json:"code"`
+	Type          string          `bson:"type" json:"type"`
+	Value         float64         `bson:"value,omitempty" json:"value,omitempty"`  // percent off
+	Amount        money.Money     `bson:"amount,omitempty" json:"amount,omitzero"` // fixed amount off
+	MaxDiscount   money.Money     `bson:"max_discount,omitempty" json:"max_discount,omitzero"`
+	MinOrderValue money.Money     `bson:"min_order_value,omitempty" json:"min_order_value,omitzero"`
+	StartsAt      *time.Time      `bson:"starts_at,omitempty" json:"starts_at,omitempty"`
+	EndsAt        *time.Time      `bson:"ends_at,omitempty" json:"ends_at,omitempty"`
+	UsageLimit    int             `bson:"usage_limit,omitempty" json:"usage_limit,omitempty"`
+	PerUserLimit  int             `bson:"per_user_limit,omitempty" json:"per_user_limit,omitempty"`
+	UsedCount     int             `bson:"used_count" json:"used_count"`
+	Categories    []string        `bson:"categories,omitempty" json:"categories,omitempty"`
+	SellerIDs     []bson.ObjectID `bson:"seller_ids,omitempty" json:"seller_ids,omitempty"`
+	OwnerSellerID bson.ObjectID   `bson:"owner_seller_id,omitempty" json:"owner_seller_id,omitempty"`
+	Active        bool            `bson:"active" json:"active"`
+	CreatedBy     bson.ObjectID   `bson:"created_by" json:"created_by"`
+	CreatedAt     time.Time       `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time       `bson:"updated_at" json:"updated_at"`
+}
+
+// CouponRedemption is one use of a coupon by an order.
+type CouponRedemption struct {
+	ID       bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	CouponID bson.ObjectID `bson:"coupon_id" json:"coupon_id"`
+	UserID   bson.ObjectID `bson:"user_id,omitempty" json:"-"`
+	OrderID  bson.ObjectID `bson:"order_id" json:"order_id"`
+	Discount money.Money   `bson:"discount" json:"discount"`
+	// Slot numbers a user's uses of a coupon with a per-user limit, from 1;
+	// it is unique per coupon and user, which caps the uses.
+	Slot      int       `bson:"slot,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+// TaxRule is a tax rate for a country, optionally narrowed to a region and
+// a product category. The most specific active rule for a line applies.
+// Shipping marks a rule as also taxing shipping; a category rule's flag
+// only counts in regions without a rule for all categories.
+type TaxRule struct {
+	ID        bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string        `bson:"name" json:"name"`
+	Country   string        `bson:"country" json:"country"`
+	Region    string        `bson:"region,omitempty" json:"region,omitempty"`
+	Category  string        `bson:"category,omitempty" json:"category,omitempty"`
+	Rate      float64       `bson:"rate" json:"rate"` // percent
+	Shipping  bool          `bson:"shipping,omitempty" json:"shipping,omitempty"`
+	Active    bool          `bson:"active" json:"active"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+// ShippingMethod delivers to a zone: the listed countries (any if empty),
+// optionally narrowed to regions. The cheapest matching rate applies, and
+// orders worth at least FreeOver ship free.
+type ShippingMethod struct {
+	ID        bson.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Name      string         `bson:"name" json:"name"`
+	Countries []string       `bson:"countries,omitempty" json:"countries,omitempty"`
+	Regions   []string       `bson:"regions,omitempty" json:"regions,omitempty"`
+	Rates     []ShippingRate `bson:"rates" json:"rates"`
+	FreeOver  money.Money    `bson:"free_over,omitempty" json:"free_over,omitzero"`
+	MinDays   int            `bson:"min_days,omitempty" json:"min_days,omitempty"`
+	MaxDays   int            `bson:"max_days,omitempty" json:"max_days,omitempty"`
+	Active    bool           `bson:"active" json:"active"`
+	CreatedAt time.Time      `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `bson:"updated_at" json:"updated_at"`
+}
+
+// ShippingRate prices a parcel within a weight bracket (MaxWeightGrams 0
+// means no upper bound) for orders worth at least MinOrderValue.
+type ShippingRate struct {
+	MinWeightGrams int         `bson:"min_weight_grams,omitempty" json:"min_weight_grams,omitempty"`
+	MaxWeightGrams int         `bson:"max_weight_grams,omitempty" json:"max_weight_grams,omitempty"`
+	MinOrderValue  money.Money `bson:"min_order_value,omitempty" json:"min_order_value,omitzero"`
+	Price          money.Money `bson:"price" json:"price"`
+}
+
+const (
+	ReturnStatusRequested = "requested"
+	ReturnStatusApproved  = "approved"
+	ReturnStatusRejected  = "rejected"
+	ReturnStatusReceived  = "received" // back at the store and inspected
+	ReturnStatusRefunded  = "refunded"
+)
+
+var ReturnReasons = []string{"damaged", "defective", "wrong_item", "not_as_described", "no_longer_needed", "other"}
+
+// ReturnRequest asks a store to take back lines of a delivered order. All
+// its items come from one seller, who approves it, inspects the goods and
+// refunds.
+type ReturnRequest struct {
+	ID            bson.ObjectID       `bson:"_id,omitempty" json:"id"`
+	OrderID       bson.ObjectID       `bson:"order_id" json:"order_id"`
+	UserID        bson.ObjectID       `bson:"user_id,omitempty" json:"-"`
+	SellerID      bson.ObjectID       `bson:"seller_id,omitempty" json:"seller_id,omitempty"`
+	Items         []ReturnItem        `bson:"items" json:"items"`
+	Reason        string              `bson:"reason" json:"reason"`
+	Comment       string              `bson:"comment,omitempty" json:"comment,omitempty"`
+	Photos        []string            `bson:"photos,omitempty" json:"photos,omitempty"`
+	Status        string              `bson:"status" json:"status"`
+	StatusHistory []OrderStatusChange `bson:"status_history" json:"status_history"`
+	RefundAmount  money.Money         `bson:"refund_amount" json:"refund_amount"`
+	CreatedAt     time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time           `bson:"updated_at" json:"updated_at"`
+	RefundedAt    *time.Time          `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"`
+	// LedgerPosted is set once the refund is booked in the ledger.
+	LedgerPosted bool `bson:"ledger_posted,omitempty" json:"-"`
+}
+
+// ReturnItem is a quantity of one order line. Refund is what the buyer paid
+// for those units: their share of the line after discount, with tax.
+type ReturnItem struct {
+	ProductID bson.ObjectID `bson:"product_id" json:"product_id"`
+	VariantID bson.ObjectID `bson:"variant_id,omitempty" json:"variant_id,omitempty"`
+	Name      string        `bson:"name" json:"name"`
+	Quantity  int           `bson:"quantity" json:"quantity"`
+	Refund    money.Money   `bson:"refund" json:"refund"`
+}
+
+// CommissionRule is the platform's cut of sales, in percent of the line
+// after discount. It may be narrowed to a seller, a category or both; the
+// most specific active rule applies.
+type CommissionRule struct {
+	ID        bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	SellerID  bson.ObjectID `bson:"seller_id,omitempty" json:"seller_id,omitzero"`
+	Category  string        `bson:"category,omitempty" json:"category,omitempty"`
+	Rate      float64       `bson:"rate" json:"rate"`
+	Active    bool          `bson:"active" json:"active"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time     `bson:"updated_at" json:"updated_at"`
+}
+
+// Ledger accounts. Seller earnings are kept per seller in
+// AccountSellerPayable, told apart by SellerID.
+const (
+	AccountCash          = "cash"           // money held from buyers
+	AccountCommission    = "commission"     // platform revenue
+	AccountShipping      = "shipping"       // shipping charged to buyers
+	AccountTaxPayable    = "tax_payable"    // tax collected for the authorities
+	AccountSellerPayable = "seller_payable" // owed to a seller
+)
+
+const (
+	LedgerKindSale   = "sale"
+	LedgerKindRefund = "refund"
+	LedgerKindPayout = "payout"
+)
+
+// LedgerEntry is one leg of a double-entry transaction: the legs sharing a
+// TxKey add up to zero. Amounts are debits when positive and credits when
+// negative, so a seller's balance is minus the sum of their payable legs.
+// Key makes posting a leg twice a no-op.
+type LedgerEntry struct {
+	ID        bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	Key       string        `bson:"key" json:"-"`
+	TxKey     string        `bson:"tx_key" json:"tx_key"`
+	TxLegs    int           `bson:"tx_legs,omitempty" json:"-"` // legs in the whole transaction
+	Kind      string        `bson:"kind" json:"kind"`
+	Account   string        `bson:"account" json:"account"`
+	SellerID  bson.ObjectID `bson:"seller_id,omitempty" json:"seller_id,omitzero"`
+	OrderID   bson.ObjectID `bson:"order_id,omitempty" json:"order_id,omitzero"`
+	ProductID bson.ObjectID `bson:"product_id,omitempty" json:"product_id,omitzero"`
+	VariantID bson.ObjectID `bson:"variant_id,omitempty" json:"variant_id,omitzero"`
+	ReturnID  bson.ObjectID `bson:"return_id,omitempty" json:"return_id,omitzero"`
+	PayoutID  bson.ObjectID `bson:"payout_id,omitempty" json:"payout_id,omitzero"`
+	Amount    money.Money   `bson:"amount" json:"amount"`
+	Memo      string        `bson:"memo,omitempty" json:"memo,omitempty"`
+	CreatedAt time.Time     `bson:"created_at" json:"created_at"`
+}
+
+const (
+	PayoutStatusRunning   = "running"
+	PayoutStatusCompleted = "completed"
+	PayoutStatusFailed    = "failed"
+)
+
+// PayoutBatch pays every seller their balance earned up to PeriodEnd. Only
+// one batch runs at a time.
+type PayoutBatch struct {
+	ID          bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	PeriodEnd   time.Time     `bson:"period_end" json:"period_end"`
+	Status      string        `bson:"status" json:"status"`
+	Payouts     []Payout      `bson:"payouts" json:"payouts"`
+	Total       money.Money   `bson:"total" json:"total"`
+	CreatedBy   bson.ObjectID `bson:"created_by" json:"created_by"`
+	CreatedAt   time.Time     `bson:"created_at" json:"created_at"`
+	CompletedAt *time.Time    `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+	Failure     string        `bson:"failure,omitempty" json:"failure,omitempty"`
+}
+
+type Payout struct {
+	SellerID bson.ObjectID `bson:"seller_id" json:"seller_id"`
+	Amount   money.Money   `bson:"amount" json:"amount"`
+}
@@ -0,0 +1,272 @@
+// Package money holds amounts as integer minor units with an ISO 4217
+// currency code, so prices add up without float rounding.
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Default is the store currency: what prices are kept and charged in.
+var Default = "KZT"
+
+// minor digits of currencies that do not use two
+var exponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+var ErrCurrencyMismatch = errors.New("money: currencies differ")
+
+// Exponent is the number of minor digits of the currency.
+func Exponent(currency string) int {
+	if e, ok := exponents[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// ValidCode reports whether s looks like an ISO 4217 code.
+func ValidCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+type Money struct {
+	Amount   int64  `bson:"amount" json:"amount"` // minor units
+	Currency string `bson:"currency" json:"currency"`
+}
+
+// New returns amount minor units of currency.
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// FromMajor converts an amount in major units, rounding half away from zero.
+func FromMajor(v float64, currency string) Money {
+	return Money{Amount: int64(math.Round(v * math.Pow10(Exponent(currency)))), Currency: currency}
+}
+
+// Zero is no money in the currency.
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Major is the amount in major units, for display and for legacy callers.
+func (m Money) Major() float64 {
+	return float64(m.Amount) / math.Pow10(Exponent(m.Currency))
+}
+
+// In reports whether m can be used as an amount in currency: it is in it,
+// or it is zero. Callers check this where stored amounts meet the store
+// currency, so arithmetic never mixes currencies.
+func (m Money) In(currency string) bool {
+	return m.Amount == 0 || m.Currency == "" || m.Currency == currency
+}
+
+// Check returns ErrCurrencyMismatch unless every amount is In currency.
+func Check(currency string, amounts ...Money) error {
+	for _, a := range amounts {
+		if !a.In(currency) {
+			return fmt.Errorf("%w: %s is not in %s", ErrCurrencyMismatch, a, currency)
+		}
+	}
+	return nil
+}
+
+// Add returns m+o. A zero amount takes the other's currency. Adding amounts
+// in different currencies is a bug in the caller and panics rather than
+// produce a mislabelled sum: amounts from outside are run through Check
+// first, or added with AddChecked.
+func (m Money) Add(o Money) Money {
+	return must(m.AddChecked(o))
+}
+
+func (m Money) Sub(o Money) Money {
+	return must(m.SubChecked(o))
+}
+
+// AddChecked returns m+o, or ErrCurrencyMismatch if they are non-zero
+// amounts in different currencies.
+func (m Money) AddChecked(o Money) (Money, error) {
+	if mixed(m, o) {
+		return m, fmt.Errorf("%w: %s + %s", ErrCurrencyMismatch, m, o)
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: pick(m, o)}, nil
+}
+
+// SubChecked returns m-o, or ErrCurrencyMismatch if they are non-zero
+// amounts in different currencies.
+func (m Money) SubChecked(o Money) (Money, error) {
+	if mixed(m, o) {
+		return m, fmt.Errorf("%w: %s - %s", ErrCurrencyMismatch, m, o)
+	}
+	return Money{Amount: m.Amount - o.Amount, Currency: pick(m, o)}, nil
+}
+
+func must(m Money, err error) Money {
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// pick is the currency of a sum of amounts that are not mixed: the
+// non-zero one's, or whichever is set.
+func pick(m, o Money) string {
+	if m.Currency == "" || (m.Amount == 0 && o.Currency != "") {
+		return o.Currency
+	}
+	return m.Currency
+}
+
+// mixed reports whether m and o are non-zero amounts in different
+// currencies.
+func mixed(m, o Money) bool {
+	return !o.In(m.Currency) && !m.In(o.Currency)
+}
+
+// Mul returns m times n.
+func (m Money) Mul(n int) Money {
+	return Money{Amount: m.Amount * int64(n), Currency: m.Currency}
+}
+
+// Percent returns p percent of m, rounded to the nearest minor unit.
+func (m Money) Percent(p float64) Money {
+	return Money{Amount: int64(math.Round(float64(m.Amount) * p / 100)), Currency: m.Currency}
+}
+
+// Less reports whether m is below o. Amounts in different currencies do
+// not compare; Less is false for them, like for NaN.
+func (m Money) Less(o Money) bool {
+	if mixed(m, o) {
+		return false
+	}
+	return m.Amount < o.Amount
+}
+
+// Min returns the smaller of m and o, or an error if they are in different
+// currencies.
+func Min(m, o Money) (Money, error) {
+	if mixed(m, o) {
+		return m, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m, o)
+	}
+	if o.Less(m) {
+		return o, nil
+	}
+	return m, nil
+}
+
+// Allocate splits m over the weights pro rata. Negative weights count as
+// zero and get nothing. The parts add up to m exactly, with rounding
+// leftovers going to the first weighted parts, unless no weight is
+// positive: then every part is zero.
+func (m Money) Allocate(weights []int64) []Money {
+	parts := make([]Money, len(weights))
+	var total int64
+	for _, w := range weights {
+		total += max(w, 0)
+	}
+	if total == 0 {
+		for i := range parts {
+			parts[i] = Zero(m.Currency)
+		}
+		return parts
+	}
+	left := m.Amount
+	for i, w := range weights {
+		share := int64(float64(m.Amount) * float64(max(w, 0)) / float64(total))
+		parts[i] = Money{Amount: share, Currency: m.Currency}
+		left -= share
+	}
+	for i := 0; left != 0; i = (i + 1) % len(parts) {
+		if weights[i] <= 0 {
+			continue
+		}
+		step := int64(1)
+		if left < 0 {
+			step = -1
+		}
+		parts[i].Amount += step
+		left -= step
+	}
+	return parts
+}
+
+// String formats m like "1500.00 KZT".
+func (m Money) String() string {
+	return strconv.FormatFloat(m.Major(), 'f', Exponent(m.Currency), 64) + " " + m.Currency
+}
+
+// UnmarshalJSON takes either {"amount": <minor units>, "currency": "..."}
+// or a bare number in major units of the store currency, as the API took
+// before amounts had a currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v float64
+	if err := json.Unmarshal(data, &v); err == nil {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("money: invalid amount")
+		}
+		*m = FromMajor(v, Default)
+		return nil
+	}
+	type plain Money
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	p.Currency = strings.ToUpper(p.Currency)
+	if p.Currency == "" {
+		p.Currency = Default
+	}
+	if !ValidCode(p.Currency) {
+		return errors.New("money: invalid currency")
+	}
+	*m = Money(p)
+	return nil
+}
+
+// UnmarshalBSONValue also reads the plain doubles stored before amounts
+// had a currency; those are major units of the store currency.
+func (m *Money) UnmarshalBSONValue(typ byte, data []byte) error {
+	rv := bson.RawValue{Type: bson.Type(typ), Value: data}
+	switch rv.Type {
+	case bson.TypeDouble:
+		*m = FromMajor(rv.Double(), Default)
+	case bson.TypeInt32:
+		*m = FromMajor(float64(rv.Int32()), Default)
+	case bson.TypeInt64:
+		*m = FromMajor(float64(rv.Int64()), Default)
+	case bson.TypeNull:
+		*m = Money{}
+	case bson.TypeEmbeddedDocument:
+		type plain Money
+		var p plain
+		if err := bson.Unmarshal(rv.Value, &p); err != nil {
+			return err
+		}
+		*m = Money(p)
+	default:
+		return fmt.Errorf("money: cannot decode BSON %s", rv.Type)
+	}
+	return nil
+}
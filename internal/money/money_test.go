@@ -0,0 +1,135 @@
+package money
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func amounts(parts []Money) []int64 {
+	out := make([]int64, len(parts))
+	for i, p := range parts {
+		out[i] = p.Amount
+	}
+	return out
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{"even", 300, []int64{1, 1, 1}, []int64{100, 100, 100}},
+		{"pro rata", 1000, []int64{3000, 1000}, []int64{750, 250}},
+		{"remainder to first parts", 100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{"remainder of two", 200, []int64{1, 1, 1}, []int64{67, 67, 66}},
+		{"negative amount", -100, []int64{1, 1, 1}, []int64{-34, -33, -33}},
+		{"zero weight gets nothing", 101, []int64{0, 1, 1}, []int64{0, 51, 50}},
+		{"remainder skips zero weights", 10, []int64{0, 3, 0, 3, 3}, []int64{0, 4, 0, 3, 3}},
+		{"negative weight counts as zero", 100, []int64{-5, 1, 1}, []int64{0, 50, 50}},
+		{"all weights zero", 100, []int64{0, 0}, []int64{0, 0}},
+		{"all weights negative", 100, []int64{-1, -2}, []int64{0, 0}},
+		{"zero amount", 0, []int64{2, 5}, []int64{0, 0}},
+		{"single part", 999, []int64{7}, []int64{999}},
+		{"no parts", 100, nil, []int64{}},
+		{"amount smaller than parts", 2, []int64{1, 1, 1, 1}, []int64{1, 1, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := New(tt.amount, "KZT").Allocate(tt.weights)
+			if got := amounts(parts); !slices.Equal(got, tt.want) {
+				t.Fatalf("Allocate(%d, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+			}
+			for _, p := range parts {
+				if p.Currency != "KZT" {
+					t.Errorf("part currency %q, want KZT", p.Currency)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateAddsUp(t *testing.T) {
+	weights := []int64{1999, 1, 333, 0, 7, 12345}
+	for _, amount := range []int64{1, 7, 99, 1000, 123457, -4567} {
+		var sum int64
+		for _, p := range New(amount, "KZT").Allocate(weights) {
+			sum += p.Amount
+		}
+		if sum != amount {
+			t.Errorf("parts of %d add up to %d", amount, sum)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount int64
+		pct    float64
+		want   int64
+	}{
+		{10000, 12, 1200},
+		{1000, 12.5, 125},
+		{999, 10, 100},  // 99.9 rounds up
+		{994, 10, 99},   // 99.4 rounds down
+		{5, 10, 1},      // 0.5 rounds half away from zero
+		{15, 10, 2},     // 1.5
+		{-5, 10, -1},    // -0.5
+		{-994, 10, -99}, // -99.4
+		{333, 33.333, 111},
+		{0, 50, 0},
+		{1234, 0, 0},
+		{1234, 100, 1234},
+	}
+	for _, tt := range tests {
+		got := New(tt.amount, "KZT").Percent(tt.pct)
+		if got.Amount != tt.want || got.Currency != "KZT" {
+			t.Errorf("Percent(%d, %v) = %v, want %d KZT", tt.amount, tt.pct, got, tt.want)
+		}
+	}
+}
+
+func TestMixedCurrencies(t *testing.T) {
+	kzt, usd := New(500, "KZT"), New(100, "USD")
+
+	if _, err := Min(kzt, usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Min of KZT and USD: err = %v, want ErrCurrencyMismatch", err)
+	}
+	if kzt.Less(usd) || usd.Less(kzt) {
+		t.Error("amounts in different currencies compare")
+	}
+	if err := Check("KZT", kzt, Zero("USD"), Money{}); err != nil {
+		t.Errorf("Check with zero amounts: %v", err)
+	}
+	if err := Check("KZT", kzt, usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Check with USD: err = %v, want ErrCurrencyMismatch", err)
+	}
+
+	// a zero amount adds to anything
+	if got := Zero("USD").Add(kzt); got != kzt {
+		t.Errorf("zero USD + %v = %v", kzt, got)
+	}
+	if got, err := kzt.SubChecked(Zero("USD")); err != nil || got != kzt {
+		t.Errorf("%v - zero USD = %v, %v", kzt, got, err)
+	}
+	if _, err := kzt.AddChecked(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("AddChecked of KZT and USD: err = %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := kzt.SubChecked(usd); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("SubChecked of KZT and USD: err = %v, want ErrCurrencyMismatch", err)
+	}
+	func() {
+		defer func() {
+			if err, _ := recover().(error); !errors.Is(err, ErrCurrencyMismatch) {
+				t.Errorf("Add of KZT and USD recovered %v, want ErrCurrencyMismatch", err)
+			}
+		}()
+		got := kzt.Add(usd)
+		t.Errorf("Add of KZT and USD returned %v", got)
+	}()
+	if got, err := Min(Zero("USD"), kzt); err != nil || got != Zero("USD") {
+		t.Errorf("Min(0 USD, %v) = %v, %v", kzt, got, err)
+	}
+}
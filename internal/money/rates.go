@@ -0,0 +1,98 @@
+package money
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownCurrency = errors.New("money: unknown currency")
+
+// Rates is an exchange-rate table against the store currency: one unit of
+// Default is worth Rates[c] units of c. Default itself is always 1.
+type Rates map[string]float64
+
+// Has reports whether amounts can be shown in currency.
+func (r Rates) Has(currency string) bool {
+	if currency == Default {
+		return true
+	}
+	_, ok := r[currency]
+	return ok
+}
+
+// Currencies lists the currencies the table converts to, sorted.
+func (r Rates) Currencies() []string {
+	out := []string{Default}
+	for c := range r {
+		if c != Default {
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out[1:])
+	return out
+}
+
+func (r Rates) rate(currency string) (float64, error) {
+	if currency == Default {
+		return 1, nil
+	}
+	if rate, ok := r[currency]; ok {
+		return rate, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, currency)
+}
+
+// Convert returns m in currency to, rounded to its minor unit. The result
+// is for display; charges stay in the store currency.
+func (r Rates) Convert(m Money, to string) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	from, err := r.rate(m.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	rate, err := r.rate(to)
+	if err != nil {
+		return Money{}, err
+	}
+	return FromMajor(m.Major()/from*rate, to), nil
+}
+
+// FromEnv configures the store currency from STORE_CURRENCY and reads the
+// rate table from EXCHANGE_RATES, a list like "USD=0.0021,EUR=0.0019".
+func FromEnv() (Rates, error) {
+	if c := strings.ToUpper(strings.TrimSpace(os.Getenv("STORE_CURRENCY"))); c != "" {
+		if !ValidCode(c) {
+			return nil, fmt.Errorf("STORE_CURRENCY: invalid currency %q", c)
+		}
+		Default = c
+	}
+	return ParseRates(os.Getenv("EXCHANGE_RATES"))
+}
+
+// ParseRates reads a "CODE=rate,..." list.
+func ParseRates(s string) (Rates, error) {
+	rates := Rates{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(part, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || !ValidCode(code) {
+			return nil, fmt.Errorf("EXCHANGE_RATES: invalid entry %q", part)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("EXCHANGE_RATES: invalid rate for %s", code)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
@@ -0,0 +1,271 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payment methods understood by the fake provider. Anything else succeeds.
+const (
+	FakeMethodSuccess = "pm_fake_success"
+	FakeMethodDecline = "pm_fake_decline"
+	FakeMethodAsync   = "pm_fake_async"
+)
+
+// FakeSignatureHeader carries "t=<unix>,v1=<hex hmac-sha256 of t.body>".
+const FakeSignatureHeader = "X-Fake-Signature"
+
+const fakeSignatureTolerance = 5 * time.Minute
+
+// Fake is an in-process provider for local runs and tests. Outcomes depend
+// only on the payment method, so runs are reproducible. IDs are random, as
+// webhook events are deduplicated by ID across restarts. Async payments stay processing until Settle is called.
+// Webhooks are posted to WebhookURL when it is set.
+type Fake struct {
+	Secret     []byte
+	WebhookURL string
+	Client     *http.Client
+
+	mu      sync.Mutex
+	intents map[string]*Intent
+	keys    map[string]string // idempotency key -> intent or refund id
+	refunds map[string]*Refund
+}
+
+func NewFake(secret []byte, webhookURL string) *Fake {
+	return &Fake{
+		Secret:     secret,
+		WebhookURL: webhookURL,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		intents:    map[string]*Intent{},
+		keys:       map[string]string{},
+		refunds:    map[string]*Refund{},
+	}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) nextID(prefix string) string {
+	return prefix + "_fake_" + strings.ToLower(rand.Text())
+}
+
+func (f *Fake) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.keys["intent:"+req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		in := *f.intents[id]
+		return &in, nil
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+
+	in := &Intent{ID: f.nextID("pi"), Reference: req.Reference, Amount: req.Amount, Currency: req.Currency}
+	switch req.PaymentMethod {
+	case FakeMethodDecline:
+		in.Status = StatusFailed
+		in.FailureReason = "card_declined"
+	case FakeMethodAsync:
+		in.Status = StatusProcessing
+	default:
+		in.Status = StatusSucceeded
+		if req.CaptureManually {
+			in.Status = StatusRequiresCapture
+		}
+	}
+	f.intents[in.ID] = in
+	if req.IdempotencyKey != "" {
+		f.keys["intent:"+req.IdempotencyKey] = in.ID
+	}
+	f.notifyLocked(in, "")
+
+	out := *in
+	return &out, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, intentID string) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	if in.Status != StatusRequiresCapture {
+		return nil, ErrNotCapturable
+	}
+	in.Status = StatusSucceeded
+	f.notifyLocked(in, "")
+
+	out := *in
+	return &out, nil
+}
+
+// Settle finishes an async payment as succeeded or failed.
+func (f *Fake) Settle(ctx context.Context, intentID string, succeed bool) (*Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	if in.Status != StatusProcessing {
+		return nil, fmt.Errorf("payment is %s, not processing", in.Status)
+	}
+	if succeed {
+		in.Status = StatusSucceeded
+	} else {
+		in.Status = StatusFailed
+		in.FailureReason = "async_payment_failed"
+	}
+	f.notifyLocked(in, "")
+
+	out := *in
+	return &out, nil
+}
+
+func (f *Fake) Refund(ctx context.Context, intentID string, amount int64, idempotencyKey string) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.keys["refund:"+idempotencyKey]; ok && idempotencyKey != "" {
+		re := *f.refunds[id]
+		return &re, nil
+	}
+	in, ok := f.intents[intentID]
+	if !ok {
+		return nil, ErrUnknownIntent
+	}
+	if in.Status != StatusSucceeded || amount <= 0 || amount > in.Amount-in.AmountRefunded {
+		return nil, ErrNotRefundable
+	}
+	in.AmountRefunded += amount
+	re := &Refund{ID: f.nextID("re"), IntentID: in.ID, Amount: amount, Status: StatusSucceeded}
+	f.refunds[re.ID] = re
+	if idempotencyKey != "" {
+		f.keys["refund:"+idempotencyKey] = re.ID
+	}
+	f.notifyLocked(in, EventRefundSucceeded)
+
+	out := *re
+	return &out, nil
+}
+
+// notifyLocked posts the webhook for the intent's current state, from a
+// goroutine like a real gateway would. Processing intents send nothing.
+func (f *Fake) notifyLocked(in *Intent, eventType string) {
+	if eventType == "" {
+		switch in.Status {
+		case StatusSucceeded:
+			eventType = EventPaymentSucceeded
+		case StatusFailed:
+			eventType = EventPaymentFailed
+		default:
+			return
+		}
+	}
+	if f.WebhookURL == "" {
+		return
+	}
+	ev := Event{
+		ID:             f.nextID("evt"),
+		Type:           eventType,
+		IntentID:       in.ID,
+		Reference:      in.Reference,
+		Amount:         in.Amount,
+		AmountRefunded: in.AmountRefunded,
+		FailureReason:  in.FailureReason,
+		Created:        time.Now().UTC(),
+	}
+	go func() {
+		if err := f.deliver(ev); err != nil {
+			log.Printf("fake payments: delivering %s: %v", ev.ID, err)
+		}
+	}()
+}
+
+func (f *Fake) deliver(ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FakeSignatureHeader, f.Sign(time.Now(), body))
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for body sent at t.
+func (f *Fake) Sign(t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + f.mac(ts, body)
+}
+
+func (f *Fake) mac(ts string, body []byte) string {
+	m := hmac.New(sha256.New, f.Secret)
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (f *Fake) VerifyWebhook(header http.Header, body []byte) (*Event, error) {
+	var ts, sig string
+	for _, part := range strings.Split(header.Get(FakeSignatureHeader), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return nil, ErrInvalidSignature
+	}
+	if math.Abs(time.Since(time.Unix(unix, 0)).Seconds()) > fakeSignatureTolerance.Seconds() {
+		return nil, ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(f.mac(ts, body))) {
+		return nil, ErrInvalidSignature
+	}
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, fmt.Errorf("decoding webhook: %w", err)
+	}
+	return &ev, nil
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
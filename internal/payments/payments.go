@@ -0,0 +1,108 @@
+// Package payments abstracts the payment gateway behind Provider. Amounts
+// are integer minor units (e.g. tiyn for KZT).
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	StatusProcessing      = "processing"
+	StatusRequiresCapture = "requires_capture"
+	StatusSucceeded       = "succeeded"
+	StatusFailed          = "failed"
+)
+
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventRefundSucceeded  = "refund.succeeded"
+)
+
+var (
+	ErrUnknownIntent    = errors.New("unknown payment intent")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrNotCapturable    = errors.New("payment cannot be captured")
+	ErrNotRefundable    = errors.New("payment cannot be refunded for that amount")
+)
+
+// IntentRequest asks the provider to take a payment. Reference is echoed
+// back in webhook events so they can be matched to our records; requests
+// with the same IdempotencyKey return the same intent.
+type IntentRequest struct {
+	Reference       string
+	Amount          int64
+	Currency        string
+	PaymentMethod   string
+	CaptureManually bool
+	IdempotencyKey  string
+}
+
+// Intent is the provider's view of one payment.
+type Intent struct {
+	ID             string
+	Reference      string
+	Status         string
+	Amount         int64
+	AmountRefunded int64
+	Currency       string
+	FailureReason  string
+}
+
+type Refund struct {
+	ID       string
+	IntentID string
+	Amount   int64
+	Status   string
+}
+
+// Event is a verified webhook notification.
+type Event struct {
+	ID             string    `json:"id"`
+	Type           string    `json:"type"`
+	IntentID       string    `json:"intent_id"`
+	Reference      string    `json:"reference"`
+	Amount         int64     `json:"amount"`
+	AmountRefunded int64     `json:"amount_refunded"`
+	FailureReason  string    `json:"failure_reason,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+// Provider is a payment gateway.
+type Provider interface {
+	Name() string
+	CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error)
+	Capture(ctx context.Context, intentID string) (*Intent, error)
+	Refund(ctx context.Context, intentID string, amount int64, idempotencyKey string) (*Refund, error)
+	// VerifyWebhook checks the signature of a webhook request and decodes it.
+	VerifyWebhook(header http.Header, body []byte) (*Event, error)
+}
+
+// FromEnv builds the provider selected by PAYMENT_PROVIDER, which must be
+// set. Only "fake" exists so far; it approves any payment method, so it is
+// never picked unless asked for:
+//
+//	FAKE_PAYMENTS_SECRET - webhook signing secret, random if unset
+//	PAYMENT_WEBHOOK_URL  - where the fake delivers its webhooks
+func FromEnv() (Provider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "fake":
+		secret := os.Getenv("FAKE_PAYMENTS_SECRET")
+		if secret == "" {
+			var err error
+			if secret, err = randomSecret(); err != nil {
+				return nil, err
+			}
+		}
+		return NewFake([]byte(secret), os.Getenv("PAYMENT_WEBHOOK_URL")), nil
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q", name)
+	}
+}
@@ -3,6 +3,7 @@ package routes
 import (
 	"PROJECTTEST/internal/handlers"
 	"PROJECTTEST/internal/middleware"
+	"PROJECTTEST/internal/models"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -17,24 +18,145 @@ func InitRoutes() *mux.Router {
 			w.WriteHeader(http.StatusOK)
 	})
 	r.HandleFunc("/", handlers.HomePage).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
 	r.HandleFunc("/api/auth/register", handlers.RegisterHandler).Methods("POST")
 	r.HandleFunc("/api/auth/login", handlers.LoginHandler).Methods("POST")
+	r.HandleFunc("/api/auth/login/2fa", handlers.LoginTOTPHandler).Methods("POST")
+	r.Handle("/api/auth/2fa/enroll", middleware.SessionOnly(http.HandlerFunc(handlers.EnrollTOTPHandler))).Methods("POST")
+	r.Handle("/api/auth/2fa/enable", middleware.SessionOnly(http.HandlerFunc(handlers.EnableTOTPHandler))).Methods("POST")
+	r.Handle("/api/auth/2fa/disable", middleware.SessionOnly(http.HandlerFunc(handlers.DisableTOTPHandler))).Methods("POST")
+	r.HandleFunc("/api/auth/oidc/{provider}/start", handlers.OIDCStartHandler).Methods("GET")
+	r.HandleFunc("/api/auth/oidc/{provider}/callback", handlers.OIDCCallbackHandler).Methods("GET")
+	r.HandleFunc("/api/auth/refresh", handlers.RefreshHandler).Methods("POST")
+	r.HandleFunc("/api/auth/email/verify", handlers.VerifyEmailHandler).Methods("POST")
+	r.Handle("/api/auth/email/resend", middleware.SessionOnly(http.HandlerFunc(handlers.ResendVerificationHandler))).Methods("POST")
+	r.HandleFunc("/api/auth/password/forgot", handlers.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/api/auth/password/reset", handlers.ResetPasswordHandler).Methods("POST")
+	r.Handle("/api/auth/logout", middleware.SessionOnly(http.HandlerFunc(handlers.LogoutHandler))).Methods("POST")
 	r.Handle("/api/auth/me", middleware.AuthMiddleware(http.HandlerFunc(handlers.MeHandler))).Methods("GET")
+	r.Handle("/api/auth/me", middleware.SessionOnly(http.HandlerFunc(handlers.UpdateMeHandler))).Methods("PATCH")
+	r.Handle("/api/auth/me", middleware.SessionOnly(http.HandlerFunc(handlers.DeleteMeHandler))).Methods("DELETE")
+	r.Handle("/api/auth/api-keys", middleware.SessionOnly(http.HandlerFunc(handlers.CreateAPIKeyHandler))).Methods("POST")
+	r.Handle("/api/auth/api-keys", middleware.SessionOnly(http.HandlerFunc(handlers.ListAPIKeysHandler))).Methods("GET")
+	r.Handle("/api/auth/api-keys/{id}", middleware.SessionOnly(http.HandlerFunc(handlers.RevokeAPIKeyHandler))).Methods("DELETE")
+	r.Handle("/api/auth/me/export", middleware.SessionOnly(http.HandlerFunc(handlers.ExportMeHandler))).Methods("GET")
 
-	r.HandleFunc("/api/products", handlers.ListProductsHandler).Methods("GET")
+	r.HandleFunc("/api/currencies", handlers.CurrenciesHandler).Methods("GET")
+
+	sellerOrAdmin := middleware.RequireRole(models.RoleSeller, models.RoleAdmin)
+	r.Handle("/api/products", middleware.OptionalAuth(http.HandlerFunc(handlers.ListProductsHandler))).Methods("GET")
 	r.HandleFunc("/api/products/search", handlers.ProductsSearchHandler).Methods("GET")
+	r.Handle("/api/products/low-stock", sellerOrAdmin(http.HandlerFunc(handlers.LowStockHandler))).Methods("GET")
 	r.HandleFunc("/api/products/{id}", handlers.ProductDetailHandler).Methods("GET")
+	r.HandleFunc("/api/products/{id}/price-history", handlers.PriceHistoryHandler).Methods("GET")
 	r.HandleFunc("/api/products/category/{category}", handlers.ProductsByCategoryHandler).Methods("GET")
 
-	r.Handle("/api/interactions/view", middleware.AuthMiddleware(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
-	r.Handle("/api/interactions/like", middleware.AuthMiddleware(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
-	r.Handle("/api/interactions/purchase", middleware.AuthMiddleware(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
-	r.Handle("/api/user/interactions", middleware.AuthMiddleware(http.HandlerFunc(handlers.GetUserInteractionsHandler))).Methods("GET")
+	manageProducts := func(h http.HandlerFunc) http.Handler {
+		return sellerOrAdmin(middleware.RequireScope(models.ScopeProductsWrite)(h))
+	}
+	r.Handle("/api/products", manageProducts(handlers.CreateProductHandler)).Methods("POST")
+	r.Handle("/api/products/{id}", manageProducts(handlers.UpdateProductHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/products/{id}", manageProducts(handlers.DeleteProductHandler)).Methods("DELETE")
+	r.Handle("/api/products/{id}/stock", manageProducts(handlers.UpdateStockHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/products/{id}/variants", manageProducts(handlers.CreateVariantHandler)).Methods("POST")
+	r.Handle("/api/products/{id}/variants/{variantId}", manageProducts(handlers.UpdateVariantHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/products/{id}/variants/{variantId}", manageProducts(handlers.DeleteVariantHandler)).Methods("DELETE")
+
+	manageCoupons := func(h http.HandlerFunc) http.Handler { return middleware.SessionOnly(sellerOrAdmin(h)) }
+	r.Handle("/api/coupons", manageCoupons(handlers.CreateCouponHandler)).Methods("POST")
+	r.Handle("/api/coupons", manageCoupons(handlers.ListCouponsHandler)).Methods("GET")
+	r.Handle("/api/coupons/{id}", manageCoupons(handlers.UpdateCouponHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/coupons/{id}", manageCoupons(handlers.DeleteCouponHandler)).Methods("DELETE")
+
+	cart := func(h http.HandlerFunc) http.Handler { return middleware.OptionalAuth(h) }
+	r.Handle("/api/cart", cart(handlers.GetCartHandler)).Methods("GET")
+	r.Handle("/api/cart", cart(handlers.ClearCartHandler)).Methods("DELETE")
+	r.Handle("/api/cart/items", cart(handlers.AddCartItemHandler)).Methods("POST")
+	r.Handle("/api/cart/items/{itemId}", cart(handlers.UpdateCartItemHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/cart/items/{itemId}", cart(handlers.RemoveCartItemHandler)).Methods("DELETE")
+	r.Handle("/api/cart/coupon", cart(handlers.ApplyCartCouponHandler)).Methods("POST")
+	r.Handle("/api/cart/coupon", cart(handlers.RemoveCartCouponHandler)).Methods("DELETE")
+	r.Handle("/api/cart/quote", cart(handlers.QuoteHandler)).Methods("POST")
+	r.Handle("/api/cart/merge", middleware.SessionOnly(http.HandlerFunc(handlers.MergeCartHandler))).Methods("POST")
+
+	r.Handle("/api/orders", middleware.SessionOnly(http.HandlerFunc(handlers.CheckoutHandler))).Methods("POST")
+	r.Handle("/api/orders", middleware.SessionOnly(http.HandlerFunc(handlers.ListMyOrdersHandler))).Methods("GET")
+	r.Handle("/api/orders/{id}", middleware.SessionOnly(http.HandlerFunc(handlers.GetOrderHandler))).Methods("GET")
+	r.Handle("/api/orders/{id}/cancel", middleware.SessionOnly(http.HandlerFunc(handlers.CancelOrderHandler))).Methods("POST")
+	r.Handle("/api/orders/{id}/pay", middleware.SessionOnly(http.HandlerFunc(handlers.PayOrderHandler))).Methods("POST")
+	r.Handle("/api/orders/{id}/payments", middleware.SessionOnly(http.HandlerFunc(handlers.ListOrderPaymentsHandler))).Methods("GET")
+	r.Handle("/api/orders/{id}/returns", middleware.SessionOnly(http.HandlerFunc(handlers.CreateReturnHandler))).Methods("POST")
+	r.Handle("/api/returns", middleware.SessionOnly(http.HandlerFunc(handlers.ListMyReturnsHandler))).Methods("GET")
+	r.Handle("/api/returns/{id}", middleware.SessionOnly(http.HandlerFunc(handlers.GetReturnHandler))).Methods("GET")
+	r.HandleFunc("/api/payments/webhook/{provider}", handlers.PaymentWebhookHandler).Methods("POST")
+
+	// a store handles money just like the seller role does
+	ownStore := func(h http.HandlerFunc) http.Handler { return middleware.SessionOnly(middleware.RequireTwoFactor(h)) }
+	r.Handle("/api/sellers/me/orders", ownStore(handlers.SellerOrdersHandler)).Methods("GET")
+	r.Handle("/api/sellers/me/orders/{id}/status", ownStore(handlers.SellerUpdateOrderHandler)).Methods("POST")
+	r.Handle("/api/sellers/me/returns", ownStore(handlers.SellerReturnsHandler)).Methods("GET")
+	r.Handle("/api/sellers/me/returns/{id}/status", ownStore(handlers.SellerUpdateReturnHandler)).Methods("POST")
+	r.Handle("/api/sellers/me/balance", ownStore(handlers.SellerBalanceHandler)).Methods("GET")
+	r.Handle("/api/sellers/me/statement", ownStore(handlers.SellerStatementHandler)).Methods("GET")
+	r.Handle("/api/sellers/apply", middleware.SessionOnly(http.HandlerFunc(handlers.ApplySellerHandler))).Methods("POST")
+	r.Handle("/api/sellers/me", middleware.AuthMiddleware(http.HandlerFunc(handlers.MySellerHandler))).Methods("GET")
+	r.Handle("/api/sellers/me", ownStore(handlers.UpdateMySellerHandler)).Methods("PATCH")
+	r.HandleFunc("/api/sellers/{slug}", handlers.SellerStorefrontHandler).Methods("GET")
+	r.HandleFunc("/api/sellers/{slug}/products", handlers.SellerProductsHandler).Methods("GET")
+
+	writeInteractions := middleware.RequireScope(models.ScopeInteractionsWrite)
+	r.Handle("/api/interactions/view", writeInteractions(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
+	r.Handle("/api/interactions/like", writeInteractions(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
+	r.Handle("/api/interactions/purchase", writeInteractions(http.HandlerFunc(handlers.PostInteraction))).Methods("POST")
+	r.Handle("/api/user/interactions", middleware.RequireScope(models.ScopeInteractionsRead)(http.HandlerFunc(handlers.GetUserInteractionsHandler))).Methods("GET")
+
+	r.Handle("/api/recommendations", middleware.RequireScope(models.ScopeRecommendationsRead)(http.HandlerFunc(handlers.RecommendationsHandler))).Methods("GET")
 
-	r.Handle("/api/recommendations", middleware.AuthMiddleware(http.HandlerFunc(handlers.RecommendationsHandler))).Methods("GET")
+	adminOnly := middleware.RequireRole(models.RoleAdmin)
+	// admin consoles are for people, not for API keys
+	admin := func(h http.HandlerFunc) http.Handler { return middleware.SessionOnly(adminOnly(h)) }
+	r.Handle("/api/admin/users", admin(handlers.AdminListUsersHandler)).Methods("GET")
+	r.Handle("/api/admin/users/{id}", admin(handlers.AdminGetUserHandler)).Methods("GET")
+	r.Handle("/api/admin/users/{id}", admin(handlers.AdminDeleteUserHandler)).Methods("DELETE")
+	r.Handle("/api/admin/users/{id}/suspend", admin(handlers.AdminSuspendUserHandler)).Methods("POST")
+	r.Handle("/api/admin/users/{id}/reactivate", admin(handlers.AdminReactivateUserHandler)).Methods("POST")
+	r.Handle("/api/admin/users/{id}/roles", admin(handlers.AdminSetRolesHandler)).Methods("PUT")
+	r.Handle("/api/admin/users/{id}/password-reset", admin(handlers.AdminForcePasswordResetHandler)).Methods("POST")
+	r.Handle("/api/admin/users/{id}/unlock", admin(handlers.UnlockUserHandler)).Methods("POST")
+	r.Handle("/api/admin/users/{id}/interactions", admin(handlers.AdminUserInteractionsHandler)).Methods("GET")
+	r.Handle("/api/admin/users/{id}/login-events", admin(handlers.AdminUserLoginEventsHandler)).Methods("GET")
+	r.Handle("/api/admin/sellers", admin(handlers.AdminListSellersHandler)).Methods("GET")
+	r.Handle("/api/admin/sellers/{id}/approve", admin(handlers.AdminApproveSellerHandler)).Methods("POST")
+	r.Handle("/api/admin/sellers/{id}/reject", admin(handlers.AdminRejectSellerHandler)).Methods("POST")
+	r.Handle("/api/admin/sellers/{id}/suspend", admin(handlers.AdminSuspendSellerHandler)).Methods("POST")
+	r.Handle("/api/admin/sellers/{id}/balance", admin(handlers.AdminSellerBalanceHandler)).Methods("GET")
+	r.Handle("/api/admin/sellers/{id}/statement", admin(handlers.AdminSellerStatementHandler)).Methods("GET")
+	r.Handle("/api/admin/commission-rules", admin(handlers.ListCommissionRulesHandler)).Methods("GET")
+	r.Handle("/api/admin/commission-rules", admin(handlers.CreateCommissionRuleHandler)).Methods("POST")
+	r.Handle("/api/admin/commission-rules/{id}", admin(handlers.UpdateCommissionRuleHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/admin/commission-rules/{id}", admin(handlers.DeleteCommissionRuleHandler)).Methods("DELETE")
+	r.Handle("/api/admin/payouts", admin(handlers.ListPayoutsHandler)).Methods("GET")
+	r.Handle("/api/admin/payouts", admin(handlers.RunPayoutsHandler)).Methods("POST")
+	r.Handle("/api/admin/payouts/{id}", admin(handlers.GetPayoutHandler)).Methods("GET")
+	r.Handle("/api/admin/orders", admin(handlers.AdminListOrdersHandler)).Methods("GET")
+	r.Handle("/api/admin/orders/{id}", admin(handlers.GetOrderHandler)).Methods("GET")
+	r.Handle("/api/admin/orders/{id}/status", admin(handlers.AdminSetOrderStatusHandler)).Methods("POST")
+	r.Handle("/api/admin/returns", admin(handlers.AdminListReturnsHandler)).Methods("GET")
+	r.Handle("/api/admin/returns/{id}", admin(handlers.GetReturnHandler)).Methods("GET")
+	r.Handle("/api/admin/returns/{id}/status", admin(handlers.AdminUpdateReturnHandler)).Methods("POST")
+	r.Handle("/api/admin/payments/fake/{intentId}/settle", admin(handlers.AdminSettleFakePaymentHandler)).Methods("POST")
+	r.Handle("/api/admin/tax-rules", admin(handlers.ListTaxRulesHandler)).Methods("GET")
+	r.Handle("/api/admin/tax-rules", admin(handlers.CreateTaxRuleHandler)).Methods("POST")
+	r.Handle("/api/admin/tax-rules/{id}", admin(handlers.UpdateTaxRuleHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/admin/tax-rules/{id}", admin(handlers.DeleteTaxRuleHandler)).Methods("DELETE")
+	r.Handle("/api/admin/shipping-methods", admin(handlers.ListShippingMethodsHandler)).Methods("GET")
+	r.Handle("/api/admin/shipping-methods", admin(handlers.CreateShippingMethodHandler)).Methods("POST")
+	r.Handle("/api/admin/shipping-methods/{id}", admin(handlers.UpdateShippingMethodHandler)).Methods("PUT", "PATCH")
+	r.Handle("/api/admin/shipping-methods/{id}", admin(handlers.DeleteShippingMethodHandler)).Methods("DELETE")
 
-	r.Handle("/api/product/generate-100", middleware.AuthMiddleware(http.HandlerFunc(handlers.Generate100Products))).Methods("POST")
-	r.Handle("/api/product/generate-1000", middleware.AuthMiddleware(http.HandlerFunc(handlers.Generate1000Products))).Methods("POST")
+	writeProducts := middleware.RequireScope(models.ScopeProductsWrite)
+	r.Handle("/api/product/generate-100", adminOnly(writeProducts(http.HandlerFunc(handlers.Generate100Products)))).Methods("POST")
+	r.Handle("/api/product/generate-1000", adminOnly(writeProducts(http.HandlerFunc(handlers.Generate1000Products)))).Methods("POST")
 
 	return r
 }
@@ -0,0 +1,110 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors, the ASCII string
+// "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 appendix B lists 8-digit codes; with 6 digits the code is their
+// last six digits.
+var rfcVectors = []struct {
+	unix int64
+	want string
+}{
+	{59, "287082"},          // 94287082
+	{1111111109, "081804"},  // 07081804
+	{1111111111, "050471"},  // 14050471
+	{1234567890, "005924"},  // 89005924
+	{2000000000, "279037"},  // 69279037
+	{20000000000, "353130"}, // 65353130
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", v.unix, err)
+		}
+		if got != v.want {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, v.want)
+		}
+	}
+}
+
+func TestCodeNormalizesSecret(t *testing.T) {
+	got, err := Code(" gezdgnbvgy3tqojqgezdgnbvgy3tqojq ", Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("Code with lower-case secret = %q, %v", got, err)
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("Code accepted an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	if got, ok := Validate(rfcSecret, "050471", now, 1); !ok || got != step {
+		t.Errorf("current code: step %d, ok %v, want step %d", got, ok, step)
+	}
+	// the code of the previous step is accepted within the skew and
+	// reports that step, so callers can refuse it a second time
+	prev := now.Add(-Period)
+	code, _ := Code(rfcSecret, step-1)
+	if got, ok := Validate(rfcSecret, code, now, 1); !ok || got != step-1 {
+		t.Errorf("previous code: step %d, ok %v, want step %d", got, ok, step-1)
+	}
+	if _, ok := Validate(rfcSecret, code, now, 0); ok {
+		t.Error("previous code accepted without skew")
+	}
+	if _, ok := Validate(rfcSecret, code, prev.Add(3*Period), 1); ok {
+		t.Error("code three steps old accepted")
+	}
+
+	for _, bad := range []string{"", "05047", "0504710", "94287082", "123456"} {
+		if _, ok := Validate(rfcSecret, bad, now, 1); ok {
+			t.Errorf("Validate accepted %q", bad)
+		}
+	}
+	if _, ok := Validate(rfcSecret, " 050471 ", now, 1); !ok {
+		t.Error("surrounding spaces rejected")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(a)
+	if err != nil || len(key) != 20 {
+		t.Fatalf("secret %q decodes to %d bytes, %v", a, len(key), err)
+	}
+	if b, _ := NewSecret(); a == b {
+		t.Error("two secrets are equal")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(ProvisioningURI(rfcSecret, "Marketplace", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Marketplace:alice" {
+		t.Errorf("unexpected URI %s", u)
+	}
+	q := u.Query()
+	for key, want := range map[string]string{
+		"secret": rfcSecret, "issuer": "Marketplace", "algorithm": "SHA1", "digits": "6", "period": "30",
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}